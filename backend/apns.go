@@ -0,0 +1,597 @@
+/*  Pushed - a daemon for parallel handling of push operations to mobile devices
+ *  Copyright (C) 2014  Marco Cilloni <marco.cilloni@yahoo.com>
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *  Exhibit B is not attached; this software is compatible with the
+ *  licenses expressed under Section 1.12 of the MPL v2.
+ */
+
+package backend
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ApnsDefaultMaxHttpConns       = 5
+	ApnsDefaultMaxSleepBeforeFail = 8 * time.Second
+	ApnsProductionHost            = "https://api.push.apple.com"
+	ApnsSandboxHost               = "https://api.sandbox.push.apple.com"
+	ApnsDefaultTimeout            = 10 * time.Second
+	apnsMaxPayloadSize            = 4096
+	apnsTokenLifetime             = 50 * time.Minute //APNs refuses tokens older than one hour, and refreshes more often than every 20 minutes
+)
+
+var (
+	ApnsAuthError            = errors.New("APNs refused the provider credentials. Check them twice.")
+	ApnsInternalServerError  = errors.New("APNs internal server error.")
+	ApnsInvalidConfig        = errors.New("Apns config requires either KeyFile, KeyId and TeamId or Certificate and Key")
+	ApnsInvalidToken         = errors.New("APNs device tokens are hexadecimal strings")
+	ApnsMessageTooLargeError = errors.New("Message is bigger than 4 KiBs (4096 bytes)")
+	ApnsReservedKeyError     = errors.New("Message contains the aps key, which is reserved by APNs")
+	ApnsTimeoutError         = errors.New("Timeout or APNs server unavailable.")
+	ApnsTooManyRequestsError = errors.New("Too many requests to the same device token.")
+	ApnsTopicError           = errors.New("APNs device token is not for the configured Topic. Check it twice.")
+	ApnsWontTryAgain         = errors.New("Connector has given up with message delivery")
+)
+
+type ApnsConfig struct {
+	Host  string //production, sandbox or the base URL of a stand-in server
+	Topic string //bundle ID of the app
+
+	KeyFile string //path of the .p8 key for token based auth
+	KeyId   string
+	TeamId  string
+
+	Certificate string //paths of the PEM certificate and key for certificate based auth
+	Key         string
+
+	MaxTcpConns  int
+	MaxRetryTime time.Duration
+	Timeout      time.Duration
+}
+
+type apns struct {
+	client   *http.Client
+	devices  DeviceStore
+	host     string
+	key      *ecdsa.PrivateKey
+	keyId    string
+	maxSleep time.Duration
+	teamId   string
+	topic    string
+
+	jwtLock   sync.Mutex
+	jwt       string
+	jwtIssued time.Time
+}
+
+type apnsClaims struct {
+	Issuer   string `json:"iss"`
+	IssuedAt int64  `json:"iat"`
+}
+
+type apnsErrorResponse struct {
+	Reason    string `json:"reason"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+type apnsOpData struct {
+	Delay    time.Duration
+	Receipt  *Receipt
+	Data     []byte
+	Message  *Message //for the options and push type
+	Response *http.Response
+	Reauthed bool //a fresh provider token has already been tried
+}
+
+func apnsHost(host string) string {
+
+	switch strings.ToLower(host) {
+	case "", "production":
+		return ApnsProductionHost
+	case "sandbox", "development":
+		return ApnsSandboxHost
+	default:
+		return strings.TrimRight(host, "/")
+	}
+
+}
+
+func init() {
+	RegisterConnectorFactory("apns", func(name string, settings json.RawMessage) (Connector, error) {
+
+		var config ApnsConfig
+
+		if e := json.Unmarshal(settings, &config); e != nil {
+			return nil, e
+		}
+
+		if config.Topic == "" {
+			return nil, errors.New("Apns config object set but no Topic field set")
+		}
+
+		config.MaxRetryTime *= time.Second
+		config.Timeout *= time.Second
+
+		return newApns(name, &config)
+	})
+}
+
+func newApns(name string, config *ApnsConfig) (*apns, error) {
+
+	if config.MaxTcpConns == 0 {
+		config.MaxTcpConns = ApnsDefaultMaxHttpConns
+	}
+
+	if config.MaxRetryTime == 0 {
+		config.MaxRetryTime = ApnsDefaultMaxSleepBeforeFail
+	}
+
+	if config.Timeout == 0 {
+		config.Timeout = ApnsDefaultTimeout
+	}
+
+	apnsI := &apns{
+		host:     apnsHost(config.Host),
+		keyId:    config.KeyId,
+		maxSleep: config.MaxRetryTime,
+		teamId:   config.TeamId,
+		topic:    config.Topic,
+	}
+
+	transport := &http.Transport{
+		ForceAttemptHTTP2:   true,
+		MaxIdleConnsPerHost: config.MaxTcpConns,
+		TLSClientConfig:     &tls.Config{},
+	}
+
+	switch {
+	case config.KeyFile != "" && config.KeyId != "" && config.TeamId != "":
+		keyData, e := ioutil.ReadFile(config.KeyFile)
+
+		if e != nil {
+			return nil, e
+		}
+
+		key, e := parsePrivateKey(keyData)
+
+		if e != nil {
+			return nil, e
+		}
+
+		ecKey, ok := key.(*ecdsa.PrivateKey)
+
+		if !ok {
+			return nil, errors.New("APNs key " + config.KeyFile + " is not an ECDSA key")
+		}
+
+		apnsI.key = ecKey
+
+	case config.Certificate != "" && config.Key != "":
+		cert, e := tls.LoadX509KeyPair(config.Certificate, config.Key)
+
+		if e != nil {
+			return nil, e
+		}
+
+		transport.TLSClientConfig.Certificates = []tls.Certificate{cert}
+
+	default:
+		return nil, ApnsInvalidConfig
+	}
+
+	apnsI.client = &http.Client{Timeout: config.Timeout, Transport: transport}
+
+	devices, e := openDevices(name)
+
+	if e != nil {
+		return nil, e
+	}
+
+	apnsI.devices = devices
+
+	return apnsI, nil
+
+}
+
+func (apns *apns) Exists(deviceTargetId string) (bool, error) {
+
+	return apns.devices.Exists(deviceTargetId)
+
+}
+
+func (apns *apns) Owner(deviceTargetId string) (int64, bool, error) {
+
+	return apns.devices.Owner(deviceTargetId)
+
+}
+
+func (apns *apns) Push(user int64, message Message) ([]Receipt, error) {
+
+	tokens, e := userTokens(apns.devices, user)
+
+	if e != nil {
+		return nil, e
+	}
+
+	return apns.tokensPush(tokens, message)
+
+}
+
+// PushExcept pushes to the devices of users whose tokens are not in reached
+func (apns *apns) PushExcept(users []int64, message Message, reached map[string]bool) ([]Receipt, error) {
+
+	devices, e := devicesExcept(apns.devices, users, reached)
+
+	if e != nil {
+		return nil, e
+	}
+
+	receipts, e := apns.tokensPush(deviceTokens(devices), message)
+
+	for i := range receipts {
+		receipts[i].User = devices[i].User
+	}
+
+	return receipts, e
+
+}
+
+func (apns *apns) Register(user int64, deviceTargetId string) error {
+
+	if _, e := hex.DecodeString(deviceTargetId); e != nil || deviceTargetId == "" {
+		return ApnsInvalidToken
+	}
+
+	return apns.devices.Add(user, deviceTargetId, "")
+
+}
+
+func (apns *apns) Subscribed(user int64) (bool, error) {
+	return apns.devices.Subscribed(user)
+}
+
+func (apns *apns) Unregister(deviceTargetId string) error {
+
+	return apns.devices.Delete(deviceTargetId)
+
+}
+
+// bearer returns the cached provider token, or an empty string when using certificate based auth
+func (apns *apns) bearer() (string, error) {
+
+	if apns.key == nil {
+		return "", nil
+	}
+
+	apns.jwtLock.Lock()
+	defer apns.jwtLock.Unlock()
+
+	now := time.Now()
+
+	if apns.jwt != "" && now.Sub(apns.jwtIssued) < apnsTokenLifetime {
+		return apns.jwt, nil
+	}
+
+	jwt, e := jwtSignES256(apns.key, apns.keyId, &apnsClaims{
+		Issuer:   apns.teamId,
+		IssuedAt: now.Unix(),
+	})
+
+	if e != nil {
+		return "", e
+	}
+
+	apns.jwt, apns.jwtIssued = jwt, now
+
+	return jwt, nil
+}
+
+func (apns *apns) dropBearer() {
+	apns.jwtLock.Lock()
+	apns.jwt = ""
+	apns.jwtLock.Unlock()
+}
+
+func (apns *apns) expRetry(opData *apnsOpData) error {
+
+	if opData.Delay > apns.maxSleep {
+		return ApnsWontTryAgain
+	}
+
+	sleep := opData.Delay
+
+	if 2*opData.Delay > apns.maxSleep {
+		sleep = apns.maxSleep
+	}
+
+	time.Sleep(sleep)
+
+	return apns.payloadPush(opData.Receipt, opData.Data, opData.Message, 2*opData.Delay)
+
+}
+
+func (apns *apns) evalResponse(opData *apnsOpData) error {
+
+	res := opData.Response
+
+	defer res.Body.Close()
+
+	if res.StatusCode == 200 {
+		opData.Receipt.delivered(res.Header.Get("apns-id"))
+		return nil
+	}
+
+	var errResp apnsErrorResponse
+
+	body, e := ioutil.ReadAll(res.Body)
+
+	if e != nil {
+		return e
+	}
+
+	if e = json.Unmarshal(body, &errResp); e != nil {
+		errResp.Reason = string(body)
+	}
+
+	token := opData.Receipt.Token
+
+	switch {
+	case res.StatusCode == 410, errResp.Reason == "Unregistered": //User has removed the application
+		opData.Receipt.removed("Unregistered")
+		return apns.devices.Delete(token)
+
+	case errResp.Reason == "DeviceTokenNotForTopic": //the token is fine, the Topic of pushed is not
+		log.Printf("APNs token %s is not for topic %s", token, apns.topic)
+		return ApnsTopicError
+
+	case errResp.Reason == "BadDeviceToken":
+		log.Printf("APNs token %s has been rejected from server with %s and has been deleted.", token, errResp.Reason)
+		opData.Receipt.removed(errResp.Reason)
+		return apns.devices.Delete(token)
+
+	case res.StatusCode == 413:
+		return ApnsMessageTooLargeError
+
+	case res.StatusCode == 403:
+		apns.dropBearer()
+
+		//APNs may refuse a provider token before its expiry, so sign a new one before giving up
+		if apns.key != nil && !opData.Reauthed {
+			opData.Reauthed = true
+			return apns.send(opData)
+		}
+
+		log.Printf("APNs refused credentials: %s", errResp.Reason)
+		return ApnsAuthError
+
+	case res.StatusCode == 429:
+		log.Println("APNs throttling, beginning exponential retry")
+
+		if e := apns.expRetry(opData); e != ApnsWontTryAgain {
+			return e
+		}
+
+		return ApnsTooManyRequestsError
+
+	case res.StatusCode == 500:
+		log.Println("APNs internal server error, beginning exponential retry")
+
+		if e := apns.expRetry(opData); e != ApnsWontTryAgain {
+			return e
+		}
+
+		return ApnsInternalServerError
+
+	case res.StatusCode == 503:
+		log.Println("APNs unavailable, beginning exponential retry")
+
+		if e := apns.expRetry(opData); e != ApnsWontTryAgain {
+			return e
+		}
+
+		return ApnsTimeoutError
+
+	default:
+		return errors.New("APNs error: " + errResp.Reason)
+	}
+
+}
+
+func (apns *apns) payloadPush(receipt *Receipt, payload []byte, message *Message, retryTime time.Duration) error {
+
+	return apns.send(&apnsOpData{
+		Delay:   retryTime,
+		Receipt: receipt,
+		Data:    payload,
+		Message: message,
+	})
+
+}
+
+func (apns *apns) send(opData *apnsOpData) error {
+
+	bearer, e := apns.bearer()
+
+	if e != nil {
+		return e
+	}
+
+	req, e := http.NewRequest("POST", apns.host+"/3/device/"+url.PathEscape(opData.Receipt.Token), bytes.NewReader(opData.Data))
+
+	if e != nil {
+		return e
+	}
+
+	if bearer != "" {
+		req.Header.Add("Authorization", "bearer "+bearer)
+	}
+
+	req.Header.Add("Content-Type", "application/json")
+
+	options := &opData.Message.Options
+
+	if opData.Message.Notification != nil {
+		req.Header.Add("apns-push-type", "alert")
+
+		if options.Priority == PriorityNormal {
+			req.Header.Add("apns-priority", "5")
+		} else {
+			req.Header.Add("apns-priority", "10")
+		}
+	} else {
+		req.Header.Add("apns-push-type", "background")
+		req.Header.Add("apns-priority", "5") //APNs refuses 10 for background notifications, whatever the priority option says
+	}
+
+	if options.TimeToLive != nil {
+
+		expiration := int64(0) //0 means deliver now or never
+
+		if *options.TimeToLive > 0 {
+			expiration = time.Now().Unix() + int64(*options.TimeToLive)
+		}
+
+		req.Header.Add("apns-expiration", strconv.FormatInt(expiration, 10))
+	}
+
+	if options.CollapseKey != "" {
+		req.Header.Add("apns-collapse-id", options.CollapseKey)
+	}
+
+	if apns.topic != "" {
+		req.Header.Add("apns-topic", apns.topic)
+	}
+
+	if opData.Response, e = apns.client.Do(req); e != nil {
+		return e
+	}
+
+	return apns.evalResponse(opData)
+
+}
+
+type apnsAlert struct {
+	Title        string   `json:"title,omitempty"`
+	Body         string   `json:"body,omitempty"`
+	TitleLocKey  string   `json:"title-loc-key,omitempty"`
+	TitleLocArgs []string `json:"title-loc-args,omitempty"`
+	LocKey       string   `json:"loc-key,omitempty"`
+	LocArgs      []string `json:"loc-args,omitempty"`
+}
+
+type apnsAps struct {
+	Alert            *apnsAlert `json:"alert,omitempty"`
+	Badge            *int       `json:"badge,omitempty"`
+	Sound            string     `json:"sound,omitempty"`
+	Category         string     `json:"category,omitempty"`
+	ContentAvailable int        `json:"content-available,omitempty"`
+}
+
+// apnsPayload puts the message data beside the aps dictionary, as custom data. Without a notification this is a background notification.
+func apnsPayload(message *Message) ([]byte, error) {
+
+	dict := make(map[string]interface{}, len(message.Data)+1)
+
+	for key, value := range message.Data {
+		if key == "aps" {
+			return nil, ApnsReservedKeyError
+		}
+
+		dict[key] = value
+	}
+
+	aps := &apnsAps{ContentAvailable: 1}
+
+	if n := message.Notification; n != nil {
+		aps = &apnsAps{
+			Alert: &apnsAlert{
+				Title:        n.Title,
+				Body:         n.Body,
+				TitleLocKey:  n.TitleLocKey,
+				TitleLocArgs: n.TitleLocArgs,
+				LocKey:       n.BodyLocKey,
+				LocArgs:      n.BodyLocArgs,
+			},
+			Badge:    n.Badge,
+			Sound:    n.Sound,
+			Category: n.ClickAction, //the category chooses the actions, like click_action does on Android
+		}
+	}
+
+	dict["aps"] = aps
+
+	payload, e := json.Marshal(dict)
+
+	if e != nil {
+		return nil, e
+	}
+
+	if len(payload) > apnsMaxPayloadSize {
+		return nil, ApnsMessageTooLargeError
+	}
+
+	return payload, nil
+}
+
+// tokensPush sends one request per token, with at most multicastWorkers at once
+func (apns *apns) tokensPush(tokens []string, message Message) ([]Receipt, error) {
+
+	receipts := newReceipts(tokens)
+
+	payload, e := apnsPayload(&message)
+
+	if e != nil {
+		return settleAll(receipts, e)
+	}
+
+	if message.Options.DryRun { //APNs has no dry run, a valid payload is all we can check
+		return validateAll(receipts)
+	}
+
+	errChan := make(chan error, len(tokens))
+	workers := make(chan bool, multicastWorkers)
+
+	for i := range receipts {
+
+		workers <- true
+
+		go func(receipt *Receipt) {
+
+			defer func() { <-workers }()
+
+			e := apns.payloadPush(receipt, payload, &message, time.Second)
+
+			receipt.settle(e)
+
+			errChan <- e
+		}(&receipts[i])
+	}
+
+	var err error
+
+	for range tokens {
+		if e := <-errChan; e != nil && err == nil {
+			err = e
+		}
+	}
+
+	return receipts, err
+
+}
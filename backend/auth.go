@@ -0,0 +1,266 @@
+/*  Pushed - a daemon for parallel handling of push operations to mobile devices
+ *  Copyright (C) 2014  Marco Cilloni <marco.cilloni@yahoo.com>
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *  Exhibit B is not attached; this software is compatible with the
+ *  licenses expressed under Section 1.12 of the MPL v2.
+ */
+
+package backend
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	MinSecretLength = 16
+
+	secretScheme     = "pbkdf2-sha256"
+	secretIterations = 600000
+	secretSaltSize   = 16
+	secretKeySize    = 32
+)
+
+var (
+	ErrInvalidClientId   = errors.New("Client IDs must match [a-zA-Z0-9-_.]+")
+	ErrInvalidSecret     = errors.New("Secrets must be at least 16 characters long")
+	ErrInvalidSecretHash = errors.New("Secret hashes must be in the format given by pushed -hashsecret")
+	ErrUnknownClient     = errors.New("No client with the given ID")
+	clientIdRegexp       = regexp.MustCompile(`^[a-zA-Z0-9\-_.]{1,255}$`)
+	dummyHash            string
+	dummyHashOnce        sync.Once
+)
+
+// Acl limits what a client can do. Commands lists the commands it can send, where a command like TEMPLATE
+// allows all of its subcommands, or * for all of them. If Users is not empty, the client can only act on the
+// users in its ranges, and cannot reach everyone with BROADCAST or PUSHTOPIC.
+type Acl struct {
+	Commands []string    `json:"commands"`
+	Users    []UserRange `json:"users,omitempty"`
+}
+
+// UserRange holds the user IDs from From to To, both included
+type UserRange struct {
+	From int64 `json:"from"`
+	To   int64 `json:"to"`
+}
+
+// AllowsCommand tells if cmd is allowed. A nil Acl allows everything.
+func (acl *Acl) AllowsCommand(cmd string) bool {
+
+	if acl == nil {
+		return true
+	}
+
+	for _, allowed := range acl.Commands {
+		if allowed == "*" || allowed == cmd || strings.HasPrefix(cmd, allowed+" ") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// AllowsUser tells if user is in the ranges of acl
+func (acl *Acl) AllowsUser(user int64) bool {
+
+	if acl == nil || len(acl.Users) == 0 {
+		return true
+	}
+
+	for _, users := range acl.Users {
+		if user >= users.From && user <= users.To {
+			return true
+		}
+	}
+
+	return false
+}
+
+// RestrictsUsers tells if acl allows only some users
+func (acl *Acl) RestrictsUsers() bool {
+	return acl != nil && len(acl.Users) > 0
+}
+
+func ValidClientId(id string) bool {
+	return clientIdRegexp.MatchString(id)
+}
+
+// HashSecret hashes secret with PBKDF2 and a random salt, in a format CheckSecret understands
+func HashSecret(secret string) (string, error) {
+
+	if len(secret) < MinSecretLength {
+		return "", ErrInvalidSecret
+	}
+
+	salt := make([]byte, secretSaltSize)
+
+	if _, e := rand.Read(salt); e != nil {
+		return "", e
+	}
+
+	return hashSecret(secret, salt, secretIterations)
+}
+
+func hashSecret(secret string, salt []byte, iterations int) (string, error) {
+
+	key, e := pbkdf2.Key(sha256.New, secret, salt, iterations, secretKeySize)
+
+	if e != nil {
+		return "", e
+	}
+
+	return strings.Join([]string{
+		secretScheme,
+		strconv.Itoa(iterations),
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	}, "$"), nil
+}
+
+// parseSecretHash splits a hash given by HashSecret in its iterations, salt and key
+func parseSecretHash(hash string) (iterations int, salt, key []byte, e error) {
+
+	parts := strings.Split(hash, "$")
+
+	if len(parts) != 4 || parts[0] != secretScheme {
+		return 0, nil, nil, ErrInvalidSecretHash
+	}
+
+	if iterations, e = strconv.Atoi(parts[1]); e != nil || iterations <= 0 {
+		return 0, nil, nil, ErrInvalidSecretHash
+	}
+
+	if salt, e = base64.RawStdEncoding.DecodeString(parts[2]); e != nil {
+		return 0, nil, nil, ErrInvalidSecretHash
+	}
+
+	if key, e = base64.RawStdEncoding.DecodeString(parts[3]); e != nil || len(key) == 0 {
+		return 0, nil, nil, ErrInvalidSecretHash
+	}
+
+	return
+}
+
+func ValidSecretHash(hash string) bool {
+
+	_, _, _, e := parseSecretHash(hash)
+
+	return e == nil
+}
+
+// CheckSecret tells if secret is the one hash was made from
+func CheckSecret(hash, secret string) bool {
+
+	iterations, salt, key, e := parseSecretHash(hash)
+
+	if e != nil {
+		return false
+	}
+
+	computed, e := pbkdf2.Key(sha256.New, secret, salt, iterations, len(key))
+
+	return e == nil && subtle.ConstantTimeCompare(computed, key) == 1
+}
+
+// CheckNoSecret takes as long as CheckSecret, so that unknown clients cannot be told apart from wrong secrets
+func CheckNoSecret(secret string) {
+
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = hashSecret("", make([]byte, secretSaltSize), secretIterations)
+	})
+
+	CheckSecret(dummyHash, secret)
+}
+
+// AddClient stores the hash of the secret of a client of the line protocol and its acl, if any, replacing
+// any previous one
+func AddClient(id, secret string, acl *Acl) error {
+
+	if e := needsPostgres(); e != nil {
+		return e
+	}
+
+	if !ValidClientId(id) {
+		return ErrInvalidClientId
+	}
+
+	hash, e := HashSecret(secret)
+
+	if e != nil {
+		return e
+	}
+
+	var encoded sql.NullString
+
+	if acl != nil {
+
+		b, e := json.Marshal(acl)
+
+		if e != nil {
+			return e
+		}
+
+		encoded = sql.NullString{String: string(b), Valid: true}
+	}
+
+	log.Printf("Setting the secret of client %s", id)
+
+	_, e = globalDb.conn.Exec(`INSERT INTO CLIENTS VALUES ($1,$2,$3)
+		ON CONFLICT (ID) DO UPDATE SET SECRET = EXCLUDED.SECRET, ACL = EXCLUDED.ACL`, id, hash, encoded)
+
+	return e
+}
+
+func DelClient(id string) error {
+
+	if e := needsPostgres(); e != nil {
+		return e
+	}
+
+	log.Printf("Deleting client %s", id)
+
+	_, e := globalDb.conn.Exec("DELETE FROM CLIENTS WHERE ID = $1", id)
+
+	return e
+}
+
+// ClientSecret returns the hashed secret of the client with the given ID, and its acl if it has one.
+// Without the Postgres store, there are only the clients in the configuration.
+func ClientSecret(id string) (hash string, acl *Acl, e error) {
+
+	if !UsesPostgres() {
+		return "", nil, ErrUnknownClient
+	}
+
+	var encoded sql.NullString
+
+	e = globalDb.conn.QueryRow("SELECT SECRET, ACL FROM CLIENTS WHERE ID = $1", id).Scan(&hash, &encoded)
+
+	if e == sql.ErrNoRows {
+		return "", nil, ErrUnknownClient
+	}
+
+	if e != nil || !encoded.Valid {
+		return
+	}
+
+	acl = new(Acl)
+	e = json.Unmarshal([]byte(encoded.String), acl)
+
+	return
+}
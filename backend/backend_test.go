@@ -11,9 +11,33 @@
 package backend
 
 import (
-	//	"math/rand"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
-	//	"time"
+	"text/template"
+	"time"
 )
 
 /*func TestCreate(t *testing.T) {
@@ -165,10 +189,1370 @@ func TestCloseDb(t *testing.T) {
 }*/
 
 func TestMarshal(t *testing.T) {
-	gcmI := new(gcm)
 
-	gcmI.Push([]string{"abc", "def"}, Message{
-		"gigia": "bargigia",
-		"giga":  "bargiga",
+	payload, e := json.Marshal(&gcmPayload{
+		RegIds: []string{"abc", "def"},
+		Data: map[string]interface{}{
+			"gigia": "bargigia",
+			"giga":  "bargiga",
+		},
 	})
+
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	const expected = `{"registration_ids":["abc","def"],"data":{"giga":"bargiga","gigia":"bargigia"}}`
+
+	if string(payload) != expected {
+		t.Errorf("Marshalled payload is %s, expected %s", payload, expected)
+	}
+}
+
+func TestMessageSections(t *testing.T) {
+
+	var message Message
+
+	e := json.Unmarshal([]byte(`{"data":{"id":12345678901234567890,"tags":["a"]},"notification":{"title":"Hi","badge":3}}`), &message)
+
+	if e != nil || message.Notification == nil || message.Notification.Title != "Hi" {
+		t.Fatalf("Sections not accepted: %v, %+v", e, message)
+	}
+
+	if id, ok := message.Data["id"].(json.Number); !ok || id.String() != "12345678901234567890" {
+		t.Errorf("Number has not been kept as it is: %v", message.Data["id"])
+	}
+
+	//a bare object of data may have a data key too, as long as the object is not made of sections only
+	if e = json.Unmarshal([]byte(`{"data":"x","count":1}`), &message); e != nil || message.Data["data"] != "x" {
+		t.Errorf("Bare data mistaken for sections: %v, %+v", e, message)
+	}
+
+	data, e := stringData(map[string]interface{}{"s": "x", "n": json.Number("1"), "a": []interface{}{"b"}})
+
+	if e != nil || data["s"] != "x" || data["n"] != "1" || data["a"] != `["b"]` {
+		t.Errorf("Unexpected string data %v, %v", data, e)
+	}
+
+	badge := 3
+
+	payload, e := apnsPayload(&Message{Notification: &Notification{Title: "Hi", Badge: &badge}})
+
+	if e != nil || string(payload) != `{"aps":{"alert":{"title":"Hi"},"badge":3}}` {
+		t.Errorf("Unexpected APNs payload %s, %v", payload, e)
+	}
+
+	big := &Message{Notification: &Notification{Body: strings.Repeat("a", gcmMaxPayloadSize)}}
+
+	if _, e = gcmMessage(big); e != GcmMessageTooLargeError {
+		t.Errorf("Oversized notification accepted by GCM: %v", e)
+	}
+}
+
+func TestMessageOptions(t *testing.T) {
+
+	var message Message
+
+	if e := json.Unmarshal([]byte(`{"giga":"bargiga"}`), &message); e != nil || message.Data["giga"] != "bargiga" {
+		t.Errorf("Bare data not accepted: %v, %+v", e, message)
+	}
+
+	e := json.Unmarshal([]byte(`{"data":{"giga":"bargiga"},"options":{"time_to_live":60,"priority":"high"}}`), &message)
+
+	if e != nil || message.Data["giga"] != "bargiga" || *message.Options.TimeToLive != 60 {
+		t.Fatalf("Data with options not accepted: %v, %+v", e, message)
+	}
+
+	if e = message.Options.Validate(); e != nil {
+		t.Error(e)
+	}
+
+	if android := fcmAndroid(&message.Options, nil); android.Ttl != "60s" || android.Priority != "HIGH" {
+		t.Errorf("Unexpected FCM android config %+v", android)
+	}
+
+	if e = json.Unmarshal([]byte(`{"data":{},"options":{"ttl":60}}`), &message); e == nil {
+		t.Error("Unknown option accepted")
+	}
+
+	ttl := MaxTimeToLive + 1
+
+	for _, options := range []PushOptions{{TimeToLive: &ttl}, {Priority: "urgent"}, {CollapseKey: strings.Repeat("a", 65)}} {
+		if e = options.Validate(); e == nil {
+			t.Errorf("Invalid options %+v accepted", options)
+		}
+	}
+}
+
+// redirectTransport sends every request to the test server at host, for connectors with fixed URLs
+type redirectTransport struct {
+	host string
+}
+
+func (redirect *redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+
+	req.URL.Scheme, req.URL.Host = "http", redirect.host
+
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestGcmRetry(t *testing.T) {
+
+	var sent [][]string
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		var payload gcmPayload
+
+		if e := json.NewDecoder(r.Body).Decode(&payload); e != nil {
+			w.WriteHeader(400)
+			return
+		}
+
+		sent = append(sent, payload.RegIds)
+
+		response := gcmResponse{Results: make([]gcmResult, len(payload.RegIds))}
+
+		for i, regid := range payload.RegIds {
+			if regid == "b" && len(sent) == 1 {
+				response.Results[i].Error = "Unavailable"
+			} else {
+				response.Results[i].MessageId = "id-" + regid
+			}
+		}
+
+		json.NewEncoder(w).Encode(&response)
+	}))
+	defer srv.Close()
+
+	store := &memoryStore{users: make(map[int64]bool), tables: make(map[string]*memoryDevices)}
+	devices, _ := store.Devices("gcm", DevicePolicy{})
+
+	for user, regids := range map[int64][]string{1: {"a", "b", "c"}, 2: {"d"}} {
+
+		if e := store.AddUser(user); e != nil {
+			t.Fatal(e)
+		}
+
+		for _, regid := range regids {
+			if e := devices.Add(user, regid, ""); e != nil {
+				t.Fatal(e)
+			}
+		}
+	}
+
+	gcmI := &gcm{client: &http.Client{Transport: &redirectTransport{strings.TrimPrefix(srv.URL, "http://")}}, devices: devices, maxSleep: time.Second}
+
+	receipts, e := gcmI.PushExcept([]int64{1, 2}, Message{Data: map[string]interface{}{"giga": "bargiga"}}, map[string]bool{"d": true})
+
+	if e != nil || len(receipts) != 3 {
+		t.Fatalf("Got receipts %+v and error %v, expected 3 receipts", receipts, e)
+	}
+
+	for _, receipt := range receipts {
+		if receipt.State != DeviceDelivered || receipt.User != 1 || receipt.MessageId != "id-"+receipt.Token {
+			t.Errorf("Receipt %+v not delivered to user 1", receipt)
+		}
+	}
+
+	if len(sent) != 2 || len(sent[0]) != 3 || !reflect.DeepEqual(sent[1], []string{"b"}) {
+		t.Errorf("Sent %v, expected to send again only the unavailable registration ID", sent)
+	}
+}
+
+func TestFcmPush(t *testing.T) {
+
+	key, e := rsa.GenerateKey(rand.Reader, 2048)
+
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	var minted, sent int32
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("grant_type") != fcmGrantType || strings.Count(r.FormValue("assertion"), ".") != 2 {
+			w.WriteHeader(400)
+			return
+		}
+
+		//the first token is revoked before its expiry
+		if atomic.AddInt32(&minted, 1) == 1 {
+			w.Write([]byte(`{"access_token":"revoked","expires_in":3600,"token_type":"Bearer"}`))
+			return
+		}
+
+		w.Write([]byte(`{"access_token":"fake","expires_in":3600,"token_type":"Bearer"}`))
+	})
+
+	mux.HandleFunc("/v1/projects/test/messages:send", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&sent, 1)
+
+		if r.Header.Get("Authorization") != "Bearer fake" {
+			w.WriteHeader(401)
+			return
+		}
+
+		var payload fcmPayload
+
+		if e := json.NewDecoder(r.Body).Decode(&payload); e != nil || payload.Message.Token == "broken" {
+			w.WriteHeader(400)
+			w.Write([]byte(`{"error":{"code":400,"status":"INVALID_ARGUMENT","details":[{"@type":"type.googleapis.com/google.rpc.BadRequest","fieldViolations":[{"field":"message.token"}]}]}}`))
+			return
+		}
+
+		if payload.Message.Data["giga"] != "bargiga" {
+			w.WriteHeader(400)
+			w.Write([]byte(`{"error":{"code":400,"status":"INVALID_ARGUMENT","details":[{"@type":"type.googleapis.com/google.rpc.BadRequest","fieldViolations":[{"field":"message.data"}]}]}}`))
+			return
+		}
+
+		w.Write([]byte(`{"name":"projects/test/messages/1"}`))
+	})
+
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	store := &memoryStore{users: make(map[int64]bool), tables: make(map[string]*memoryDevices)}
+	devices, _ := store.Devices("fcm", DevicePolicy{})
+
+	if e = store.AddUser(1); e != nil {
+		t.Fatal(e)
+	}
+
+	for _, token := range []string{"abc", "def", "broken"} {
+		if e = devices.Add(1, token, ""); e != nil {
+			t.Fatal(e)
+		}
+	}
+
+	fcmI := &fcm{
+		client:   srv.Client(),
+		devices:  devices,
+		email:    "pushed@test.iam.gserviceaccount.com",
+		key:      key,
+		maxSleep: time.Second,
+		sendUrl:  srv.URL + "/v1/projects/test/messages:send",
+		tokenUrl: srv.URL + "/token",
+	}
+
+	receipts, e := fcmI.tokensPush([]string{"abc"}, Message{Data: map[string]interface{}{"giga": "bargiga"}})
+
+	if e != nil || receipts[0].State != DeviceDelivered {
+		t.Fatalf("Push with a revoked access token not retried, got %+v, error %v", receipts, e)
+	}
+
+	if minted != 2 || sent != 2 {
+		t.Errorf("Expected a single retry with a new access token, got %d tokens and %d requests", minted, sent)
+	}
+
+	atomic.StoreInt32(&sent, 0)
+
+	if receipts, e = fcmI.tokensPush([]string{"abc", "def"}, Message{Data: map[string]interface{}{"giga": "bargiga"}}); e != nil {
+		t.Fatal(e)
+	}
+
+	if sent != 2 {
+		t.Errorf("Expected one request per token, got %d", sent)
+	}
+
+	for _, receipt := range receipts {
+		if receipt.State != DeviceDelivered || receipt.MessageId != "1" {
+			t.Errorf("Unexpected receipt %+v", receipt)
+		}
+	}
+
+	if minted != 2 {
+		t.Errorf("Access token has been minted %d times, expected it to be cached", minted)
+	}
+
+	if receipts, e = fcmI.tokensPush([]string{"abc"}, Message{Data: map[string]interface{}{"google.foo": "bar"}}); e != FcmReservedKeyError || receipts[0].State != DeviceFailed {
+		t.Errorf("Expected reserved key error, got %v", e)
+	}
+
+	//an argument other than the token is wrong, so the device must stay
+	if receipts, e = fcmI.tokensPush([]string{"def"}, Message{Data: map[string]interface{}{"giga": "giga"}}); e == nil || receipts[0].State != DeviceFailed {
+		t.Errorf("Expected a failed receipt, got %+v, error %v", receipts, e)
+	}
+
+	if receipts, e = fcmI.tokensPush([]string{"broken"}, Message{Data: map[string]interface{}{"giga": "bargiga"}}); e != nil || receipts[0].State != DeviceRemoved {
+		t.Errorf("Expected a removed receipt, got %+v, error %v", receipts, e)
+	}
+
+	for token, kept := range map[string]bool{"def": true, "broken": false} {
+		if exists, _ := devices.Exists(token); exists != kept {
+			t.Errorf("Token %s exists: %v, expected %v", token, exists, kept)
+		}
+	}
+}
+
+func TestApnsPush(t *testing.T) {
+
+	key, e := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	var sent, expired int32
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&sent, 1)
+
+		switch r.URL.Path {
+		case "/3/device/stale":
+			if atomic.AddInt32(&expired, 1) == 1 {
+				w.WriteHeader(403)
+				w.Write([]byte(`{"reason":"ExpiredProviderToken"}`))
+				return
+			}
+		case "/3/device/other":
+			w.WriteHeader(400)
+			w.Write([]byte(`{"reason":"DeviceTokenNotForTopic"}`))
+			return
+		}
+
+		if r.ProtoMajor != 2 {
+			w.WriteHeader(400)
+			w.Write([]byte(`{"reason":"BadRequest"}`))
+			return
+		}
+
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "bearer ") || r.Header.Get("apns-topic") != "com.example.app" {
+			w.WriteHeader(403)
+			w.Write([]byte(`{"reason":"InvalidProviderToken"}`))
+			return
+		}
+
+		var payload map[string]interface{}
+
+		if e := json.NewDecoder(r.Body).Decode(&payload); e != nil || payload["giga"] != "bargiga" || payload["aps"] == nil {
+			w.WriteHeader(400)
+			w.Write([]byte(`{"reason":"PayloadEmpty"}`))
+			return
+		}
+
+		w.Header().Set("apns-id", "EC1BF194-B3B2-424A-89A9-5A918A6E6B5D")
+	}))
+
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	apnsI := &apns{
+		client:   srv.Client(),
+		host:     srv.URL,
+		key:      key,
+		keyId:    "ABC123DEFG",
+		maxSleep: time.Second,
+		teamId:   "DEF123GHIJ",
+		topic:    "com.example.app",
+	}
+
+	receipts, e := apnsI.tokensPush([]string{"abc", "def"}, Message{Data: map[string]interface{}{"giga": "bargiga"}})
+
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	if sent != 2 {
+		t.Errorf("Expected one request per token, got %d", sent)
+	}
+
+	for _, receipt := range receipts {
+		if receipt.State != DeviceDelivered || receipt.MessageId == "" {
+			t.Errorf("Unexpected receipt %+v", receipt)
+		}
+	}
+
+	message := Message{Data: map[string]interface{}{"giga": "bargiga"}, Options: PushOptions{DryRun: true}}
+
+	if receipts, e = apnsI.tokensPush([]string{"abc"}, message); e != nil || receipts[0].State != DeviceValidated || sent != 2 {
+		t.Errorf("Dry run got %+v, error %v, %d requests", receipts, e, sent)
+	}
+
+	if receipts, e = apnsI.tokensPush([]string{"stale"}, Message{Data: map[string]interface{}{"giga": "bargiga"}}); e != nil || receipts[0].State != DeviceDelivered || expired != 2 {
+		t.Errorf("Expected a retry with a new provider token, got %+v, error %v", receipts, e)
+	}
+
+	//apnsI has no device store, so deleting the token would panic
+	if receipts, e = apnsI.tokensPush([]string{"other"}, Message{Data: map[string]interface{}{"giga": "bargiga"}}); e != ApnsTopicError || receipts[0].State != DeviceFailed {
+		t.Errorf("Expected a topic error, got %+v, error %v", receipts, e)
+	}
+
+	if e = apnsI.Register(1, "../../3/device/abc"); e != ApnsInvalidToken {
+		t.Errorf("Expected a non hexadecimal token to be refused, got %v", e)
+	}
+
+	if _, e = apnsPayload(&Message{Data: map[string]interface{}{"aps": "{}"}}); e != ApnsReservedKeyError {
+		t.Errorf("Expected reserved key error, got %v", e)
+	}
+}
+
+func TestWebPushEncrypt(t *testing.T) {
+
+	uaPrivate, e := ecdh.P256().GenerateKey(rand.Reader)
+
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	authSecret := make([]byte, 16)
+	rand.Read(authSecret)
+
+	uaPublic := uaPrivate.PublicKey().Bytes()
+
+	keys := &webPushKeys{
+		P256dh: base64.RawURLEncoding.EncodeToString(uaPublic),
+		Auth:   base64.RawURLEncoding.EncodeToString(authSecret),
+	}
+
+	const plaintext = `{"giga":"bargiga"}`
+
+	body, e := webPushEncrypt(keys, []byte(plaintext))
+
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	//decrypt as a user agent would, following RFC 8291
+	salt, idLen := body[:16], int(body[20])
+	asPublicRaw := body[21 : 21+idLen]
+
+	asPublic, e := ecdh.P256().NewPublicKey(asPublicRaw)
+
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	ecdhSecret, e := uaPrivate.ECDH(asPublic)
+
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	keyInfo := append(append([]byte("WebPush: info\x00"), uaPublic...), asPublicRaw...)
+	prk := hmacSha256(salt, hkdfExpand(hmacSha256(authSecret, ecdhSecret), keyInfo, 32))
+
+	block, _ := aes.NewCipher(hkdfExpand(prk, []byte("Content-Encoding: aes128gcm\x00"), 16))
+	aead, _ := cipher.NewGCM(block)
+
+	decrypted, e := aead.Open(nil, hkdfExpand(prk, []byte("Content-Encoding: nonce\x00"), 12), body[21+idLen:], nil)
+
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	if string(decrypted) != plaintext+"\x02" {
+		t.Errorf("Decrypted %q, expected %q", decrypted, plaintext+"\x02")
+	}
+
+	if _, e = webPushEncrypt(keys, make([]byte, 4096)); e != WebPushMessageTooLargeError {
+		t.Errorf("Expected message too large error, got %v", e)
+	}
+}
+
+func TestWebPushHosts(t *testing.T) {
+
+	store := &memoryStore{users: make(map[int64]bool), tables: make(map[string]*memoryDevices)}
+	devices, _ := store.Devices("webpush", DevicePolicy{})
+	store.AddUser(1)
+
+	hosts, e := newWebhookHosts(nil)
+
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	wpI := &webPush{devices: devices, hosts: hosts}
+
+	uaPrivate, _ := ecdh.P256().GenerateKey(rand.Reader)
+
+	subscription := func(endpoint string) string {
+		sub, _ := json.Marshal(&webPushSubscription{
+			Endpoint: endpoint,
+			Keys: webPushKeys{
+				P256dh: base64.RawURLEncoding.EncodeToString(uaPrivate.PublicKey().Bytes()),
+				Auth:   base64.RawURLEncoding.EncodeToString(make([]byte, 16)),
+			},
+		})
+
+		return string(sub)
+	}
+
+	if e = wpI.Register(1, subscription("http://push.example.com/abc")); e != WebPushInvalidSubscription {
+		t.Errorf("Expected a plain http endpoint to be refused, got %v", e)
+	}
+
+	for _, endpoint := range []string{"https://127.0.0.1/abc", "https://10.1.2.3/abc", "https://[::1]:8443/abc"} {
+		if e = wpI.Register(1, subscription(endpoint)); e != WebPushForbiddenHost {
+			t.Errorf("Endpoint %s not refused, got %v", endpoint, e)
+		}
+	}
+
+	if wpI.hosts, e = newWebhookHosts([]string{"127.0.0.0/8"}); e != nil {
+		t.Fatal(e)
+	}
+
+	if e = wpI.Register(1, subscription("https://127.0.0.1/abc")); e != nil {
+		t.Errorf("Allowed endpoint refused: %v", e)
+	}
+}
+
+func TestWebhookSignature(t *testing.T) {
+
+	const secret = "gigia"
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+
+		if r.Header.Get(WebhookDefaultSignatureHeader) != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+			w.WriteHeader(500)
+		}
+	}))
+
+	defer srv.Close()
+
+	whI := &webhook{
+		client:          srv.Client(),
+		maxSleep:        0,
+		secret:          []byte(secret),
+		signatureHeader: WebhookDefaultSignatureHeader,
+	}
+
+	payload, _ := json.Marshal(&webhookPayload{User: 42, Message: map[string]interface{}{"giga": "bargiga"}})
+
+	receipt := &Receipt{Token: srv.URL, State: DevicePending}
+
+	if e := whI.payloadPush(Device{Token: srv.URL}, receipt, payload, time.Second); e != nil || receipt.State != DeviceDelivered {
+		t.Error(e)
+	}
+}
+
+func TestWebhookHosts(t *testing.T) {
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	store := &memoryStore{users: make(map[int64]bool), tables: make(map[string]*memoryDevices)}
+	devices, _ := store.Devices("webhook", DevicePolicy{})
+	store.AddUser(1)
+
+	hosts, e := newWebhookHosts(nil)
+
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	whI := &webhook{
+		client:          &http.Client{Transport: &http.Transport{DialContext: hosts.dial}},
+		devices:         devices,
+		hosts:           hosts,
+		maxSleep:        0,
+		signatureHeader: WebhookDefaultSignatureHeader,
+	}
+
+	for _, target := range []string{"http://127.0.0.1/", "http://localhost:8080/", "https://10.1.2.3/", "http://[::1]/", "http://169.254.169.254/latest"} {
+		if e = whI.Register(1, target); e != WebhookForbiddenHost {
+			t.Errorf("Target %s not refused, got %v", target, e)
+		}
+	}
+
+	receipt := &Receipt{Token: srv.URL, State: DevicePending}
+
+	if e = whI.payloadPush(Device{Token: srv.URL}, receipt, []byte("{}"), time.Second); !errors.Is(e, WebhookForbiddenHost) {
+		t.Errorf("Expected the dial to a loopback address to be refused, got %v", e)
+	}
+
+	if whI.hosts, e = newWebhookHosts([]string{"127.0.0.0/8", "LocalHost"}); e != nil {
+		t.Fatal(e)
+	}
+
+	for _, target := range []string{srv.URL, "http://localhost:8080/"} {
+		if e = whI.Register(1, target); e != nil {
+			t.Errorf("Allowed target %s refused: %v", target, e)
+		}
+	}
+
+	if _, e = newWebhookHosts([]string{"10.0.0.0/33"}); e == nil {
+		t.Error("Invalid CIDR accepted")
+	}
+}
+
+// smtpSink accepts a single SMTP session, sending what has been received after DATA on the returned channel.
+// Commands in replies get the given reply instead.
+func smtpSink(t *testing.T, replies map[string]string) (string, <-chan string) {
+
+	l, e := net.Listen("tcp", "127.0.0.1:0")
+
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	received := make(chan string, 1)
+
+	go func() {
+		defer l.Close()
+
+		conn, e := l.Accept()
+
+		if e != nil {
+			return
+		}
+
+		defer conn.Close()
+
+		text := textproto.NewConn(conn)
+		text.PrintfLine("220 sink ESMTP")
+
+		for {
+			line, e := text.ReadLine()
+
+			if e != nil {
+				return
+			}
+
+			verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+
+			if reply, ok := replies[verb]; ok {
+				text.PrintfLine("%s", reply)
+				continue
+			}
+
+			switch verb {
+			case "DATA":
+				text.PrintfLine("354 go ahead")
+				data, _ := text.ReadDotBytes()
+				received <- string(data)
+				text.PrintfLine("250 ok")
+			case "QUIT":
+				text.PrintfLine("221 bye")
+				return
+			default:
+				text.PrintfLine("250 ok")
+			}
+		}
+	}()
+
+	return l.Addr().String(), received
+}
+
+func TestEmailSend(t *testing.T) {
+
+	addr, received := smtpSink(t, nil)
+
+	emailI := &email{
+		from:    "pushed@example.com",
+		relay:   addr,
+		subject: template.Must(template.New("subject").Parse("Hi {{.User}}")),
+		text:    template.Must(template.New("text").Parse(emailDefaultText)),
+		timeout: time.Second,
+	}
+
+	msg, e := emailI.render(&emailContext{User: 42, To: "user@example.com", Message: map[string]interface{}{"giga": "bargiga"}})
+
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	if e = emailI.send(&Receipt{Token: "user@example.com", State: DevicePending}, msg, time.Second); e != nil {
+		t.Fatal(e)
+	}
+
+	data := <-received
+
+	if !strings.Contains(data, "Subject: Hi 42") || !strings.Contains(data, "giga: bargiga") {
+		t.Errorf("Unexpected e-mail:\n%s", data)
+	}
+}
+
+func TestEmailRejected(t *testing.T) {
+
+	store := &memoryStore{users: make(map[int64]bool), tables: make(map[string]*memoryDevices)}
+	devices, _ := store.Devices("email", DevicePolicy{})
+	store.AddUser(1)
+	devices.Add(1, "user@example.com", "")
+
+	for _, test := range []struct {
+		verb    string
+		removed bool
+	}{
+		{"MAIL", false}, //the sender is refused, not the address
+		{"RCPT", true},
+	} {
+		addr, _ := smtpSink(t, map[string]string{test.verb: "550 no such mailbox"})
+
+		emailI := &email{devices: devices, from: "pushed@example.com", relay: addr, timeout: time.Second}
+		receipt := &Receipt{Token: "user@example.com", State: DevicePending}
+
+		emailI.send(receipt, []byte("Subject: hi\r\n\r\nhi\r\n"), time.Second)
+
+		if found, _ := devices.Exists("user@example.com"); found == test.removed || (receipt.State == DeviceRemoved) != test.removed {
+			t.Errorf("550 to %s: address removed %v, receipt %+v", test.verb, !found, receipt)
+		}
+	}
+}
+
+type fakeConnector struct {
+	pushErr error
+}
+
+func (fake *fakeConnector) Exists(deviceTargetId string) (bool, error) { return false, nil }
+func (fake *fakeConnector) Push(user int64, message Message) ([]Receipt, error) {
+	return nil, fake.pushErr
+}
+func (fake *fakeConnector) Register(user int64, deviceTargetId string) error { return nil }
+func (fake *fakeConnector) Subscribed(user int64) (bool, error)              { return false, nil }
+func (fake *fakeConnector) Unregister(deviceTargetId string) error           { return nil }
+
+func TestConnectorRegistry(t *testing.T) {
+
+	failure := errors.New("gigia")
+
+	RegisterConnectorFactory("fake", func(name string, settings json.RawMessage) (Connector, error) {
+
+		var config struct{ Fail bool }
+
+		if e := json.Unmarshal(settings, &config); e != nil {
+			return nil, e
+		}
+
+		if config.Fail {
+			return &fakeConnector{pushErr: failure}, nil
+		}
+
+		return &fakeConnector{pushErr: ErrNotRegistered}, nil
+	})
+
+	defer func() {
+		delete(factories, "fake")
+		delete(connectors, "fake_ok")
+		delete(connectors, "fake_ko")
+	}()
+
+	if e := InitConnector("fake", "fake_ok", nil, DevicePolicy{}); e != nil {
+		t.Fatal(e)
+	}
+
+	if e := InitConnector("fake", "fake_ko", json.RawMessage(`{"Fail":true}`), DevicePolicy{}); e != nil {
+		t.Fatal(e)
+	}
+
+	if e := InitConnector("fake", "fake_ok", nil, DevicePolicy{}); e != ErrConnectorExists {
+		t.Errorf("Expected duplicate instance error, got %v", e)
+	}
+
+	if e := InitConnector("fake", "Fake-Bad", nil, DevicePolicy{}); e != ErrInvalidConnectorName {
+		t.Errorf("Expected invalid name error, got %v", e)
+	}
+
+	if e := InitConnector("missing", "missing", nil, DevicePolicy{}); e != ErrUnknownConnectorType {
+		t.Errorf("Expected unknown type error, got %v", e)
+	}
+
+	if GetConnector("FAKE_OK") == nil {
+		t.Error("GetConnector cannot find fake_ok")
+	}
+
+	failed, errs := PushAll(42, Message{})
+
+	if !failed || len(errs) != 1 || errs["fake_ko"] != failure {
+		t.Errorf("PushAll errors are %v, expected only fake_ko to fail", errs)
+	}
+
+	results := pushEach([]int64{42}, Message{}, map[string]*progress{"fake_ko": {settled: true}})
+
+	if len(results) != 1 || results["fake_ok"] == nil || results["fake_ok"].e != ErrNotRegistered {
+		t.Errorf("pushEach results are %v, expected only fake_ok", results)
+	}
+}
+
+// evenConnector has a device for each even user
+type evenConnector struct {
+	fakeConnector
+}
+
+func (even *evenConnector) Push(user int64, message Message) ([]Receipt, error) {
+
+	if user%2 != 0 {
+		return nil, ErrNotRegistered
+	}
+
+	return []Receipt{{Token: strconv.FormatInt(user, 10), State: DeviceDelivered}}, nil
+}
+
+func TestPushMany(t *testing.T) {
+
+	users := make([]int64, 100)
+
+	for i := range users {
+		users[i] = int64(i)
+	}
+
+	receipts, e := pushMany(&evenConnector{}, users, Message{})
+
+	if e != nil || len(receipts) != 50 {
+		t.Errorf("Got %d receipts and error %v, expected 50 receipts", len(receipts), e)
+	}
+
+	for _, receipt := range receipts {
+		if receipt.Token != strconv.FormatInt(receipt.User, 10) {
+			t.Errorf("Receipt %s belongs to user %d", receipt.Token, receipt.User)
+		}
+	}
+
+	prog := &progress{reached: map[string]bool{"0": true}, done: map[int64]bool{0: true, 2: false}}
+
+	if retried, e := pushRemaining(&evenConnector{}, users, Message{}, prog); e != nil || len(retried) != 49 {
+		t.Errorf("Retry got %d receipts and error %v, expected 49 receipts", len(retried), e)
+	}
+
+	if retried, e := pushRemaining(&evenConnector{}, []int64{0, 1}, Message{}, prog); e != nil || len(retried) != 0 {
+		t.Errorf("Retry of reached users got %d receipts and error %v, expected none", len(retried), e)
+	}
+
+	if _, e = pushMany(&evenConnector{}, []int64{1, 3, 5}, Message{}); e != ErrNotRegistered {
+		t.Errorf("Expected ErrNotRegistered with no devices at all, got %v", e)
+	}
+
+	merged := pushResult{e: ErrNotRegistered}
+	merged.merge(pushResult{e: GcmTimeoutError})
+	merged.merge(pushResult{receipts: receipts[:1]})
+
+	if merged.e != GcmTimeoutError || len(merged.receipts) != 1 {
+		t.Errorf("Merge lost the failure or the receipts: %v, %d", merged.e, len(merged.receipts))
+	}
+}
+
+func TestRecipientResults(t *testing.T) {
+
+	results := recipientResults([]int64{1, 2, 3, 4}, map[string]*ConnectorStatus{
+		"gcm":  {Devices: []Receipt{{User: 1, State: DeviceFailed}, {User: 2, State: DeviceRemoved}}},
+		"fcm":  {Devices: []Receipt{{User: 1, State: DeviceCanonicalized}, {User: 5, State: DeviceFailed}}},
+		"apns": {Devices: []Receipt{{User: 5, State: DeviceValidated}}},
+	}, map[int64]string{4: "missing key"})
+
+	for user, expected := range map[int64]string{1: ResultDelivered, 2: ResultFailed, 3: ResultSkipped, 4: ResultFailed, 5: ResultValidated} {
+		if results[user] != expected {
+			t.Errorf("User %d is %s, expected %s", user, results[user], expected)
+		}
+	}
+
+	if unique := uniqueUsers([]int64{3, 1, 3, 2, 1}); len(unique) != 3 || unique[0] != 1 || unique[2] != 3 {
+		t.Errorf("Unique users are %v", unique)
+	}
+}
+
+func TestReceiptSettle(t *testing.T) {
+
+	receipts := newReceipts([]string{"abc", "def", "ghi"})
+
+	receipts[0].removed("NotRegistered")
+	receipts[1].canonicalized("jkl")
+
+	settleAll(receipts, GcmTimeoutError)
+
+	if receipts[0].State != DeviceRemoved || receipts[1].State != DeviceCanonicalized || receipts[2].State != DeviceFailed {
+		t.Errorf("Settling overwrote states given by the connector: %+v", receipts)
+	}
+
+	if receipts[2].Reason != GcmTimeoutError.Error() {
+		t.Errorf("Failure reason is %s", receipts[2].Reason)
+	}
+}
+
+func TestOutboxDelay(t *testing.T) {
+
+	for attempts, expected := range map[int]time.Duration{
+		1:  outboxBaseDelay,
+		2:  2 * outboxBaseDelay,
+		4:  8 * outboxBaseDelay,
+		50: outboxMaxDelay,
+	} {
+		if delay := outboxDelay(attempts); delay != expected {
+			t.Errorf("Delay after %d attempts is %s, expected %s", attempts, delay, expected)
+		}
+	}
+}
+
+func TestBroadcastThrottle(t *testing.T) {
+
+	for _, c := range []struct {
+		messages int64
+		rate     int
+		expected time.Duration
+	}{
+		{0, 500, 0},
+		{500, 500, time.Second},
+		{1000, 500, 2 * time.Second},
+		{1, 4, 250 * time.Millisecond},
+	} {
+		if wait := broadcastThrottle(c.messages, c.rate); wait != c.expected {
+			t.Errorf("%d messages at %d/s take %s, expected %s", c.messages, c.rate, wait, c.expected)
+		}
+	}
+
+	for rate, expected := range map[int]int{1: 1, 9: 1, 10: 1, 500: 50, 1005: 100} {
+		if batch := broadcastBatch(rate); batch != expected {
+			t.Errorf("Batches at %d/s have %d users, expected %d", rate, batch, expected)
+		}
+	}
+}
+
+func TestRenderMessages(t *testing.T) {
+
+	bodies := map[string]string{
+		DefaultLocale: `{"notification": {"title": "Hello {{.Vars.name}}"}}`,
+		"it":          `{"notification": {"title": "Ciao {{.Vars.name}}"}}`,
+		"fr":          `{"notification": {"title": "Salut {{.Vars.missing}}"}}`,
+	}
+
+	userLocales := map[int64]string{2: "it_IT", 3: "it", 4: "fr", 5: "de-DE"}
+
+	groups, failures := renderMessages("greet", bodies, userLocales, map[string]interface{}{"name": "Bob"}, []int64{1, 2, 3, 4, 5})
+
+	if len(groups) != 2 {
+		t.Fatalf("Expected 2 groups, got %d", len(groups))
+	}
+
+	if title := groups[0].message.Notification.Title; title != "Hello Bob" || len(groups[0].users) != 2 {
+		t.Errorf("Default group is %q for %v", title, groups[0].users)
+	}
+
+	if title := groups[1].message.Notification.Title; title != "Ciao Bob" || len(groups[1].users) != 2 {
+		t.Errorf("Italian group is %q for %v", title, groups[1].users)
+	}
+
+	if _, failed := failures[4]; !failed || len(failures) != 1 {
+		t.Errorf("Expected only user 4 to fail, got %v", failures)
+	}
+}
+
+func TestIdempotencyKey(t *testing.T) {
+
+	for key, expected := range map[string]bool{
+		"order-1234":             true,
+		"3f2a8c1e:retry":         true,
+		"":                       false,
+		"with space":             false,
+		strings.Repeat("k", 256): false,
+	} {
+		if ValidIdempotencyKey(key) != expected {
+			t.Errorf("Key %q should be valid: %v", key, expected)
+		}
+	}
+}
+
+func TestSecretHash(t *testing.T) {
+
+	hash, e := HashSecret("correct horse battery staple")
+
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	if !ValidSecretHash(hash) || !CheckSecret(hash, "correct horse battery staple") {
+		t.Errorf("Secret does not match its own hash %s", hash)
+	}
+
+	if CheckSecret(hash, "correct horse battery stapler") || CheckSecret("plain secret", "plain secret") {
+		t.Error("Wrong secret or unhashed secret accepted")
+	}
+
+	if _, e = HashSecret("short"); e != ErrInvalidSecret {
+		t.Errorf("Short secret hashed, error %v", e)
+	}
+}
+
+func TestAcl(t *testing.T) {
+
+	acl := &Acl{Commands: []string{"PUSH", "TEMPLATE"}, Users: []UserRange{{From: 10, To: 19}}}
+
+	for cmd, expected := range map[string]bool{"PUSH": true, "TEMPLATE GET": true, "PUSHAT": false, "HALT": false} {
+		if acl.AllowsCommand(cmd) != expected {
+			t.Errorf("Command %s should be allowed: %v", cmd, expected)
+		}
+	}
+
+	if !acl.AllowsUser(10) || !acl.AllowsUser(19) || acl.AllowsUser(20) || !acl.RestrictsUsers() {
+		t.Errorf("Wrong user ranges for %+v", acl.Users)
+	}
+
+	var unrestricted *Acl
+
+	if !unrestricted.AllowsCommand("HALT") || !unrestricted.AllowsUser(42) || unrestricted.RestrictsUsers() {
+		t.Error("A nil ACL must allow everything")
+	}
+}
+
+// checkStore runs the same checks on every store, which must have no users yet
+func checkStore(t *testing.T, store Store) {
+
+	devices, e := store.Devices("gcm", DevicePolicy{})
+
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	if e = store.AddUser(1); e != nil {
+		t.Fatal(e)
+	}
+
+	if e = store.AddUser(1); e != ErrUserExists {
+		t.Errorf("Duplicate user added, error %v", e)
+	}
+
+	for i := 0; i < deviceDefaultCap; i++ {
+		if e = devices.Add(1, "token"+strconv.Itoa(i), ""); e != nil {
+			t.Fatal(e)
+		}
+	}
+
+	if e = devices.Add(1, "token0", ""); e != ErrDeviceExists {
+		t.Errorf("Duplicate token added, error %v", e)
+	}
+
+	if e = devices.Add(1, "onetoomany", ""); e != ErrTooManyDevices {
+		t.Errorf("Device over the cap added, error %v", e)
+	}
+
+	if e = devices.UpdateToken("token0", "canonical"); e != nil {
+		t.Fatal(e)
+	}
+
+	if e = devices.SetData("canonical", "data"); e != nil {
+		t.Fatal(e)
+	}
+
+	found, e := devices.ForUsers([]int64{1, 2})
+
+	if e != nil || len(found) != deviceDefaultCap {
+		t.Fatalf("Expected %d devices, got %v, error %v", deviceDefaultCap, found, e)
+	}
+
+	for _, dev := range found {
+		if dev.Token == "canonical" && dev.Data != "data" {
+			t.Errorf("Data of the updated token is %q", dev.Data)
+		}
+	}
+
+	if exists, e := devices.Exists("canonical"); e != nil || !exists {
+		t.Errorf("Updated token not found, error %v", e)
+	}
+
+	if user, found, e := devices.Owner("canonical"); e != nil || !found || user != 1 {
+		t.Errorf("Updated token owned by %d (found %v), error %v", user, found, e)
+	}
+
+	if _, found, e := devices.Owner("missing"); e != nil || found {
+		t.Errorf("Missing token has an owner, error %v", e)
+	}
+
+	if e = store.DelUser(1); e != nil {
+		t.Fatal(e)
+	}
+
+	if subscribed, e := devices.Subscribed(1); e != nil || subscribed {
+		t.Errorf("Devices not deleted with their user, error %v", e)
+	}
+
+	if _, e = devices.ForUser(1); e != ErrNotRegistered {
+		t.Errorf("Expected ErrNotRegistered, got %v", e)
+	}
+
+	checkEviction(t, store)
+}
+
+// checkEviction registers devices past a cap of 2 with each policy
+func checkEviction(t *testing.T, store Store) {
+
+	if e := store.AddUser(2); e != nil {
+		t.Fatal(e)
+	}
+
+	expect := func(policy DevicePolicy, token string, tokens ...string) {
+
+		devices, e := store.Devices("fcm", policy)
+
+		if e != nil {
+			t.Fatal(e)
+		}
+
+		if e = devices.Add(2, token, ""); e != nil {
+			t.Fatalf("Cannot add %s with policy %v: %v", token, policy, e)
+		}
+
+		found, e := devices.ForUser(2)
+
+		if e != nil || !reflect.DeepEqual(deviceTokens(found), tokens) {
+			t.Errorf("Expected %v with policy %v, got %v, error %v", tokens, policy, found, e)
+		}
+	}
+
+	lru := DevicePolicy{MaxDevices: 2, Eviction: EvictLru}
+
+	expect(lru, "a", "a")
+	expect(lru, "b", "a", "b")
+
+	devices, _ := store.Devices("fcm", lru)
+
+	if e := devices.Succeeded([]string{"a"}, time.Now().Add(time.Hour)); e != nil {
+		t.Fatal(e)
+	}
+
+	expect(lru, "c", "a", "c") //b was never reached, so it goes before a
+	expect(DevicePolicy{MaxDevices: 2, Eviction: EvictOldest}, "d", "c", "d")
+
+	rejecting, _ := store.Devices("fcm", DevicePolicy{MaxDevices: 2})
+
+	if e := rejecting.Add(2, "f", ""); e != ErrTooManyDevices {
+		t.Errorf("Device over the cap added, error %v", e)
+	}
+
+	expect(DevicePolicy{MaxDevices: 1, Eviction: EvictOldest}, "g", "g") //the cap went down, so both go
+
+	if e := (&DevicePolicy{Eviction: "random"}).Validate(); e != ErrUnknownEviction {
+		t.Errorf("Unknown eviction policy accepted, error %v", e)
+	}
+
+	if e := store.DelUser(2); e != nil {
+		t.Fatal(e)
+	}
+}
+
+func TestSqliteStore(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "pushed.db")
+
+	if e := Migrate(StorageSqlite, path, []string{"gcm", "fcm"}, -1); e != nil {
+		t.Fatal(e)
+	}
+
+	store, e := openSqlite(path)
+
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	defer store.Close()
+
+	checkStore(t, store)
+}
+
+func TestMemoryStore(t *testing.T) {
+
+	checkStore(t, &memoryStore{users: make(map[int64]bool), tables: make(map[string]*memoryDevices)})
+
+	snapshot := filepath.Join(t.TempDir(), "pushed.json")
+
+	store, e := newMemoryStore(snapshot, time.Hour)
+
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	devices, _ := store.Devices("webhook", DevicePolicy{})
+
+	if e = store.AddUser(7); e == nil {
+		e = devices.Add(7, "https://example.com/hook", "2")
+	}
+
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	if e = store.Close(); e != nil {
+		t.Fatal(e)
+	}
+
+	if store, e = newMemoryStore(snapshot, time.Hour); e != nil {
+		t.Fatal(e)
+	}
+
+	defer store.Close()
+
+	devices, _ = store.Devices("webhook", DevicePolicy{})
+
+	found, e := devices.ForUser(7)
+
+	if e != nil || len(found) != 1 || found[0].Token != "https://example.com/hook" || found[0].Data != "2" || found[0].Registered.IsZero() {
+		t.Errorf("Snapshot not restored, got %v, error %v", found, e)
+	}
+}
+
+func TestMigrations(t *testing.T) {
+
+	for kind, d := range dialects {
+		if migrations, e := loadMigrations(d.dir); e != nil || len(migrations) != Version {
+			t.Errorf("Migrations of %s do not reach version %d, error %v", kind, Version, e)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "pushed.db")
+
+	if e := Migrate(StorageSqlite, path, nil, Version+1); e != ErrUnknownVersion {
+		t.Errorf("Migrated to an unknown version, error %v", e)
+	}
+
+	if _, e := openSqlite(path); e == nil {
+		t.Error("Store opened without a schema")
+	}
+
+	if e := Migrate(StorageSqlite, path, []string{"gcm"}, -1); e != nil {
+		t.Fatal(e)
+	}
+
+	if e := Migrate(StorageSqlite, path, []string{"gcm", "fcm"}, -1); e != nil { //adds the FCM table
+		t.Fatal(e)
+	}
+
+	store, e := openSqlite(path)
+
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	for _, instance := range []string{"gcm", "fcm"} {
+		if _, e = store.Devices(instance, DevicePolicy{}); e != nil {
+			t.Errorf("Devices of %s not migrated: %v", instance, e)
+		}
+	}
+
+	if _, e = store.Devices("apns", DevicePolicy{}); e == nil {
+		t.Error("Devices opened without a table")
+	}
+
+	store.Close()
+
+	if e = Migrate(StorageSqlite, path, nil, 0); e != nil { //GCM and FCM follow, even if not given
+		t.Fatal(e)
+	}
+
+	conn, e := dialSqlite(path)
+
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	defer conn.Close()
+
+	m := &migrator{conn: conn, dialect: dialects[StorageSqlite]}
+
+	for _, table := range []string{"USERS", "GCM", "FCM"} {
+		if exists, e := m.tableExists(table); e != nil || exists {
+			t.Errorf("Table %s not dropped, error %v", table, e)
+		}
+	}
+
+	//SQLite came after the first pushed, so the tables of -initdb were already in the layout of version 1
+	if _, e = conn.Exec("DROP TABLE SCHEMA_VERSION; CREATE TABLE USERS (ID INTEGER PRIMARY KEY); CREATE TABLE GCM (USERID INTEGER, TOKEN TEXT, DATA TEXT)"); e != nil {
+		t.Fatal(e)
+	}
+
+	if e = Migrate(StorageSqlite, path, []string{"gcm"}, 1); e != nil {
+		t.Fatal(e)
+	}
+
+	if version, e := m.version("GCM"); e != nil || version != 1 {
+		t.Errorf("Legacy GCM table at version %d, error %v", version, e)
+	}
+}
+
+// TestPostgresLegacy upgrades the tables of the first pushed. It needs an empty Postgres database, whose
+// connection string is in PUSHED_TEST_POSTGRES.
+func TestPostgresLegacy(t *testing.T) {
+
+	source := os.Getenv("PUSHED_TEST_POSTGRES")
+
+	if source == "" {
+		t.Skip("PUSHED_TEST_POSTGRES not set")
+	}
+
+	conn, e := dialPostgres(source)
+
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	defer conn.Close()
+
+	//as InitDb and gcmInitTable created them
+	for _, statement := range []string{
+		"CREATE TABLE USERS (ID BIGINT PRIMARY KEY CHECK (ID > -1))",
+		"CREATE TABLE GCM (USERID BIGINT REFERENCES USERS ON DELETE CASCADE, REGID CHARACTER VARYING, PRIMARY KEY (USERID,REGID))",
+		`CREATE FUNCTION CHECKTEN() RETURNS TRIGGER AS $$ BEGIN IF((SELECT COUNT(REGID) FROM GCM WHERE USERID = NEW.USERID) >= 10) THEN RAISE EXCEPTION 'Already 10 Registration IDs for this user'; END IF; RETURN NEW; END $$ LANGUAGE plpgsql`,
+		"CREATE TRIGGER CHECKTEN BEFORE INSERT ON GCM FOR EACH ROW EXECUTE PROCEDURE CHECKTEN()",
+		"INSERT INTO USERS VALUES (1)",
+		"INSERT INTO GCM VALUES (1, 'abc')",
+	} {
+		if _, e = conn.Exec(statement); e != nil {
+			t.Fatal(e)
+		}
+	}
+
+	defer func() {
+		if e := Migrate(StoragePostgres, source, nil, 0); e != nil {
+			t.Error(e)
+		}
+
+		conn.Exec("DROP TABLE SCHEMA_VERSION")
+	}()
+
+	if e = Migrate(StoragePostgres, source, []string{"gcm"}, -1); e != nil {
+		t.Fatal(e)
+	}
+
+	m := &migrator{conn: conn, dialect: dialects[StoragePostgres]}
+
+	for _, name := range []string{schemaShared, "GCM"} {
+		if version, e := m.version(name); e != nil || version != Version {
+			t.Errorf("%s at version %d, error %v", schemaName(name), version, e)
+		}
+	}
+
+	for _, table := range []string{"TOPICS", "BROADCASTS", "CLIENTS", "TEMPLATES", "OUTBOX", "IDEMPOTENCYKEYS", "OUTBOXRESULTS", "OUTBOXDEVICES", "OUTBOXUSERS"} {
+		if exists, e := m.tableExists(table); e != nil || !exists {
+			t.Errorf("Table %s not created, error %v", table, e)
+		}
+	}
+
+	var checkTen bool
+
+	if e = conn.QueryRow("SELECT EXISTS (SELECT 1 FROM pg_proc WHERE proname = 'checkten')").Scan(&checkTen); e != nil || checkTen {
+		t.Errorf("CHECKTEN not dropped, error %v", e)
+	}
+
+	if _, e = conn.Exec("UPDATE USERS SET LOCALE = 'it' WHERE ID = 1"); e != nil {
+		t.Errorf("No LOCALE column: %v", e)
+	}
+
+	store, e := dialDb(source)
+
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	defer store.Close()
+
+	devices, e := store.Devices("gcm", DevicePolicy{MaxDevices: 20})
+
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	if found, e := devices.ForUser(1); e != nil || len(found) != 1 || found[0].Token != "abc" {
+		t.Errorf("Registration ID not kept as a token, got %v, error %v", found, e)
+	}
+
+	//the cap of 10 devices is up to the policy now, not to a trigger
+	for i := 0; i < 10; i++ {
+		if e = devices.Add(1, "token"+strconv.Itoa(i), ""); e != nil {
+			t.Errorf("Device %d refused: %v", i, e)
+		}
+	}
 }
@@ -0,0 +1,459 @@
+/*  Pushed - a daemon for parallel handling of push operations to mobile devices
+ *  Copyright (C) 2014  Marco Cilloni <marco.cilloni@yahoo.com>
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *  Exhibit B is not attached; this software is compatible with the
+ *  licenses expressed under Section 1.12 of the MPL v2.
+ */
+
+package backend
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	BroadcastDefaultRate = 500 //messages per second
+	broadcastBatches     = 10  //a page is sent in batches of a tenth of the rate, to spread it over time
+	broadcastLease       = 5 * time.Minute
+	broadcastPageSize    = 1000
+	broadcastLockedDelay = 5 * time.Second //wait before retrying a page leased by another instance
+
+	BroadcastCancelled = "cancelled"
+	BroadcastDone      = "done"
+	BroadcastRunning   = "running"
+)
+
+var (
+	ErrBroadcastsStarted = errors.New("Broadcasts are already running")
+	ErrUnknownBroadcast  = errors.New("No broadcast with the given ID")
+	globalBroadcasts     *broadcasts
+)
+
+type BroadcastConfig struct {
+	Rate int //default messages per second, when BROADCAST does not give one
+}
+
+// BroadcastStatus is the progress of a broadcast. Counters are updated after each page of users.
+type BroadcastStatus struct {
+	Id        int64     `json:"id"`
+	State     string    `json:"state"`
+	Rate      int       `json:"rate"`
+	Total     int64     `json:"total"`     //users when the broadcast started
+	Processed int64     `json:"processed"` //users already pushed, or in the page being pushed
+	Delivered int64     `json:"delivered"` //devices
+	Failed    int64     `json:"failed"`
+	Removed   int64     `json:"removed"`
+	LastError string    `json:"last_error,omitempty"`
+	Created   time.Time `json:"created"`
+	Updated   time.Time `json:"updated"`
+}
+
+// broadcasts runs every broadcast in its own goroutine. Users are streamed a page at a time with a cursor on
+// their ID, which is saved before the page is sent along with a lease on the broadcast, so broadcasts resume
+// where they stopped and no page is ever sent twice. Counters are saved once the page is over.
+type broadcasts struct {
+	config  *BroadcastConfig
+	quit    chan bool
+	wg      sync.WaitGroup
+	lock    sync.Mutex
+	cancels map[int64]chan bool
+}
+
+type broadcastPage struct {
+	users                      int
+	delivered, failed, removed int64
+	lastError                  string
+}
+
+// StartBroadcasts must be called after every connector has been initialized, and resumes the broadcasts
+// left running
+func StartBroadcasts(config *BroadcastConfig) error {
+
+	if globalBroadcasts != nil {
+		return ErrBroadcastsStarted
+	}
+
+	if !UsesPostgres() {
+		log.Println("Broadcasts need the postgres storage, they are disabled")
+		return nil
+	}
+
+	if config.Rate <= 0 {
+		config.Rate = BroadcastDefaultRate
+	}
+
+	globalBroadcasts = &broadcasts{
+		config:  config,
+		quit:    make(chan bool),
+		cancels: make(map[int64]chan bool),
+	}
+
+	rows, e := globalDb.conn.Query("SELECT ID, DATA, RATE FROM BROADCASTS WHERE STATE = $1", BroadcastRunning)
+
+	if e != nil {
+		return e
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+
+		var (
+			id, rate int64
+			data     string
+			message  Message
+		)
+
+		if e = rows.Scan(&id, &data, &rate); e != nil {
+			return e
+		}
+
+		if e = json.Unmarshal([]byte(data), &message); e != nil {
+			return e
+		}
+
+		log.Printf("Resuming broadcast %d", id)
+
+		globalBroadcasts.run(id, message, int(rate))
+	}
+
+	return rows.Err()
+}
+
+// StopBroadcasts interrupts the running broadcasts after their current page, which is not left halfway as its
+// users are already counted as processed. They are resumed by the next StartBroadcasts.
+func StopBroadcasts() {
+
+	if globalBroadcasts == nil {
+		return
+	}
+
+	close(globalBroadcasts.quit)
+	globalBroadcasts.wg.Wait()
+
+	globalBroadcasts = nil
+}
+
+// Broadcast pushes message to every user, at rate messages per second (or the configured default if rate is 0)
+func Broadcast(message Message, rate int) (id int64, e error) {
+
+	if e = needsPostgres(); e != nil {
+		return
+	}
+
+	if rate <= 0 {
+		rate = globalBroadcasts.config.Rate
+	}
+
+	data, e := json.Marshal(message)
+
+	if e != nil {
+		return
+	}
+
+	e = globalDb.conn.QueryRow("INSERT INTO BROADCASTS (DATA, RATE, TOTAL) VALUES ($1, $2, (SELECT COUNT(1) FROM USERS)) RETURNING ID",
+		string(data), rate).Scan(&id)
+
+	if e != nil {
+		return
+	}
+
+	log.Printf("Starting broadcast %d at %d messages per second", id, rate)
+
+	globalBroadcasts.run(id, message, rate)
+
+	return
+}
+
+func BroadcastProgress(id int64) (*BroadcastStatus, error) {
+
+	if e := needsPostgres(); e != nil {
+		return nil, e
+	}
+
+	var (
+		lastError sql.NullString
+		status    = &BroadcastStatus{Id: id}
+	)
+
+	e := globalDb.conn.QueryRow(`SELECT STATE, RATE, TOTAL, PROCESSED, DELIVERED, FAILED, REMOVED, LASTERROR, CREATED, UPDATED
+		FROM BROADCASTS WHERE ID = $1`, id).Scan(&status.State, &status.Rate, &status.Total, &status.Processed, &status.Delivered,
+		&status.Failed, &status.Removed, &lastError, &status.Created, &status.Updated)
+
+	if e == sql.ErrNoRows {
+		return nil, ErrUnknownBroadcast
+	}
+
+	if e != nil {
+		return nil, e
+	}
+
+	status.LastError = lastError.String
+
+	return status, nil
+}
+
+// CancelBroadcast stops a running broadcast for good. It returns false if the broadcast was not running.
+func CancelBroadcast(id int64) (bool, error) {
+
+	if e := needsPostgres(); e != nil {
+		return false, e
+	}
+
+	//the page in progress, if any, stops at the end of its current batch
+	res, e := globalDb.conn.Exec("UPDATE BROADCASTS SET STATE = $2, UPDATED = now() WHERE ID = $1 AND STATE = $3",
+		id, BroadcastCancelled, BroadcastRunning)
+
+	if e != nil {
+		return false, e
+	}
+
+	n, e := res.RowsAffected()
+
+	if e != nil || n == 0 {
+		return false, e
+	}
+
+	log.Printf("Broadcast %d has been cancelled", id)
+
+	globalBroadcasts.lock.Lock()
+
+	if cancel, ok := globalBroadcasts.cancels[id]; ok {
+		close(cancel)
+		delete(globalBroadcasts.cancels, id)
+	}
+
+	globalBroadcasts.lock.Unlock()
+
+	return true, nil
+}
+
+func (bc *broadcasts) run(id int64, message Message, rate int) {
+
+	cancel := make(chan bool)
+
+	bc.lock.Lock()
+	bc.cancels[id] = cancel
+	bc.lock.Unlock()
+
+	bc.wg.Add(1)
+
+	go func() {
+
+		defer bc.wg.Done()
+
+		defer func() {
+			bc.lock.Lock()
+			delete(bc.cancels, id)
+			bc.lock.Unlock()
+		}()
+
+		for {
+			page, done, e := nextBroadcastPage(id, message, rate, cancel)
+
+			if e != nil {
+				log.Printf("Broadcast %d error: %s", id, e.Error())
+			}
+
+			if done {
+				log.Printf("Broadcast %d is over", id)
+				return
+			}
+
+			wait := time.Duration(0) //pages are paced while sending
+
+			if page == nil {
+				wait = broadcastLockedDelay
+			}
+
+			select {
+			case <-bc.quit:
+				return
+			case <-cancel:
+				return
+			case <-time.After(wait):
+			}
+		}
+	}()
+}
+
+// broadcastThrottle is how long sending messages must take to stay within rate
+func broadcastThrottle(messages int64, rate int) time.Duration {
+	return time.Duration(messages) * time.Second / time.Duration(rate)
+}
+
+// broadcastBatch is how many users of a page are sent at once, before waiting to stay within rate
+func broadcastBatch(rate int) int {
+
+	if rate < broadcastBatches {
+		return 1
+	}
+
+	return rate / broadcastBatches
+}
+
+// nextBroadcastPage pushes the next page of users, if the broadcast is still running. A nil page
+// without errors means another instance is working on the broadcast right now.
+func nextBroadcastPage(id int64, message Message, rate int, cancel <-chan bool) (page *broadcastPage, done bool, e error) {
+
+	users, done, e := claimBroadcastPage(id, rate)
+
+	if len(users) == 0 || e != nil {
+		return
+	}
+
+	page = &broadcastPage{users: len(users)}
+
+	batch := broadcastBatch(rate)
+
+sending:
+	for len(users) > 0 {
+
+		start, n := time.Now(), batch
+
+		if n > len(users) {
+			n = len(users)
+		}
+
+		messages := page.delivered + page.failed + page.removed
+
+		page.add(pushEach(users[:n], message, nil))
+
+		users = users[n:]
+
+		select {
+		case <-cancel:
+			break sending
+		case <-time.After(broadcastThrottle(page.delivered+page.failed+page.removed-messages, rate) - time.Since(start)):
+		}
+	}
+
+	_, e = globalDb.conn.Exec(`UPDATE BROADCASTS SET DELIVERED = DELIVERED + $2, FAILED = FAILED + $3, REMOVED = REMOVED + $4,
+		LASTERROR = COALESCE($5, LASTERROR), LEASE = NULL, UPDATED = now() WHERE ID = $1`,
+		id, page.delivered, page.failed, page.removed, sql.NullString{String: page.lastError, Valid: page.lastError != ""})
+
+	return
+}
+
+// claimBroadcastPage leases the broadcast and moves its cursor past the next page of users, which it returns.
+// No users and no errors mean that the broadcast is over, if done, or leased by another instance.
+func claimBroadcastPage(id int64, rate int) (users []int64, done bool, e error) {
+
+	tx, e := globalDb.conn.Begin()
+
+	if e != nil {
+		return
+	}
+
+	defer func() {
+		if e != nil {
+			tx.Rollback()
+		}
+	}()
+
+	var (
+		cursor int64
+		state  string
+	)
+
+	e = tx.QueryRow("SELECT LASTUSER, STATE FROM BROADCASTS WHERE ID = $1 AND (LEASE IS NULL OR LEASE < now()) FOR UPDATE SKIP LOCKED",
+		id).Scan(&cursor, &state)
+
+	if e == sql.ErrNoRows {
+		return nil, false, tx.Rollback()
+	}
+
+	if e != nil {
+		return
+	}
+
+	if state != BroadcastRunning {
+		return nil, true, tx.Rollback()
+	}
+
+	pageSize := broadcastPageSize
+
+	if rate < pageSize {
+		pageSize = rate
+	}
+
+	if users, e = userPage(tx, cursor, pageSize); e != nil {
+		return
+	}
+
+	if len(users) == 0 {
+
+		if _, e = tx.Exec("UPDATE BROADCASTS SET STATE = $2, UPDATED = now() WHERE ID = $1", id, BroadcastDone); e != nil {
+			return
+		}
+
+		return nil, true, tx.Commit()
+	}
+
+	_, e = tx.Exec(`UPDATE BROADCASTS SET LASTUSER = $2, PROCESSED = PROCESSED + $3, LEASE = now() + $4::float8 * interval '1 second',
+		UPDATED = now() WHERE ID = $1`, id, users[len(users)-1], len(users), broadcastLease.Seconds())
+
+	if e != nil {
+		return
+	}
+
+	return users, false, tx.Commit()
+}
+
+// add counts the receipts of a batch of the page
+func (page *broadcastPage) add(results map[string]*pushResult) {
+
+	for _, res := range results {
+
+		if res.e != nil && res.e != ErrNotRegistered {
+			page.lastError = res.e.Error()
+		}
+
+		for _, receipt := range res.receipts {
+			switch receipt.State {
+			case DeviceDelivered, DeviceCanonicalized:
+				page.delivered++
+			case DeviceRemoved:
+				page.removed++
+			case DeviceValidated: //dry run, nothing to count
+			default:
+				page.failed++
+			}
+		}
+	}
+}
+
+// userPage streams USERS with a cursor, returning up to n users with an ID greater than after
+func userPage(tx *sql.Tx, after int64, n int) ([]int64, error) {
+
+	rows, e := tx.Query("SELECT ID FROM USERS WHERE ID > $1 ORDER BY ID LIMIT $2", after, n)
+
+	if e != nil {
+		return nil, e
+	}
+
+	defer rows.Close()
+
+	users := make([]int64, 0, n)
+
+	for rows.Next() {
+
+		var id int64
+
+		if e = rows.Scan(&id); e != nil {
+			return nil, e
+		}
+
+		users = append(users, id)
+	}
+
+	return users, rows.Err()
+}
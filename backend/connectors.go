@@ -11,32 +11,107 @@
 package backend
 
 import (
+	"encoding/json"
 	"errors"
+	"log"
+	"regexp"
 	"strings"
 	"sync"
+	"time"
 )
 
 const (
 	connectorSliceSize = 1
+	multicastWorkers   = 16 //users pushed at once by connectors without multicast
 )
 
 var (
-	ErrNotRegistered = errors.New("Not registered to this connector")
-	Gcm              Connector
-	connectors       map[string]Connector
-	gcmInitOnce      sync.Once
+	ErrConnectorExists      = errors.New("A connector instance with the same name already exists")
+	ErrInvalidConnectorName = errors.New("Connector instance names must match [a-z][a-z0-9_]*")
+	ErrNotRegistered        = errors.New("Not registered to this connector")
+	ErrUnknownConnectorType = errors.New("No connector factory registered with the given type")
+	connectorNameRegexp     = regexp.MustCompile("^[a-z][a-z0-9_]*$")
+	connectors              map[string]Connector
+	connectorsLock          sync.Mutex
+	connectorDevices        map[string]DeviceStore //opened by each connector instance
+	devicePolicies          map[string]DevicePolicy
+	factories               map[string]ConnectorFactory
 )
 
 type Connector interface {
 	Exists(deviceTargetId string) (bool, error)
-	Push(user int64, message Message) error
+	Push(user int64, message Message) ([]Receipt, error) //one receipt for each device of user
 	Register(user int64, deviceTargetId string) error
 	Subscribed(user int64) (bool, error)
 	Unregister(deviceTargetId string) error
 }
 
+// Multicaster is implemented by connectors able to reach the devices of many users with less requests than one
+// per user, like GCM with its 1000 registration IDs per request. Fan-outs use it when available.
+// Unlike Push, the receipts of PushMany must tell the user of each device.
+type Multicaster interface {
+	PushMany(users []int64, message Message) ([]Receipt, error)
+}
+
+// DeviceOwner is implemented by connectors able to tell which user registered a device, so that clients limited
+// to some users cannot act on the devices of the others
+type DeviceOwner interface {
+	Owner(deviceTargetId string) (user int64, found bool, e error)
+}
+
+// Resumer is implemented by connectors able to leave out the devices whose tokens are in reached, so that the retry
+// of a queued message does not push it twice to the devices that already got it. Like PushMany, the receipts of
+// PushExcept must tell the user of each device.
+type Resumer interface {
+	PushExcept(users []int64, message Message, reached map[string]bool) ([]Receipt, error)
+}
+
+// progress is what the previous attempts of a queued message achieved through a connector
+type progress struct {
+	settled bool            //no further attempts needed
+	reached map[string]bool //tokens that need no further attempts
+	done    map[int64]bool  //users whose devices all need no further attempts
+}
+
+// ConnectorFactory builds the connector instance called name from its raw JSON settings.
+// Factories run after ConnectDb, so they may prepare their statements right away.
+type ConnectorFactory func(name string, settings json.RawMessage) (Connector, error)
+
 func init() {
 	connectors = make(map[string]Connector)
+	connectorDevices = make(map[string]DeviceStore)
+	devicePolicies = make(map[string]DevicePolicy)
+}
+
+// RegisterConnectorFactory makes a connector type available to InitConnector. It panics if
+// called twice with the same type, like sql.Register does.
+func RegisterConnectorFactory(kind string, factory ConnectorFactory) {
+
+	kind = strings.ToLower(kind)
+
+	if factories == nil {
+		factories = make(map[string]ConnectorFactory)
+	}
+
+	if _, dup := factories[kind]; dup {
+		panic("RegisterConnectorFactory called twice for connector type " + kind)
+	}
+
+	factories[kind] = factory
+}
+
+func ExistsConnectorFactory(kind string) bool {
+	_, ok := factories[strings.ToLower(kind)]
+	return ok
+}
+
+func ValidConnectorName(name string) bool {
+	return connectorNameRegexp.MatchString(name)
+}
+
+// deviceTableName is the table holding the devices of a connector instance
+func deviceTableName(instance string) string {
+	return strings.ToUpper(instance)
 }
 
 func ExistsConnector(name string) bool {
@@ -48,35 +123,283 @@ func GetConnector(name string) Connector {
 	return connectors[strings.ToLower(name)]
 }
 
-func InitGcm(config *GcmConfig) error {
-	gcmInitOnce.Do(func() {
-		Gcm = newGcm(config)
-		connectors["gcm"] = Gcm
-	})
+// InitConnector must be called after ConnectDb, because connectors prepare their statements on init.
+// policy limits the devices each user can register on the connector instance.
+func InitConnector(kind, name string, settings json.RawMessage, policy DevicePolicy) error {
+
+	factory, ok := factories[strings.ToLower(kind)]
+
+	if !ok {
+		return ErrUnknownConnectorType
+	}
+
+	if !ValidConnectorName(name) {
+		return ErrInvalidConnectorName
+	}
+
+	connectorsLock.Lock()
+	defer connectorsLock.Unlock()
+
+	if _, dup := connectors[name]; dup {
+		return ErrConnectorExists
+	}
+
+	if e := policy.Validate(); e != nil {
+		return errors.New(name + ": " + e.Error())
+	}
+
+	devicePolicies[name] = policy
+
+	if settings == nil {
+		settings = json.RawMessage("{}")
+	}
+
+	connector, e := factory(name, settings)
+
+	if e != nil {
+		return errors.New(name + ": " + e.Error())
+	}
+
+	connectors[name] = connector
 
 	return nil
 }
 
-func PushAll(user int64, message Message) (failures bool, errors map[string]error) {
+// openDevices opens the devices of a connector instance with the policy given to InitConnector.
+// Factories call it while InitConnector holds connectorsLock.
+func openDevices(name string) (DeviceStore, error) {
 
-	errors = make(map[string]error)
+	devices, e := globalStore.Devices(name, devicePolicies[name])
+
+	if e != nil {
+		return nil, e
+	}
+
+	connectorDevices[name] = devices
+
+	return devices, nil
+}
+
+// recordSuccesses tells the devices of a connector instance which of them a push reached
+func recordSuccesses(name string, receipts []Receipt) {
+
+	devices, ok := connectorDevices[name]
+
+	if !ok {
+		return
+	}
 
-	errChan := make(chan error)
+	var tokens []string
 
-	for _, connector := range connectors {
-		go func() {
-			errChan <- connector.Push(user, message)
-		}()
+	for _, receipt := range receipts {
+		switch receipt.State {
+		case DeviceDelivered:
+			tokens = append(tokens, receipt.Token)
+		case DeviceCanonicalized:
+			tokens = append(tokens, receipt.Canonical)
+		}
 	}
 
-	for name, _ := range connectors {
-		e := <-errChan
+	if len(tokens) == 0 {
+		return
+	}
 
-		if e != nil && e != ErrNotRegistered {
-			errors[name] = e
+	if e := devices.Succeeded(tokens, time.Now()); e != nil {
+		log.Printf("Cannot record successful pushes on %s: %s", name, e.Error())
+	}
+}
+
+type pushResult struct {
+	name     string
+	receipts []Receipt
+	e        error
+}
+
+func PushAll(user int64, message Message) (failures bool, errors map[string]error) {
+	return PushMany([]int64{user}, message)
+}
+
+// PushMany is like PushAll, but for many users at once, multicasting on the connectors that can
+func PushMany(users []int64, message Message) (failures bool, errors map[string]error) {
+
+	errors = make(map[string]error)
+
+	for name, res := range pushEach(users, message, nil) {
+		if res.e != nil && res.e != ErrNotRegistered {
+			errors[name] = res.e
 			failures = true
 		}
 	}
 
 	return
 }
+
+// pushEach pushes message to users through every connector concurrently, and returns the outcome of each one.
+// With resume, the connectors that settled the message are skipped and the others leave out what they reached.
+func pushEach(users []int64, message Message, resume map[string]*progress) map[string]*pushResult {
+
+	results := make(map[string]*pushResult)
+
+	resChan := make(chan pushResult)
+
+	n := 0
+
+	for name, connector := range connectors {
+
+		prog := resume[name]
+
+		if prog != nil && prog.settled {
+			continue
+		}
+
+		n++
+
+		go func(name string, connector Connector) {
+			receipts, e := pushRemaining(connector, users, message, prog)
+
+			if !message.Options.DryRun {
+				recordSuccesses(name, receipts)
+			}
+
+			resChan <- pushResult{name, receipts, e}
+		}(name, connector)
+	}
+
+	for i := 0; i < n; i++ {
+		res := <-resChan
+		results[res.name] = &res
+	}
+
+	return results
+}
+
+// pushRemaining is pushMany for a retry described by prog, if not nil: it leaves out the users that need no
+// further attempts, and the single devices that do not with connectors that are Resumers.
+func pushRemaining(connector Connector, users []int64, message Message, prog *progress) ([]Receipt, error) {
+
+	if prog == nil {
+		return pushMany(connector, users, message)
+	}
+
+	remaining := make([]int64, 0, len(users))
+
+	for _, user := range users {
+		if !prog.done[user] {
+			remaining = append(remaining, user)
+		}
+	}
+
+	if len(remaining) == 0 {
+		return nil, nil
+	}
+
+	var (
+		receipts []Receipt
+		e        error
+	)
+
+	if resumer, ok := connector.(Resumer); ok {
+		receipts, e = resumer.PushExcept(remaining, message, prog.reached)
+	} else {
+		receipts, e = pushMany(connector, remaining, message)
+	}
+
+	if e == ErrNotRegistered && len(prog.reached) > 0 {
+		e = nil //the devices left have been unregistered since, but the others got the message
+	}
+
+	return receipts, e
+}
+
+// pushMany falls back to a Push for each user with connectors that are not a Multicaster.
+// It returns ErrNotRegistered only if none of the users has devices on connector.
+func pushMany(connector Connector, users []int64, message Message) ([]Receipt, error) {
+
+	if len(users) == 1 {
+		receipts, e := connector.Push(users[0], message)
+		return forUser(receipts, users[0]), e
+	}
+
+	if multicaster, ok := connector.(Multicaster); ok {
+		return multicaster.PushMany(users, message)
+	}
+
+	resChan := make(chan pushResult)
+	workers := make(chan bool, multicastWorkers)
+
+	go func() {
+		for _, user := range users {
+
+			workers <- true
+
+			go func(user int64) {
+				receipts, e := connector.Push(user, message)
+				<-workers
+				resChan <- pushResult{receipts: forUser(receipts, user), e: e}
+			}(user)
+		}
+	}()
+
+	merged := &pushResult{e: ErrNotRegistered}
+
+	for range users {
+		merged.merge(<-resChan)
+	}
+
+	return merged.receipts, merged.e
+}
+
+// pushGroups pushes to devices a user at a time with push, with at most multicastWorkers users at once, for the
+// Resumers whose payload depends on the user
+func pushGroups(devices []Device, push func(user int64, devices []Device) ([]Receipt, error)) ([]Receipt, error) {
+
+	var (
+		users  []int64
+		groups = make(map[int64][]Device)
+	)
+
+	for _, dev := range devices {
+
+		if _, ok := groups[dev.User]; !ok {
+			users = append(users, dev.User)
+		}
+
+		groups[dev.User] = append(groups[dev.User], dev)
+	}
+
+	resChan := make(chan pushResult)
+	workers := make(chan bool, multicastWorkers)
+
+	go func() {
+		for _, user := range users {
+
+			workers <- true
+
+			go func(user int64) {
+				receipts, e := push(user, groups[user])
+				<-workers
+				resChan <- pushResult{receipts: forUser(receipts, user), e: e}
+			}(user)
+		}
+	}()
+
+	merged := &pushResult{e: ErrNotRegistered}
+
+	for range users {
+		merged.merge(<-resChan)
+	}
+
+	return merged.receipts, merged.e
+}
+
+// merge adds the outcome of a push to other users through the same connector
+func (res *pushResult) merge(other pushResult) {
+
+	res.receipts = append(res.receipts, other.receipts...)
+
+	switch {
+	case other.e == ErrNotRegistered:
+	case res.e == ErrNotRegistered, res.e == nil && other.e != nil:
+		res.e = other.e
+	}
+}
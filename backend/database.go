@@ -11,12 +11,11 @@
 package backend
 
 import (
-	"container/list"
 	"database/sql"
 	"errors"
 	"log"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
 var (
@@ -25,33 +24,26 @@ var (
 	globalDb           *db
 )
 
-func AddUser(id int64) error {
-	return globalDb.userAdd(id)
-}
-
-func DelUser(id int64) error {
-	return globalDb.userDel(id)
-}
-
-func Exists(id int64) (bool, error) {
-	return globalDb.userExists(id)
-}
-
+// db is the Postgres Store, and also holds the statements of the features that need Postgres
 type db struct {
-	conn                                                                                                                     *sql.DB
-	userAddStmt, userDelStmt, userExistsStmt, gcmIdSubscribed, gcmRegAdd, gcmRegDel, gcmRegExists, gcmRegFetch, gcmUpdateReg *sql.Stmt
+	conn                                     *sql.DB
+	tables                                   []*deviceTable
+	outboxAddStmt                            *sql.Stmt
+	userAddStmt, userDelStmt, userExistsStmt *sql.Stmt
+
+	topicSubStmt, topicUnsubStmt, topicListStmt, topicPageStmt *sql.Stmt
 }
 
-func ConnectDb(connstr string) (e error) {
-	globalDb, e = dialDb(connstr)
-	return
+// ConnectDb opens the Postgres store, like OpenStore
+func ConnectDb(connstr string) error {
+	return OpenStore(StoragePostgres, connstr)
 }
 
 func CloseDb() error {
-	return globalDb.close()
+	return CloseStore()
 }
 
-func dialDb(connstr string) (*db, error) {
+func dialPostgres(connstr string) (*sql.DB, error) {
 	log.Println("Connecting to postgresql...")
 	conn, e := sql.Open("postgres", connstr)
 
@@ -60,19 +52,30 @@ func dialDb(connstr string) (*db, error) {
 	}
 
 	if e = conn.Ping(); e != nil {
+		conn.Close()
 		return nil, e
 	}
 
-	dbInst := new(db)
+	return conn, nil
+}
 
-	dbInst.conn = conn
+func dialDb(connstr string) (*db, error) {
 
-	e = dbInst.gcmInitStmt()
+	conn, e := dialPostgres(connstr)
 
 	if e != nil {
 		return nil, e
 	}
 
+	if e = checkSchema(conn, dialects[StoragePostgres], schemaShared); e != nil {
+		conn.Close()
+		return nil, e
+	}
+
+	dbInst := new(db)
+
+	dbInst.conn = conn
+
 	dbInst.userAddStmt, e = conn.Prepare("INSERT INTO USERS VALUES ($1)")
 
 	if e != nil {
@@ -91,13 +94,25 @@ func dialDb(connstr string) (*db, error) {
 		return nil, e
 	}
 
+	dbInst.outboxAddStmt, e = conn.Prepare("INSERT INTO OUTBOX (USERIDS, TOPIC, TEMPLATE, DATA, NEXTTRY) VALUES ($1,$2,$3,$4,COALESCE($5::timestamptz, now())) RETURNING ID")
+
+	if e != nil {
+		return nil, e
+	}
+
+	if e = dbInst.prepareTopics(); e != nil {
+		return nil, e
+	}
+
 	return dbInst, nil
 }
 
-func (db *db) close() (e error) {
+func (db *db) Close() (e error) {
 
-	if e = db.gcmCloseStmt(); e != nil {
-		return
+	for _, t := range db.tables {
+		if e = t.close(); e != nil {
+			return
+		}
 	}
 
 	if e = db.userAddStmt.Close(); e != nil {
@@ -112,51 +127,35 @@ func (db *db) close() (e error) {
 		return
 	}
 
-	return db.conn.Close()
-
-}
-
-func (db *db) probe() error {
-	return db.conn.Ping()
-}
-
-func (db *db) users() (*list.List, error) {
-
-	people := list.New()
-
-	rows, e := db.conn.Query("SELECT ID FROM USERS")
-
-	if e != nil {
-		return nil, e
+	if e = db.outboxAddStmt.Close(); e != nil {
+		return
 	}
 
-	var id int64
-
-	for rows.Next() {
-		if e = rows.Scan(&id); e != nil {
-			return nil, e
-		}
-
-		people.PushBack(id)
+	if e = db.closeTopics(); e != nil {
+		return
 	}
 
-	if e = rows.Err(); e != nil {
-		return nil, e
-	}
+	return db.conn.Close()
 
-	return people, nil
+}
 
+func (db *db) probe() error {
+	return db.conn.Ping()
 }
 
-func (db *db) userAdd(id int64) error {
+func (db *db) AddUser(id int64) error {
 	log.Printf("Adding user %d...", id)
 
 	_, e := db.userAddStmt.Exec(id)
 
+	if pqErr, ok := e.(*pq.Error); ok && pqErr.Code == "23505" { //unique_violation
+		return ErrUserExists
+	}
+
 	return e
 }
 
-func (db *db) userDel(id int64) error {
+func (db *db) DelUser(id int64) error {
 	log.Printf("Deleting user %d...", id)
 
 	_, e := db.userDelStmt.Exec(id)
@@ -165,50 +164,25 @@ func (db *db) userDel(id int64) error {
 
 }
 
-func (db *db) userExists(id int64) (b bool, e error) {
+func (db *db) UserExists(id int64) (b bool, e error) {
 
 	e = db.userExistsStmt.QueryRow(id).Scan(&b)
 
 	return
 }
 
-func InitDb(connstr string) error {
+func (db *db) Devices(instance string, policy DevicePolicy) (DeviceStore, error) {
 
-	log.Println("Connecting to postgresql...")
-	conn, e := sql.Open("postgres", connstr)
+	t, e := db.newDeviceTable(deviceTableName(instance), policy)
 
 	if e != nil {
-		return e
-	}
-
-	if e = conn.Ping(); e != nil {
-		return e
-	}
-
-	dbInst := new(db)
-
-	dbInst.conn = conn
-
-	if e != nil {
-		return e
-	}
-
-	log.Println("Connected.\nCreating table USERS...")
-
-	_, e = dbInst.conn.Exec("CREATE TABLE USERS (ID BIGINT PRIMARY KEY CHECK (ID > -1))")
-
-	if e != nil {
-		return e
-	}
-
-	log.Println("Done.\nCreating table GCM...")
-
-	if e = dbInst.gcmInitTable(); e != nil {
-		return e
+		return nil, e
 	}
 
-	log.Println("Done.")
-
-	return nil
+	return t, nil
+}
 
+// InitDb migrates a Postgres store to Version, like -initdb did before migrations existed
+func InitDb(connstr string, instances []string) error {
+	return Migrate(StoragePostgres, connstr, instances, Version)
 }
@@ -0,0 +1,342 @@
+/*  Pushed - a daemon for parallel handling of push operations to mobile devices
+ *  Copyright (C) 2014  Marco Cilloni <marco.cilloni@yahoo.com>
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *  Exhibit B is not attached; this software is compatible with the
+ *  licenses expressed under Section 1.12 of the MPL v2.
+ */
+
+package backend
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	deviceDefaultCap = 10
+)
+
+var (
+	ErrDeviceExists = errors.New("The given device token is already present in the database")
+)
+
+// deviceTable is the Postgres DeviceStore. It holds the prepared statements for a connector table shaped like GCM,
+// i.e. a (USERID, TOKEN) pair referencing USERS, plus the DATA of the device and when it was registered and last
+// reached by a push.
+type deviceTable struct {
+	name                                                                     string
+	conn                                                                     *sql.DB
+	policy                                                                   DevicePolicy
+	subscribed, add, del, exists, fetch, fetchMany, updateData, updateTokens *sql.Stmt
+	lockUser, owner, succeeded                                               *sql.Stmt
+}
+
+func (db *db) newDeviceTable(name string, policy DevicePolicy) (t *deviceTable, e error) {
+
+	c := db.conn
+
+	if e = checkSchema(c, dialects[StoragePostgres], name); e != nil {
+		return
+	}
+
+	t = &deviceTable{name: name, conn: c, policy: policy}
+
+	t.subscribed, e = c.Prepare("SELECT COUNT(1) FROM " + name + " WHERE USERID = $1")
+
+	if e != nil {
+		return
+	}
+
+	t.add, e = c.Prepare("INSERT INTO " + name + " (USERID, TOKEN, DATA, REGISTERED) VALUES ($1,$2,$3,$4)")
+
+	if e != nil {
+		return
+	}
+
+	t.del, e = c.Prepare("DELETE FROM " + name + " WHERE TOKEN = $1")
+
+	if e != nil {
+		return
+	}
+
+	t.exists, e = c.Prepare("SELECT COUNT(1) FROM " + name + " WHERE TOKEN = $1")
+
+	if e != nil {
+		return
+	}
+
+	t.owner, e = c.Prepare("SELECT USERID FROM " + name + " WHERE TOKEN = $1")
+
+	if e != nil {
+		return
+	}
+
+	t.fetch, e = c.Prepare("SELECT USERID, TOKEN, DATA, REGISTERED, LAST_SUCCESS FROM " + name + " WHERE USERID = $1")
+
+	if e != nil {
+		return
+	}
+
+	t.fetchMany, e = c.Prepare("SELECT USERID, TOKEN, DATA, REGISTERED, LAST_SUCCESS FROM " + name + " WHERE USERID = ANY($1) ORDER BY USERID")
+
+	if e != nil {
+		return
+	}
+
+	t.updateData, e = c.Prepare("UPDATE " + name + " SET DATA = $2 WHERE TOKEN = $1")
+
+	if e != nil {
+		return
+	}
+
+	t.updateTokens, e = c.Prepare("UPDATE " + name + " SET TOKEN = $2 WHERE TOKEN = $1")
+
+	if e != nil {
+		return
+	}
+
+	t.lockUser, e = c.Prepare("SELECT 1 FROM USERS WHERE ID = $1 FOR UPDATE")
+
+	if e != nil {
+		return
+	}
+
+	t.succeeded, e = c.Prepare("UPDATE " + name + " SET LAST_SUCCESS = $2 WHERE TOKEN = ANY($1)")
+
+	if e != nil {
+		return
+	}
+
+	db.tables = append(db.tables, t)
+
+	return
+}
+
+func (t *deviceTable) close() (e error) {
+
+	if e = t.subscribed.Close(); e != nil {
+		return
+	}
+
+	if e = t.add.Close(); e != nil {
+		return
+	}
+
+	if e = t.del.Close(); e != nil {
+		return
+	}
+
+	if e = t.exists.Close(); e != nil {
+		return
+	}
+
+	if e = t.owner.Close(); e != nil {
+		return
+	}
+
+	if e = t.fetch.Close(); e != nil {
+		return
+	}
+
+	if e = t.fetchMany.Close(); e != nil {
+		return
+	}
+
+	if e = t.updateData.Close(); e != nil {
+		return
+	}
+
+	if e = t.updateTokens.Close(); e != nil {
+		return
+	}
+
+	if e = t.lockUser.Close(); e != nil {
+		return
+	}
+
+	return t.succeeded.Close()
+}
+
+// Add locks the user, so that concurrent registrations cannot both take the last free place
+func (t *deviceTable) Add(id int64, token, data string) error {
+	log.Printf("Adding %s token for %d", t.name, id)
+
+	tx, e := t.conn.Begin()
+
+	if e != nil {
+		return e
+	}
+
+	defer tx.Rollback()
+
+	if _, e = tx.Stmt(t.lockUser).Exec(id); e != nil {
+		return e
+	}
+
+	var tokenExists bool
+
+	if e = tx.Stmt(t.exists).QueryRow(token).Scan(&tokenExists); e != nil {
+		return e
+	}
+
+	if tokenExists {
+		return ErrDeviceExists
+	}
+
+	rows, e := tx.Stmt(t.fetch).Query(id)
+
+	if e != nil {
+		return e
+	}
+
+	devices, e := scanDevices(rows, deviceDefaultCap)
+
+	if e != nil && e != ErrNotRegistered {
+		return e
+	}
+
+	victims, e := t.policy.makeRoom(devices)
+
+	if e != nil {
+		return e
+	}
+
+	for _, victim := range victims {
+		if _, e = tx.Stmt(t.del).Exec(victim); e != nil {
+			return e
+		}
+	}
+
+	if _, e = tx.Stmt(t.add).Exec(id, token, data, time.Now()); e != nil {
+		return e
+	}
+
+	return tx.Commit()
+}
+
+func (t *deviceTable) Delete(token string) error {
+
+	log.Printf("Deleting a %s token", t.name)
+
+	_, e := t.del.Exec(token)
+
+	return e
+}
+
+func (t *deviceTable) Exists(token string) (b bool, e error) {
+	e = t.exists.QueryRow(token).Scan(&b)
+	return
+}
+
+func (t *deviceTable) Owner(token string) (user int64, found bool, e error) {
+
+	switch e = t.owner.QueryRow(token).Scan(&user); e {
+	case nil:
+		return user, true, nil
+	case sql.ErrNoRows:
+		return 0, false, nil
+	}
+
+	return
+}
+
+func (t *deviceTable) Subscribed(id int64) (b bool, e error) {
+	e = t.subscribed.QueryRow(id).Scan(&b)
+	return
+}
+
+func (t *deviceTable) ForUser(id int64) ([]Device, error) {
+
+	rows, e := t.fetch.Query(id)
+
+	if e != nil {
+		return nil, e
+	}
+
+	return scanDevices(rows, deviceDefaultCap)
+}
+
+// ForUsers fetches the devices of many users in a single query
+func (t *deviceTable) ForUsers(ids []int64) ([]Device, error) {
+
+	rows, e := t.fetchMany.Query(pq.Array(ids))
+
+	if e != nil {
+		return nil, e
+	}
+
+	return scanDevices(rows, len(ids))
+}
+
+func scanDevices(rows *sql.Rows, capacity int) ([]Device, error) {
+
+	defer rows.Close()
+
+	devices := make([]Device, 0, capacity)
+
+	var (
+		dev         Device
+		lastSuccess sql.NullTime
+	)
+
+	for rows.Next() {
+		if e := rows.Scan(&dev.User, &dev.Token, &dev.Data, &dev.Registered, &lastSuccess); e != nil {
+			return nil, e
+		}
+
+		dev.LastSuccess = lastSuccess.Time //zero if NULL
+		devices = append(devices, dev)
+	}
+
+	if e := rows.Err(); e != nil {
+		return nil, e
+	}
+
+	if len(devices) == 0 {
+		return nil, ErrNotRegistered
+	}
+
+	return devices, nil
+}
+
+func (t *deviceTable) SetData(token, data string) error {
+
+	_, e := t.updateData.Exec(token, data)
+
+	return e
+}
+
+func (t *deviceTable) UpdateToken(oldToken, newToken string) error {
+
+	result, e := t.updateTokens.Exec(oldToken, newToken)
+
+	if e != nil {
+		return e
+	}
+
+	rowsAffected, e := result.RowsAffected()
+
+	if e != nil {
+		return e
+	}
+
+	if rowsAffected > 1 {
+		log.Panicf("Database inconsistency found (%s token found twice or more)", t.name)
+	}
+
+	return nil
+}
+
+func (t *deviceTable) Succeeded(tokens []string, at time.Time) error {
+
+	_, e := t.succeeded.Exec(pq.Array(tokens), at)
+
+	return e
+}
@@ -0,0 +1,520 @@
+/*  Pushed - a daemon for parallel handling of push operations to mobile devices
+ *  Copyright (C) 2014  Marco Cilloni <marco.cilloni@yahoo.com>
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *  Exhibit B is not attached; this software is compatible with the
+ *  licenses expressed under Section 1.12 of the MPL v2.
+ */
+
+package backend
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	htmlTemplate "html/template"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	EmailDefaultMaxSleepBeforeFail = 8 * time.Second
+	EmailDefaultSubject            = "New notification"
+	EmailDefaultTimeout            = 30 * time.Second
+	emailDefaultSubject            = "{{if and .Notification .Notification.Title}}{{.Notification.Title}}{{else}}" + EmailDefaultSubject + "{{end}}"
+	emailDefaultText               = "{{with .Notification}}{{.Body}}\n\n{{end}}{{range $key, $value := .Message}}{{$key}}: {{$value}}\n{{end}}"
+)
+
+var (
+	EmailInvalidAddress = errors.New("Malformed e-mail address")
+	EmailNoStartTls     = errors.New("SMTP relay does not support STARTTLS")
+	EmailWontTryAgain   = errors.New("Connector has given up with message delivery")
+)
+
+type EmailConfig struct {
+	Relay        string //host:port of the SMTP relay
+	From         string
+	Username     string //PLAIN auth credentials, optional
+	Password     string
+	StartTls     bool   //refuse relays not offering STARTTLS
+	Subject      string //text/template for the subject line
+	TextTemplate string //path of the text/template for the plain text part
+	HtmlTemplate string //path of the html/template for the HTML part, optional
+	MaxRetryTime time.Duration
+	Timeout      time.Duration //of the whole SMTP session
+}
+
+type email struct {
+	auth     smtp.Auth
+	devices  DeviceStore
+	from     string
+	host     string
+	html     *htmlTemplate.Template
+	maxSleep time.Duration
+	relay    string
+	startTls bool
+	subject  *template.Template
+	text     *template.Template
+	timeout  time.Duration
+}
+
+// emailContext is what templates get as their dot
+type emailContext struct {
+	User         int64
+	To           string
+	Message      map[string]interface{} //the data of the message
+	Notification *Notification          //nil for data-only messages
+}
+
+// emailRcptError is a reply to RCPT TO, the only one telling something about the address itself
+type emailRcptError struct {
+	reply *textproto.Error
+}
+
+func (rcptErr *emailRcptError) Error() string {
+	return rcptErr.reply.Error()
+}
+
+func (rcptErr *emailRcptError) Unwrap() error {
+	return rcptErr.reply
+}
+
+type emailOpData struct {
+	Delay   time.Duration
+	Receipt *Receipt //Receipt.Token is the address
+	Data    []byte
+	Error   error
+}
+
+func init() {
+	RegisterConnectorFactory("email", func(name string, settings json.RawMessage) (Connector, error) {
+
+		var config EmailConfig
+
+		if e := json.Unmarshal(settings, &config); e != nil {
+			return nil, e
+		}
+
+		if config.Relay == "" || config.From == "" {
+			return nil, errors.New("Email config object set but no Relay or From field set")
+		}
+
+		config.MaxRetryTime *= time.Second
+		config.Timeout *= time.Second
+
+		return newEmail(name, &config)
+	})
+}
+
+func newEmail(name string, config *EmailConfig) (*email, error) {
+
+	if config.MaxRetryTime == 0 {
+		config.MaxRetryTime = EmailDefaultMaxSleepBeforeFail
+	}
+
+	if config.Subject == "" {
+		config.Subject = emailDefaultSubject
+	}
+
+	if config.Timeout == 0 {
+		config.Timeout = EmailDefaultTimeout
+	}
+
+	host, _, e := net.SplitHostPort(config.Relay)
+
+	if e != nil {
+		return nil, e
+	}
+
+	emailI := &email{
+		from:     config.From,
+		host:     host,
+		maxSleep: config.MaxRetryTime,
+		relay:    config.Relay,
+		startTls: config.StartTls,
+		timeout:  config.Timeout,
+	}
+
+	if config.Username != "" {
+		emailI.auth = smtp.PlainAuth("", config.Username, config.Password, host)
+	}
+
+	if emailI.subject, e = template.New("subject").Parse(config.Subject); e != nil {
+		return nil, e
+	}
+
+	if config.TextTemplate != "" {
+		emailI.text, e = template.ParseFiles(config.TextTemplate)
+	} else {
+		emailI.text, e = template.New("text").Parse(emailDefaultText)
+	}
+
+	if e != nil {
+		return nil, e
+	}
+
+	if config.HtmlTemplate != "" {
+		if emailI.html, e = htmlTemplate.ParseFiles(config.HtmlTemplate); e != nil {
+			return nil, e
+		}
+	}
+
+	if emailI.devices, e = openDevices(name); e != nil {
+		return nil, e
+	}
+
+	return emailI, nil
+
+}
+
+func (email *email) Exists(deviceTargetId string) (bool, error) {
+
+	return email.devices.Exists(deviceTargetId)
+
+}
+
+func (email *email) Owner(deviceTargetId string) (int64, bool, error) {
+
+	return email.devices.Owner(deviceTargetId)
+
+}
+
+func (email *email) Push(user int64, message Message) ([]Receipt, error) {
+
+	addresses, e := userTokens(email.devices, user)
+
+	if e != nil {
+		return nil, e
+	}
+
+	return email.addressesPush(user, addresses, message)
+
+}
+
+// PushExcept mails the addresses of users that are not in reached
+func (email *email) PushExcept(users []int64, message Message, reached map[string]bool) ([]Receipt, error) {
+
+	devices, e := devicesExcept(email.devices, users, reached)
+
+	if e != nil {
+		return nil, e
+	}
+
+	return pushGroups(devices, func(user int64, devices []Device) ([]Receipt, error) {
+		return email.addressesPush(user, deviceTokens(devices), message)
+	})
+
+}
+
+func (email *email) addressesPush(user int64, addresses []string, message Message) ([]Receipt, error) {
+
+	receipts := newReceipts(addresses)
+
+	var err error
+
+	for i := range receipts {
+
+		receipt := &receipts[i]
+
+		msg, e := email.render(&emailContext{User: user, To: receipt.Token, Message: message.Data, Notification: message.Notification})
+
+		if e == nil && !message.Options.DryRun {
+			e = email.send(receipt, msg, time.Second)
+		}
+
+		receipt.settle(e)
+
+		if message.Options.DryRun {
+			receipt.validated()
+		}
+
+		if e != nil && err == nil {
+			err = e
+		}
+	}
+
+	return receipts, err
+
+}
+
+func (email *email) Register(user int64, deviceTargetId string) error {
+
+	addr, e := mail.ParseAddress(deviceTargetId)
+
+	if e != nil || addr.Address != deviceTargetId {
+		return EmailInvalidAddress
+	}
+
+	return email.devices.Add(user, deviceTargetId, "")
+
+}
+
+func (email *email) Subscribed(user int64) (bool, error) {
+	return email.devices.Subscribed(user)
+}
+
+func (email *email) Unregister(deviceTargetId string) error {
+
+	return email.devices.Delete(deviceTargetId)
+
+}
+
+func writeQuotedPrintable(w *bytes.Buffer, render func(*quotedprintable.Writer) error) error {
+
+	qp := quotedprintable.NewWriter(w)
+
+	if e := render(qp); e != nil {
+		return e
+	}
+
+	return qp.Close()
+}
+
+// render builds the whole RFC 5322 message, with a multipart/alternative body when an HTML template is configured
+func (email *email) render(ctx *emailContext) ([]byte, error) {
+
+	var subject bytes.Buffer
+
+	if e := email.subject.Execute(&subject, ctx); e != nil {
+		return nil, e
+	}
+
+	msgId := make([]byte, 16)
+
+	if _, e := rand.Read(msgId); e != nil {
+		return nil, e
+	}
+
+	hostname, _ := os.Hostname()
+
+	var buffer bytes.Buffer
+
+	header := textproto.MIMEHeader{}
+	header.Set("From", email.from)
+	header.Set("To", ctx.To)
+	header.Set("Subject", mime.QEncoding.Encode("utf-8", strings.TrimSpace(subject.String())))
+	header.Set("Date", time.Now().Format(time.RFC1123Z))
+	header.Set("Message-ID", "<"+hex.EncodeToString(msgId)+"@"+hostname+">")
+	header.Set("MIME-Version", "1.0")
+
+	renderText := func(w *quotedprintable.Writer) error {
+		return email.text.Execute(w, ctx)
+	}
+
+	if email.html == nil {
+		header.Set("Content-Type", "text/plain; charset=utf-8")
+		header.Set("Content-Transfer-Encoding", "quoted-printable")
+		writeHeader(&buffer, header)
+
+		if e := writeQuotedPrintable(&buffer, renderText); e != nil {
+			return nil, e
+		}
+
+		return buffer.Bytes(), nil
+	}
+
+	var body bytes.Buffer
+
+	parts := multipart.NewWriter(&body)
+
+	header.Set("Content-Type", "multipart/alternative; boundary="+parts.Boundary())
+	writeHeader(&buffer, header)
+
+	partHeader := textproto.MIMEHeader{}
+	partHeader.Set("Content-Transfer-Encoding", "quoted-printable")
+
+	for _, part := range []struct {
+		contentType string
+		render      func(*quotedprintable.Writer) error
+	}{
+		{"text/plain; charset=utf-8", renderText},
+		{"text/html; charset=utf-8", func(w *quotedprintable.Writer) error {
+			return email.html.Execute(w, ctx)
+		}},
+	} {
+		partHeader.Set("Content-Type", part.contentType)
+
+		w, e := parts.CreatePart(partHeader)
+
+		if e != nil {
+			return nil, e
+		}
+
+		var partBody bytes.Buffer
+
+		if e = writeQuotedPrintable(&partBody, part.render); e != nil {
+			return nil, e
+		}
+
+		if _, e = partBody.WriteTo(w); e != nil {
+			return nil, e
+		}
+	}
+
+	if e := parts.Close(); e != nil {
+		return nil, e
+	}
+
+	body.WriteTo(&buffer)
+
+	return buffer.Bytes(), nil
+}
+
+func writeHeader(buffer *bytes.Buffer, header textproto.MIMEHeader) {
+
+	for key, values := range header {
+		for _, value := range values {
+			buffer.WriteString(key)
+			buffer.WriteString(": ")
+			buffer.WriteString(value)
+			buffer.WriteString("\r\n")
+		}
+	}
+
+	buffer.WriteString("\r\n")
+}
+
+func (email *email) expRetry(opData *emailOpData) error {
+
+	if opData.Delay > email.maxSleep {
+		return EmailWontTryAgain
+	}
+
+	sleep := opData.Delay
+
+	if 2*opData.Delay > email.maxSleep {
+		sleep = email.maxSleep
+	}
+
+	time.Sleep(sleep)
+
+	return email.send(opData.Receipt, opData.Data, 2*opData.Delay)
+
+}
+
+func (email *email) evalError(opData *emailOpData) error {
+
+	var smtpErr *textproto.Error
+
+	if !errors.As(opData.Error, &smtpErr) {
+		return opData.Error
+	}
+
+	_, rcpt := opData.Error.(*emailRcptError)
+
+	switch {
+	case rcpt && (smtpErr.Code == 550 || smtpErr.Code == 553): //Mailbox does not exist, or address rejected
+		log.Printf("E-mail address %s has been rejected from relay with %d and has been deleted.", opData.Receipt.Token, smtpErr.Code)
+		opData.Receipt.removed(smtpErr.Error())
+		return email.devices.Delete(opData.Receipt.Token)
+
+	case smtpErr.Code >= 400 && smtpErr.Code <= 499:
+		log.Printf("SMTP transient failure %d, beginning exponential retry", smtpErr.Code)
+
+		if e := email.expRetry(opData); e != EmailWontTryAgain {
+			return e
+		}
+
+		return smtpErr
+
+	default:
+		return smtpErr
+	}
+
+}
+
+func (email *email) send(receipt *Receipt, data []byte, retryTime time.Duration) error {
+
+	e := email.deliver(receipt.Token, data)
+
+	if e == nil {
+		return nil
+	}
+
+	return email.evalError(&emailOpData{
+		Delay:   retryTime,
+		Receipt: receipt,
+		Data:    data,
+		Error:   e,
+	})
+}
+
+// deliver is smtp.SendMail with STARTTLS made mandatory when configured to
+func (email *email) deliver(to string, data []byte) error {
+
+	conn, e := net.DialTimeout("tcp", email.relay, email.timeout)
+
+	if e != nil {
+		return e
+	}
+
+	if email.timeout > 0 {
+		conn.SetDeadline(time.Now().Add(email.timeout))
+	}
+
+	c, e := smtp.NewClient(conn, email.host)
+
+	if e != nil {
+		conn.Close()
+		return e
+	}
+
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if e = c.StartTLS(&tls.Config{ServerName: email.host}); e != nil {
+			return e
+		}
+	} else if email.startTls {
+		return EmailNoStartTls
+	}
+
+	if email.auth != nil {
+		if e = c.Auth(email.auth); e != nil {
+			return e
+		}
+	}
+
+	if e = c.Mail(email.from); e != nil {
+		return e
+	}
+
+	if e = c.Rcpt(to); e != nil {
+		if smtpErr, ok := e.(*textproto.Error); ok {
+			return &emailRcptError{smtpErr}
+		}
+
+		return e
+	}
+
+	w, e := c.Data()
+
+	if e != nil {
+		return e
+	}
+
+	if _, e = w.Write(data); e != nil {
+		return e
+	}
+
+	if e = w.Close(); e != nil {
+		return e
+	}
+
+	return c.Quit()
+}
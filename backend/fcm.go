@@ -0,0 +1,702 @@
+/*  Pushed - a daemon for parallel handling of push operations to mobile devices
+ *  Copyright (C) 2014  Marco Cilloni <marco.cilloni@yahoo.com>
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *  Exhibit B is not attached; this software is compatible with the
+ *  licenses expressed under Section 1.12 of the MPL v2.
+ */
+
+package backend
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	FcmDefaultEndpoint           = "https://fcm.googleapis.com"
+	FcmDefaultMaxHttpConns       = 5
+	FcmDefaultMaxSleepBeforeFail = 8 * time.Second
+	FcmDefaultTimeout            = 10 * time.Second
+	FcmDefaultTokenUrl           = "https://oauth2.googleapis.com/token"
+	fcmGrantType                 = "urn:ietf:params:oauth:grant-type:jwt-bearer"
+	fcmMaxPayloadSize            = 4096
+	fcmScope                     = "https://www.googleapis.com/auth/firebase.messaging"
+	fcmTokenLifetime             = time.Hour
+	fcmTokenSlack                = time.Minute
+)
+
+var (
+	FcmAuthError            = errors.New("FCM refused the access token. Check the service account credentials twice.")
+	FcmInternalServerError  = errors.New("FCM internal server error.")
+	FcmInvalidCredentials   = errors.New("Invalid FCM service account credentials")
+	FcmMessageTooLargeError = errors.New("Message is bigger than 4 KiBs (4096 bytes)")
+	FcmQuotaExceededError   = errors.New("FCM sending quota exceeded.")
+	FcmReservedKeyError     = errors.New("Message contains a data key reserved by FCM")
+	FcmTimeoutError         = errors.New("Timeout or FCM server unavailable.")
+	FcmWontTryAgain         = errors.New("Connector has given up with message delivery")
+)
+
+type FcmConfig struct {
+	Credentials  string //path of the service account JSON file
+	ProjectId    string //overrides project_id in Credentials
+	Endpoint     string //FCM base URL, defaults to FcmDefaultEndpoint
+	TokenUrl     string //OAuth2 token URL, overrides token_uri in Credentials
+	MaxTcpConns  int
+	MaxRetryTime time.Duration
+	Timeout      time.Duration
+}
+
+type fcmCredentials struct {
+	Type         string `json:"type"`
+	ProjectId    string `json:"project_id"`
+	PrivateKeyId string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	ClientEmail  string `json:"client_email"`
+	TokenUri     string `json:"token_uri"`
+}
+
+type fcm struct {
+	client   *http.Client
+	devices  DeviceStore
+	email    string
+	key      *rsa.PrivateKey
+	keyId    string
+	maxSleep time.Duration
+	sendUrl  string
+	tokenUrl string
+
+	accessLock  sync.Mutex
+	accessToken string
+	accessUntil time.Time
+}
+
+type fcmNotification struct {
+	Title string `json:"title,omitempty"`
+	Body  string `json:"body,omitempty"`
+}
+
+type fcmAndroidNotification struct {
+	Icon              string   `json:"icon,omitempty"`
+	Sound             string   `json:"sound,omitempty"`
+	ClickAction       string   `json:"click_action,omitempty"`
+	TitleLocKey       string   `json:"title_loc_key,omitempty"`
+	TitleLocArgs      []string `json:"title_loc_args,omitempty"`
+	BodyLocKey        string   `json:"body_loc_key,omitempty"`
+	BodyLocArgs       []string `json:"body_loc_args,omitempty"`
+	NotificationCount *int     `json:"notification_count,omitempty"`
+}
+
+type fcmAndroidConfig struct {
+	CollapseKey           string                  `json:"collapse_key,omitempty"`
+	Priority              string                  `json:"priority,omitempty"`
+	Ttl                   string                  `json:"ttl,omitempty"`
+	RestrictedPackageName string                  `json:"restricted_package_name,omitempty"`
+	Notification          *fcmAndroidNotification `json:"notification,omitempty"`
+}
+
+type fcmMessage struct {
+	Token        string            `json:"token,omitempty"`
+	Data         map[string]string `json:"data,omitempty"`
+	Notification *fcmNotification  `json:"notification,omitempty"`
+	Android      *fcmAndroidConfig `json:"android,omitempty"`
+}
+
+type fcmPayload struct {
+	ValidateOnly bool       `json:"validate_only,omitempty"`
+	Message      fcmMessage `json:"message"`
+}
+
+type fcmClaims struct {
+	Issuer   string `json:"iss"`
+	Scope    string `json:"scope"`
+	Audience string `json:"aud"`
+	IssuedAt int64  `json:"iat"`
+	Expires  int64  `json:"exp"`
+}
+
+type fcmTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int64  `json:"expires_in"`
+	TokenType   string `json:"token_type"`
+}
+
+type fcmFieldViolation struct {
+	Field       string `json:"field"`
+	Description string `json:"description"`
+}
+
+type fcmErrorDetail struct {
+	Type            string              `json:"@type"`
+	ErrorCode       string              `json:"errorCode"`
+	FieldViolations []fcmFieldViolation `json:"fieldViolations"`
+}
+
+type fcmErrorResponse struct {
+	Error struct {
+		Code    int              `json:"code"`
+		Message string           `json:"message"`
+		Status  string           `json:"status"`
+		Details []fcmErrorDetail `json:"details"`
+	} `json:"error"`
+}
+
+// the FcmError errorCode is more specific than status, so prefer it when present
+func (res *fcmErrorResponse) code() string {
+
+	for _, detail := range res.Error.Details {
+		if strings.HasSuffix(detail.Type, "google.firebase.fcm.v1.FcmError") && detail.ErrorCode != "" {
+			return detail.ErrorCode
+		}
+	}
+
+	return res.Error.Status
+}
+
+// badToken tells if a google.rpc.BadRequest detail blames the token, as INVALID_ARGUMENT is also returned for bad options
+func (res *fcmErrorResponse) badToken() bool {
+
+	for _, detail := range res.Error.Details {
+		if !strings.HasSuffix(detail.Type, "google.rpc.BadRequest") {
+			continue
+		}
+
+		for _, violation := range detail.FieldViolations {
+			if violation.Field == "message.token" {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+type fcmOpData struct {
+	Delay    time.Duration
+	Data     *fcmPayload
+	Receipt  *Receipt
+	Response *http.Response
+	Reauthed bool //a fresh access token has already been tried
+}
+
+type fcmSendResponse struct {
+	Name string `json:"name"` //projects/*/messages/{message_id}
+}
+
+func init() {
+	RegisterConnectorFactory("fcm", func(name string, settings json.RawMessage) (Connector, error) {
+
+		var config FcmConfig
+
+		if e := json.Unmarshal(settings, &config); e != nil {
+			return nil, e
+		}
+
+		if config.Credentials == "" {
+			return nil, errors.New("Fcm config object set but no Credentials field set")
+		}
+
+		config.MaxRetryTime *= time.Second
+		config.Timeout *= time.Second
+
+		return newFcm(name, &config)
+	})
+}
+
+func newFcm(name string, config *FcmConfig) (*fcm, error) {
+
+	if config.MaxTcpConns == 0 {
+		config.MaxTcpConns = FcmDefaultMaxHttpConns
+	}
+
+	if config.MaxRetryTime == 0 {
+		config.MaxRetryTime = FcmDefaultMaxSleepBeforeFail
+	}
+
+	if config.Timeout == 0 {
+		config.Timeout = FcmDefaultTimeout
+	}
+
+	credData, e := ioutil.ReadFile(config.Credentials)
+
+	if e != nil {
+		return nil, e
+	}
+
+	var creds fcmCredentials
+
+	if e = json.Unmarshal(credData, &creds); e != nil {
+		return nil, e
+	}
+
+	if creds.ClientEmail == "" || creds.PrivateKey == "" {
+		return nil, FcmInvalidCredentials
+	}
+
+	key, e := parsePrivateKey([]byte(creds.PrivateKey))
+
+	if e != nil {
+		return nil, e
+	}
+
+	rsaKey, ok := key.(*rsa.PrivateKey)
+
+	if !ok {
+		return nil, FcmInvalidCredentials
+	}
+
+	projectId := config.ProjectId
+
+	if projectId == "" {
+		projectId = creds.ProjectId
+	}
+
+	if projectId == "" {
+		return nil, errors.New("No FCM project id in configuration or credentials")
+	}
+
+	endpoint := config.Endpoint
+
+	if endpoint == "" {
+		endpoint = FcmDefaultEndpoint
+	}
+
+	tokenUrl := config.TokenUrl
+
+	if tokenUrl == "" {
+		tokenUrl = creds.TokenUri
+	}
+
+	if tokenUrl == "" {
+		tokenUrl = FcmDefaultTokenUrl
+	}
+
+	devices, e := openDevices(name)
+
+	if e != nil {
+		return nil, e
+	}
+
+	return &fcm{
+		client: &http.Client{
+			Timeout: config.Timeout,
+			Transport: &http.Transport{
+				MaxIdleConnsPerHost: config.MaxTcpConns,
+			},
+		},
+		devices:  devices,
+		email:    creds.ClientEmail,
+		key:      rsaKey,
+		keyId:    creds.PrivateKeyId,
+		maxSleep: config.MaxRetryTime,
+		sendUrl:  strings.TrimRight(endpoint, "/") + "/v1/projects/" + url.PathEscape(projectId) + "/messages:send",
+		tokenUrl: tokenUrl,
+	}, nil
+
+}
+
+func (fcm *fcm) Exists(deviceTargetId string) (bool, error) {
+
+	return fcm.devices.Exists(deviceTargetId)
+
+}
+
+func (fcm *fcm) Owner(deviceTargetId string) (int64, bool, error) {
+
+	return fcm.devices.Owner(deviceTargetId)
+
+}
+
+func (fcm *fcm) Push(user int64, message Message) ([]Receipt, error) {
+
+	tokens, e := userTokens(fcm.devices, user)
+
+	if e != nil {
+		return nil, e
+	}
+
+	return fcm.tokensPush(tokens, message)
+
+}
+
+// PushExcept pushes to the devices of users whose tokens are not in reached
+func (fcm *fcm) PushExcept(users []int64, message Message, reached map[string]bool) ([]Receipt, error) {
+
+	devices, e := devicesExcept(fcm.devices, users, reached)
+
+	if e != nil {
+		return nil, e
+	}
+
+	receipts, e := fcm.tokensPush(deviceTokens(devices), message)
+
+	for i := range receipts {
+		receipts[i].User = devices[i].User
+	}
+
+	return receipts, e
+
+}
+
+func (fcm *fcm) Register(user int64, deviceTargetId string) error {
+
+	return fcm.devices.Add(user, deviceTargetId, "")
+
+}
+
+func (fcm *fcm) Subscribed(user int64) (bool, error) {
+	return fcm.devices.Subscribed(user)
+}
+
+func (fcm *fcm) Unregister(deviceTargetId string) error {
+
+	return fcm.devices.Delete(deviceTargetId)
+
+}
+
+// bearer returns a cached OAuth2 access token, minting a new one through the JWT bearer grant when it is about to expire
+func (fcm *fcm) bearer() (string, error) {
+
+	fcm.accessLock.Lock()
+	defer fcm.accessLock.Unlock()
+
+	now := time.Now()
+
+	if fcm.accessToken != "" && now.Add(fcmTokenSlack).Before(fcm.accessUntil) {
+		return fcm.accessToken, nil
+	}
+
+	assertion, e := jwtSignRS256(fcm.key, fcm.keyId, &fcmClaims{
+		Issuer:   fcm.email,
+		Scope:    fcmScope,
+		Audience: fcm.tokenUrl,
+		IssuedAt: now.Unix(),
+		Expires:  now.Add(fcmTokenLifetime).Unix(),
+	})
+
+	if e != nil {
+		return "", e
+	}
+
+	res, e := fcm.client.PostForm(fcm.tokenUrl, url.Values{
+		"grant_type": {fcmGrantType},
+		"assertion":  {assertion},
+	})
+
+	if e != nil {
+		return "", e
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != 200 {
+		body, _ := ioutil.ReadAll(res.Body)
+		return "", errors.New("OAuth2 server refused FCM credentials: " + string(body))
+	}
+
+	var token fcmTokenResponse
+
+	if e = json.NewDecoder(res.Body).Decode(&token); e != nil {
+		return "", e
+	}
+
+	if token.AccessToken == "" {
+		return "", errors.New("OAuth2 server returned an empty access token")
+	}
+
+	fcm.accessToken = token.AccessToken
+	fcm.accessUntil = now.Add(time.Duration(token.ExpiresIn) * time.Second)
+
+	return fcm.accessToken, nil
+}
+
+func (fcm *fcm) dropBearer() {
+	fcm.accessLock.Lock()
+	fcm.accessToken = ""
+	fcm.accessLock.Unlock()
+}
+
+func (fcm *fcm) expRetry(opData *fcmOpData) error {
+
+	if opData.Delay > fcm.maxSleep {
+		return FcmWontTryAgain
+	}
+
+	sleep := opData.Delay
+
+	if 2*opData.Delay > fcm.maxSleep {
+		sleep = fcm.maxSleep
+	}
+
+	time.Sleep(sleep)
+
+	return fcm.payloadPush(opData.Data, opData.Receipt, 2*opData.Delay)
+
+}
+
+func (fcm *fcm) evalResponse(opData *fcmOpData) error {
+
+	res := opData.Response
+
+	defer res.Body.Close()
+
+	if res.StatusCode == 200 {
+
+		var sendResp fcmSendResponse
+
+		json.NewDecoder(res.Body).Decode(&sendResp) //the message ID is a nicety, the push went through anyway
+
+		opData.Receipt.delivered(sendResp.Name[strings.LastIndex(sendResp.Name, "/")+1:])
+
+		return nil
+	}
+
+	var errResp fcmErrorResponse
+
+	body, e := ioutil.ReadAll(res.Body)
+
+	if e != nil {
+		return e
+	}
+
+	if e = json.Unmarshal(body, &errResp); e != nil {
+		errResp.Error.Message = string(body)
+	}
+
+	code := errResp.code()
+
+	//honour Retry-After for throttling, it's usually way bigger than our first delay
+	if after, e := strconv.Atoi(res.Header.Get("Retry-After")); e == nil && time.Duration(after)*time.Second > opData.Delay {
+		opData.Delay = time.Duration(after) * time.Second
+	}
+
+	token := opData.Data.Message.Token
+
+	switch {
+	case code == "UNREGISTERED": //User has removed the application
+		opData.Receipt.removed(code)
+		return fcm.devices.Delete(token)
+
+	case code == "SENDER_ID_MISMATCH", code == "INVALID_ARGUMENT" && errResp.badToken():
+		log.Printf("FCM token %s has been rejected from server with %s and has been deleted.", token, code)
+		opData.Receipt.removed(code)
+		return fcm.devices.Delete(token)
+
+	case code == "QUOTA_EXCEEDED":
+		log.Println("FCM quota exceeded, beginning exponential retry")
+
+		if e := fcm.expRetry(opData); e != FcmWontTryAgain {
+			return e
+		}
+
+		return FcmQuotaExceededError
+
+	case code == "UNAVAILABLE", res.StatusCode == 503:
+		log.Println("FCM unavailable, beginning exponential retry")
+
+		if e := fcm.expRetry(opData); e != FcmWontTryAgain {
+			return e
+		}
+
+		return FcmTimeoutError
+
+	case code == "INTERNAL", res.StatusCode >= 500:
+		log.Println("FCM internal server error, beginning exponential retry")
+
+		if e := fcm.expRetry(opData); e != FcmWontTryAgain {
+			return e
+		}
+
+		return FcmInternalServerError
+
+	case res.StatusCode == 401, res.StatusCode == 403:
+		fcm.dropBearer()
+
+		//the cached token may have been revoked before its expiry, so mint a new one before giving up
+		if !opData.Reauthed {
+			opData.Reauthed = true
+			return fcm.send(opData)
+		}
+
+		return FcmAuthError
+
+	default:
+		return errors.New("FCM error " + code + ": " + errResp.Error.Message)
+	}
+
+}
+
+func (fcm *fcm) payloadPush(payload *fcmPayload, receipt *Receipt, retryTime time.Duration) error {
+
+	return fcm.send(&fcmOpData{
+		Delay:   retryTime,
+		Data:    payload,
+		Receipt: receipt,
+	})
+
+}
+
+func (fcm *fcm) send(opData *fcmOpData) error {
+
+	jsonPayload, e := json.Marshal(opData.Data)
+
+	if e != nil {
+		return e
+	}
+
+	bearer, e := fcm.bearer()
+
+	if e != nil {
+		return e
+	}
+
+	req, e := http.NewRequest("POST", fcm.sendUrl, bytes.NewReader(jsonPayload))
+
+	if e != nil {
+		return e
+	}
+
+	req.Header.Add("Authorization", "Bearer "+bearer)
+	req.Header.Add("Content-Type", "application/json")
+
+	if opData.Response, e = fcm.client.Do(req); e != nil {
+		return e
+	}
+
+	return fcm.evalResponse(opData)
+
+}
+
+// fcmAndroid maps options and the Android specific parts of the notification to the android section of a
+// v1 message. The v1 API has no delay_while_idle.
+func fcmAndroid(options *PushOptions, notification *Notification) *fcmAndroidConfig {
+
+	config := &fcmAndroidConfig{
+		CollapseKey:           options.CollapseKey,
+		Priority:              strings.ToUpper(options.Priority),
+		RestrictedPackageName: options.RestrictedPackageName,
+	}
+
+	if options.TimeToLive != nil {
+		config.Ttl = strconv.Itoa(*options.TimeToLive) + "s"
+	}
+
+	if n := notification; n != nil {
+		config.Notification = &fcmAndroidNotification{
+			Icon:              n.Icon,
+			Sound:             n.Sound,
+			ClickAction:       n.ClickAction,
+			TitleLocKey:       n.TitleLocKey,
+			TitleLocArgs:      n.TitleLocArgs,
+			BodyLocKey:        n.BodyLocKey,
+			BodyLocArgs:       n.BodyLocArgs,
+			NotificationCount: n.Badge,
+		}
+	}
+
+	if *config == (fcmAndroidConfig{}) {
+		return nil
+	}
+
+	return config
+}
+
+// fcmBuild translates message into a v1 message without token, and checks it against the limits of FCM
+func fcmBuild(message *Message) (*fcmMessage, error) {
+
+	data, e := stringData(message.Data) //v1 data only has string values
+
+	if e != nil {
+		return nil, e
+	}
+
+	for key := range data {
+		switch {
+		case key == "from", key == "message_type", key == "collapse_key",
+			strings.HasPrefix(key, "google."), strings.HasPrefix(key, "gcm."):
+			return nil, FcmReservedKeyError
+		}
+	}
+
+	built := &fcmMessage{
+		Data:    data,
+		Android: fcmAndroid(&message.Options, message.Notification),
+	}
+
+	if n := message.Notification; n != nil && (n.Title != "" || n.Body != "") {
+		built.Notification = &fcmNotification{Title: n.Title, Body: n.Body}
+	}
+
+	jsonMessage, e := json.Marshal(built)
+
+	if e != nil {
+		return nil, e
+	}
+
+	if len(jsonMessage) > fcmMaxPayloadSize {
+		return nil, FcmMessageTooLargeError
+	}
+
+	return built, nil
+}
+
+// tokensPush sends one request per token, as the v1 API has no multicast, with at most multicastWorkers at once
+func (fcm *fcm) tokensPush(tokens []string, message Message) ([]Receipt, error) {
+
+	receipts := newReceipts(tokens)
+
+	built, e := fcmBuild(&message)
+
+	if e != nil {
+		return settleAll(receipts, e)
+	}
+
+	errChan := make(chan error, len(tokens))
+	workers := make(chan bool, multicastWorkers)
+
+	for i := range receipts {
+
+		workers <- true
+
+		go func(receipt *Receipt) {
+
+			defer func() { <-workers }()
+
+			payload := &fcmPayload{ValidateOnly: message.Options.DryRun, Message: *built}
+			payload.Message.Token = receipt.Token
+
+			e := fcm.payloadPush(payload, receipt, time.Second)
+
+			receipt.settle(e)
+
+			if message.Options.DryRun {
+				receipt.validated()
+			}
+
+			errChan <- e
+		}(&receipts[i])
+	}
+
+	var err error
+
+	for range tokens {
+		if e := <-errChan; e != nil && err == nil {
+			err = e
+		}
+	}
+
+	return receipts, err
+
+}
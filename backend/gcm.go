@@ -16,6 +16,7 @@ import (
 	"errors"
 	"log"
 	"net/http"
+	"strconv"
 	"time"
 
 	"io/ioutil"
@@ -24,11 +25,12 @@ import (
 const (
 	GcmDefaultMaxHttpConns       = 5
 	GcmDefaultMaxSleepBeforeFail = 8 * time.Second
+	gcmMaxPayloadSize            = 4096
+	gcmMaxRegIds                 = 1000 //registration_ids allowed in a single multicast request
 	gcmRequestUrl                = "https://android.googleapis.com/gcm/send"
 )
 
 var (
-	GcmAlreadyExistent      = errors.New("The given Registration ID is already present in the database")
 	GcmAuthError            = errors.New("The given GCM authkey is invalid. Check it twice.")
 	GcmInternalServerError  = errors.New("Internal server error.")
 	GcmMessageTooLargeError = errors.New("Message is bigger than 4 KiBs (4096 bytes)")
@@ -37,6 +39,12 @@ var (
 	GcmWontTryAgain         = errors.New("Connector has given up with message delivery")
 )
 
+// errors reported when GCM keeps answering a registration ID with one of the retriable results
+var gcmRetryErrors = map[string]error{
+	"InternalServerError": GcmInternalServerError,
+	"Unavailable":         GcmTimeoutError,
+}
+
 type GcmConfig struct {
 	ApiKey       string
 	MaxTcpConns  int
@@ -46,252 +54,187 @@ type GcmConfig struct {
 type gcm struct {
 	apiKey   string
 	client   *http.Client
+	devices  DeviceStore
 	maxSleep time.Duration
 }
 
 type gcmPayload struct {
-	RegIds []string          `json:"registration_ids"`
-	Data   map[string]string `json:"data"`
+	RegIds                []string               `json:"registration_ids,omitempty"`
+	Data                  map[string]interface{} `json:"data"`
+	Notification          *gcmNotification       `json:"notification,omitempty"`
+	TimeToLive            *int                   `json:"time_to_live,omitempty"`
+	CollapseKey           string                 `json:"collapse_key,omitempty"`
+	Priority              string                 `json:"priority,omitempty"`
+	DelayWhileIdle        bool                   `json:"delay_while_idle,omitempty"`
+	RestrictedPackageName string                 `json:"restricted_package_name,omitempty"`
+	DryRun                bool                   `json:"dry_run,omitempty"`
 }
 
-func (db *db) gcmInitStmt() (e error) {
-
-	c := db.conn
-
-	db.gcmIdSubscribed, e = c.Prepare("SELECT COUNT(1) FROM GCM WHERE USERID = $1")
-
-	if e != nil {
-		return
-	}
-
-	db.gcmRegAdd, e = c.Prepare("INSERT INTO GCM VALUES ($1,$2)")
-
-	if e != nil {
-		return
-	}
-
-	db.gcmRegDel, e = c.Prepare("DELETE FROM GCM WHERE REGID = $1")
-
-	if e != nil {
-		return
-	}
-
-	db.gcmRegExists, e = c.Prepare("SELECT COUNT(1) FROM GCM WHERE REGID = $1")
-
-	if e != nil {
-		return
-	}
-
-	db.gcmRegFetch, e = c.Prepare("SELECT REGID FROM GCM WHERE USERID = $1")
-
-	if e != nil {
-		return
-	}
-
-	db.gcmUpdateReg, e = c.Prepare("UPDATE GCM SET REGID = $2 WHERE REGID = $1")
-
-	return
-
+// gcmNotification has the loc args as JSON arrays encoded in strings, as GCM wants them
+type gcmNotification struct {
+	Title        string `json:"title,omitempty"`
+	Body         string `json:"body,omitempty"`
+	Icon         string `json:"icon,omitempty"`
+	Sound        string `json:"sound,omitempty"`
+	Badge        string `json:"badge,omitempty"`
+	ClickAction  string `json:"click_action,omitempty"`
+	TitleLocKey  string `json:"title_loc_key,omitempty"`
+	TitleLocArgs string `json:"title_loc_args,omitempty"`
+	BodyLocKey   string `json:"body_loc_key,omitempty"`
+	BodyLocArgs  string `json:"body_loc_args,omitempty"`
 }
 
-func (db *db) gcmAddRegistrationId(id int64, regid string) error {
-	log.Printf("Adding GCM RegId for %d", id)
+func init() {
+	RegisterConnectorFactory("gcm", func(name string, settings json.RawMessage) (Connector, error) {
 
-	idExists, e := db.gcmExistsRegistrationId(regid)
+		var config GcmConfig
 
-	if e != nil {
-		return e
-	}
+		if e := json.Unmarshal(settings, &config); e != nil {
+			return nil, e
+		}
 
-	if idExists {
-		return GcmAlreadyExistent
-	}
+		if config.ApiKey == "" {
+			return nil, errors.New("Gcm config object set but no ApiKey field set")
+		}
 
-	_, e = db.gcmRegAdd.Exec(id, regid)
+		config.MaxRetryTime *= time.Second //I don't expect people to input nanoseconds ;)
 
-	return e
+		return newGcm(name, &config)
+	})
 }
 
-func (db *db) gcmCloseStmt() (e error) {
-
-	if e = db.gcmIdSubscribed.Close(); e != nil {
-		return
-	}
+func newGcm(name string, config *GcmConfig) (*gcm, error) {
 
-	if e = db.gcmRegAdd.Close(); e != nil {
-		return
+	if config.MaxTcpConns == 0 {
+		config.MaxTcpConns = GcmDefaultMaxHttpConns
 	}
 
-	if e = db.gcmRegDel.Close(); e != nil {
-		return
+	if config.MaxRetryTime == 0 {
+		config.MaxRetryTime = GcmDefaultMaxSleepBeforeFail
 	}
 
-	if e = db.gcmRegExists.Close(); e != nil {
-		return
-	}
+	devices, e := openDevices(name)
 
-	if e = db.gcmRegFetch.Close(); e != nil {
-		return
+	if e != nil {
+		return nil, e
 	}
 
-	return db.gcmUpdateReg.Close()
+	return &gcm{
+		apiKey: "key=" + config.ApiKey,
+		client: &http.Client{
+			Transport: &http.Transport{
+				MaxIdleConnsPerHost: config.MaxTcpConns,
+			},
+		},
+		devices:  devices,
+		maxSleep: config.MaxRetryTime,
+	}, nil
 
 }
 
-func (db *db) gcmDeleteRegistrationId(regid string) error {
+type gcmOpData struct {
+	Delay    time.Duration
+	Data     *gcmPayload
+	Receipts []Receipt //one for each of Data.RegIds
+	Response *http.Response
+}
 
-	log.Println("Deleting a RegId")
+func (gcm *gcm) Exists(deviceTargetId string) (bool, error) {
 
-	_, e := db.gcmRegDel.Exec(regid)
+	return gcm.devices.Exists(deviceTargetId)
 
-	return e
 }
 
-func (db *db) gcmExistsRegistrationId(regid string) (b bool, e error) {
-	e = db.gcmRegExists.QueryRow(regid).Scan(&b)
-	return
-}
+func (gcm *gcm) Owner(deviceTargetId string) (int64, bool, error) {
 
-func (db *db) gcmExistsUserId(id int64) (b bool, e error) {
-	e = db.gcmIdSubscribed.QueryRow(id).Scan(&b)
+	return gcm.devices.Owner(deviceTargetId)
 
-	return
 }
 
-func (db *db) gcmGetRegistrationIdsForId(id int64) ([]string, error) {
+func (gcm *gcm) Push(user int64, message Message) ([]Receipt, error) {
 
-	rows, e := db.gcmRegFetch.Query(id)
+	ids, e := userTokens(gcm.devices, user)
 
 	if e != nil {
 		return nil, e
 	}
 
-	ids := make([]string, 0, 10)
-
-	var regid string
-
-	for rows.Next() {
-		if e = rows.Scan(&regid); e != nil {
-			return nil, e
-		}
-
-		ids = append(ids, regid)
-	}
-
-	if e = rows.Err(); e != nil {
-		return nil, e
-	}
-
-	if len(ids) == 0 {
-		return nil, ErrNotRegistered
-	}
-
-	return ids, nil
+	return gcm.regidsPush(ids, message)
 
 }
 
-func (db *db) gcmInitTable() error {
-
-	_, e := db.conn.Exec("CREATE TABLE GCM (USERID BIGINT REFERENCES USERS ON DELETE CASCADE, REGID CHARACTER VARYING, PRIMARY KEY (USERID,REGID))")
-
-	if e != nil {
-		return e
-	}
-
-	log.Println("Creating triggers on GCM table...")
+// PushMany coalesces the devices of users in as few multicast requests as possible
+func (gcm *gcm) PushMany(users []int64, message Message) ([]Receipt, error) {
 
-	_, e = db.conn.Exec("CREATE FUNCTION CHECKTEN() RETURNS TRIGGER AS $$ BEGIN IF((SELECT COUNT(REGID) FROM GCM WHERE USERID = NEW.USERID) >= 10) THEN RAISE EXCEPTION 'Already 10 Registration IDs for this user'; END IF; RETURN NEW; END $$ LANGUAGE plpgsql")
+	devices, e := gcm.devices.ForUsers(users)
 
 	if e != nil {
-		return e
+		return nil, e
 	}
 
-	_, e = db.conn.Exec("CREATE TRIGGER CHECKTEN BEFORE INSERT ON GCM FOR EACH ROW EXECUTE PROCEDURE CHECKTEN()")
+	return gcm.devicesPush(devices, message)
 
-	return e
 }
 
-func (db *db) gcmUpdateRegId(oldId, newId string) error {
+// PushExcept is PushMany for the devices whose registration IDs are not in reached
+func (gcm *gcm) PushExcept(users []int64, message Message, reached map[string]bool) ([]Receipt, error) {
 
-	result, e := db.gcmUpdateReg.Exec(oldId, newId)
+	devices, e := devicesExcept(gcm.devices, users, reached)
 
 	if e != nil {
-		return e
-	}
-
-	rowsAffected, e := result.RowsAffected()
-
-	if e != nil {
-		return e
-	}
-
-	if rowsAffected > 1 {
-		log.Panic("Database inconsistency found (regid found twice or more)")
+		return nil, e
 	}
 
-	return nil
+	return gcm.devicesPush(devices, message)
 
 }
 
-func newGcm(config *GcmConfig) *gcm {
+func (gcm *gcm) devicesPush(devices []Device, message Message) ([]Receipt, error) {
 
-	if config.MaxTcpConns == 0 {
-		config.MaxTcpConns = GcmDefaultMaxHttpConns
-	}
+	var (
+		err      error
+		ids      = deviceTokens(devices)
+		receipts = make([]Receipt, 0, len(ids))
+	)
 
-	if config.MaxRetryTime == 0 {
-		config.MaxRetryTime = GcmDefaultMaxSleepBeforeFail
-	}
+	for start := 0; start < len(ids); start += gcmMaxRegIds {
 
-	return &gcm{
-		apiKey: "key=" + config.ApiKey,
-		client: &http.Client{
-			Transport: &http.Transport{
-				MaxIdleConnsPerHost: config.MaxTcpConns,
-			},
-		},
-		maxSleep: config.MaxRetryTime,
-	}
-
-}
+		end := start + gcmMaxRegIds
 
-type gcmOpData struct {
-	Delay    time.Duration
-	Data     *gcmPayload
-	Response *http.Response
-}
-
-func (gcm *gcm) Exists(deviceTargetId string) (bool, error) {
-
-	return globalDb.gcmExistsRegistrationId(deviceTargetId)
+		if end > len(ids) {
+			end = len(ids)
+		}
 
-}
+		batch, e := gcm.regidsPush(ids[start:end], message)
 
-func (gcm *gcm) Push(user int64, message Message) error {
+		for i := range batch {
+			batch[i].User = devices[start+i].User
+		}
 
-	ids, e := globalDb.gcmGetRegistrationIdsForId(user)
+		receipts = append(receipts, batch...)
 
-	if e != nil {
-		return e
+		if e != nil && err == nil {
+			err = e
+		}
 	}
 
-	return gcm.regidsPush(ids, message)
+	return receipts, err
 
 }
 
 func (gcm *gcm) Register(user int64, deviceTargetId string) error {
 
-	return globalDb.gcmAddRegistrationId(user, deviceTargetId)
+	return gcm.devices.Add(user, deviceTargetId, "")
 
 }
 
 func (gcm *gcm) Subscribed(user int64) (bool, error) {
-	return globalDb.gcmExistsUserId(user)
+	return gcm.devices.Subscribed(user)
 }
 
 func (gcm *gcm) Unregister(deviceTargetId string) error {
 
-	return globalDb.gcmDeleteRegistrationId(deviceTargetId)
+	return gcm.devices.Delete(deviceTargetId)
 
 }
 
@@ -309,7 +252,7 @@ func (gcm *gcm) expRetry(opData *gcmOpData) error {
 
 	time.Sleep(sleep)
 
-	return gcm.payloadPush(opData.Data, 2*opData.Delay)
+	return gcm.payloadPush(opData.Data, opData.Receipts, 2*opData.Delay)
 
 }
 
@@ -362,17 +305,7 @@ func (gcm *gcm) evalResponse(opData *gcmOpData) error {
 
 }
 
-func (gcm *gcm) payloadPush(payload *gcmPayload, retryTime time.Duration) error {
-
-	jsonData, e := json.Marshal(payload.Data)
-
-	if e != nil {
-		return e
-	}
-
-	if len(jsonData) > 4096 {
-		return GcmMessageTooLargeError
-	}
+func (gcm *gcm) payloadPush(payload *gcmPayload, receipts []Receipt, retryTime time.Duration) error {
 
 	jsonPayload, e := json.Marshal(payload)
 
@@ -400,24 +333,93 @@ func (gcm *gcm) payloadPush(payload *gcmPayload, retryTime time.Duration) error
 		Delay:    retryTime,
 		Response: res,
 		Data:     payload,
+		Receipts: receipts,
 	}
 
 	return gcm.evalResponse(opData)
 
 }
 
-func (gcm *gcm) regidsPush(regids []string, data Message) error {
+// gcmMessage translates message into a payload without recipients, and checks its size against the limit of GCM
+func gcmMessage(message *Message) (*gcmPayload, error) {
+
+	options := &message.Options
+
+	payload := &gcmPayload{
+		Data:                  message.Data,
+		TimeToLive:            options.TimeToLive,
+		CollapseKey:           options.CollapseKey,
+		Priority:              options.Priority,
+		DelayWhileIdle:        options.DelayWhileIdle,
+		RestrictedPackageName: options.RestrictedPackageName,
+		DryRun:                options.DryRun,
+	}
+
+	if n := message.Notification; n != nil {
+
+		payload.Notification = &gcmNotification{
+			Title:       n.Title,
+			Body:        n.Body,
+			Icon:        n.Icon,
+			Sound:       n.Sound,
+			ClickAction: n.ClickAction,
+			TitleLocKey: n.TitleLocKey,
+			BodyLocKey:  n.BodyLocKey,
+		}
+
+		if n.Badge != nil {
+			payload.Notification.Badge = strconv.Itoa(*n.Badge)
+		}
+
+		if n.TitleLocArgs != nil {
+			args, _ := json.Marshal(n.TitleLocArgs)
+			payload.Notification.TitleLocArgs = string(args)
+		}
+
+		if n.BodyLocArgs != nil {
+			args, _ := json.Marshal(n.BodyLocArgs)
+			payload.Notification.BodyLocArgs = string(args)
+		}
+	}
+
+	jsonPayload, e := json.Marshal(payload)
+
+	if e != nil {
+		return nil, e
+	}
+
+	if len(jsonPayload) > gcmMaxPayloadSize {
+		return nil, GcmMessageTooLargeError
+	}
+
+	return payload, nil
+}
+
+func (gcm *gcm) regidsPush(regids []string, message Message) ([]Receipt, error) {
 
 	if regids == nil {
-		return errors.New("Empty regids array")
+		return nil, errors.New("Empty regids array")
 	}
 
-	gcmP := &gcmPayload{
-		RegIds: regids,
-		Data:   data,
+	receipts := newReceipts(regids)
+
+	gcmP, e := gcmMessage(&message)
+
+	if e != nil {
+		return settleAll(receipts, e)
 	}
 
-	return gcm.payloadPush(gcmP, time.Second)
+	gcmP.RegIds = regids
+
+	receipts, e = settleAll(receipts, gcm.payloadPush(gcmP, receipts, time.Second))
+
+	if message.Options.DryRun {
+		for i := range receipts {
+			receipts[i].validated()
+		}
+	}
+
+	return receipts, e
 
 }
 
@@ -445,43 +447,96 @@ func (gcm *gcm) responseBodyParse(opData *gcmOpData) error {
 		log.Panicf("Received invalid JSON from Google. Report this. Error: %s", e.Error())
 	}
 
-	if response.Failure|response.CanonicalIds == 0 {
-		return nil //all good, no weird suprises
-	}
+	if len(response.Results) != len(opData.Data.RegIds) {
 
-	//Getting in trouble here...
+		if response.Failure|response.CanonicalIds == 0 {
+			return nil //all good, no weird suprises, we just miss the message IDs
+		}
 
-	if len(response.Results) != len(opData.Data.RegIds) {
+		//Getting in trouble here...
 		log.Panicf("Malformed response from Google, sent %d registration_ids, recv %d results", len(opData.Data.RegIds), len(response.Results))
 	}
 
+	var (
+		retry  []int
+		giveUp error
+	)
+
 	for i, regid := range opData.Data.RegIds {
-		if e := gcm.responseEvalLine(regid, &response.Results[i], opData); e != nil {
+
+		switch response.Results[i].Error {
+		case "InternalServerError", "Unavailable": //only these registration IDs are sent again, the others already got their answer
+			retry = append(retry, i)
+
+			if giveUp == nil {
+				giveUp = gcmRetryErrors[response.Results[i].Error]
+			}
+
+			continue
+		}
+
+		if e := gcm.responseEvalLine(regid, &response.Results[i], &opData.Receipts[i]); e != nil {
 			return e
 		}
 	}
 
-	return nil
+	if retry == nil {
+		return nil
+	}
+
+	return gcm.retryFailed(opData, retry, giveUp)
 
 }
 
-func (gcm *gcm) responseEvalLine(regid string, result *gcmResult, opData *gcmOpData) error {
+// retryFailed sends the payload again only to the registration IDs at indexes, copying back the outcome into their receipts
+func (gcm *gcm) retryFailed(opData *gcmOpData, indexes []int, giveUp error) error {
+
+	payload := *opData.Data
+	payload.RegIds = make([]string, len(indexes))
+
+	retry := &gcmOpData{Delay: opData.Delay, Data: &payload, Receipts: make([]Receipt, len(indexes))}
+
+	for j, i := range indexes {
+		payload.RegIds[j] = opData.Data.RegIds[i]
+		retry.Receipts[j] = opData.Receipts[i]
+	}
+
+	e := gcm.expRetry(retry)
+
+	for j, i := range indexes {
+		opData.Receipts[i] = retry.Receipts[j]
+	}
+
+	if e == GcmWontTryAgain {
+		return giveUp
+	}
+
+	return e
+
+}
+
+func (gcm *gcm) responseEvalLine(regid string, result *gcmResult, receipt *Receipt) error {
 
 	if result.MessageId != "" { //all went well, check if a canonical id is given... (http://developer.android.com/google/gcm/adv.html#canonical)
+
+		receipt.delivered(result.MessageId)
+
 		if result.CanonId != "" {
 
+			receipt.canonicalized(result.CanonId)
+
 			//user has reregistered the application before leaving us able to remove the old id. So, just drop this one
-			exists, e := globalDb.gcmExistsRegistrationId(result.CanonId)
+			exists, e := gcm.devices.Exists(result.CanonId)
 
 			if e != nil {
 				return e
 			}
 
 			if exists {
-				return globalDb.gcmDeleteRegistrationId(regid)
+				return gcm.devices.Delete(regid)
 			}
 
-			return globalDb.gcmUpdateRegId(regid, result.CanonId) //update, than we're good
+			return gcm.devices.UpdateToken(regid, result.CanonId) //update, than we're good
 		}
 		return nil //all good, nothing to do
 	}
@@ -495,42 +550,29 @@ func (gcm *gcm) responseEvalLine(regid string, result *gcmResult, opData *gcmOpD
 
 	switch result.Error {
 	case "NotRegistered": //User has removed the application
-		globalDb.gcmDeleteRegistrationId(regid)
+		receipt.removed(result.Error)
+		gcm.devices.Delete(regid)
 		break
 	case "MissingRegistration": //This cannot happen, we always check for regids before sending!
 		log.Panic("connector broken, MissingRegistration found")
 	case "InvalidRegistration", "MismatchSenderId": //Malformed regid. Probably broken registration or somebody messed with the client. Lets delete it and log it
-		globalDb.gcmDeleteRegistrationId(regid)
+		receipt.removed(result.Error)
+		gcm.devices.Delete(regid)
 		log.Printf("GCM RegID %s has been rejected from server with %s and has been deleted.", regid, result.Error)
 		break
-	case "MessageTooBig":
-		log.Panic("connector broken, a message with data bigger than 4KiB has been allowed")
+	case "MessageTooBig": //GCM counts bytes its own way, so it may disagree with gcmMessage
+		receipt.failed(result.Error)
 	case "InvalidDataKey":
 		log.Printf("A message has been refused from GCM because of an InvalidDataKey in payload")
+		receipt.failed(result.Error)
 		break
-	case "InvalidTtl":
-		log.Panic("This connector has no support to ttl, so this will never happen")
-	case "InvalidPackageName":
-		log.Println("InvalidPackageName (??)")
+	case "InvalidTtl", "InvalidPackageName": //options are validated before queueing, but GCM has the last word
+		log.Printf("A message has been refused from GCM because of %s in its options", result.Error)
+		receipt.failed(result.Error)
 		break
-	case "InternalServerError":
-
-		if e := gcm.expRetry(opData); e != GcmWontTryAgain {
-			return e
-		}
-
-		return GcmInternalServerError
-
-	case "Unavailable":
-
-		if e := gcm.expRetry(opData); e != GcmWontTryAgain {
-			return e
-		}
-
-		return GcmTimeoutError
-
 	default:
 		log.Printf("GCM unknown error in response body: %s", result.Error)
+		receipt.failed(result.Error)
 		break
 	}
 
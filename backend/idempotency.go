@@ -0,0 +1,98 @@
+/*  Pushed - a daemon for parallel handling of push operations to mobile devices
+ *  Copyright (C) 2014  Marco Cilloni <marco.cilloni@yahoo.com>
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *  Exhibit B is not attached; this software is compatible with the
+ *  licenses expressed under Section 1.12 of the MPL v2.
+ */
+
+package backend
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"regexp"
+	"time"
+)
+
+const (
+	OutboxDefaultIdempotencyWindow = 24 * time.Hour
+)
+
+var (
+	ErrInvalidIdempotencyKey = errors.New("Idempotency keys must be at most 255 printable ASCII characters, without spaces")
+	idempotencyKeyRegexp     = regexp.MustCompile(`^[\x21-\x7e]{1,255}$`)
+)
+
+func ValidIdempotencyKey(key string) bool {
+	return idempotencyKeyRegexp.MatchString(key)
+}
+
+// EnqueueKeyed is like EnqueueAt, but a message already queued by client with the same key during the idempotency
+// window is not queued again: its ID is returned instead, with duplicate set. An empty key disables the check.
+// Keys belong to the client that sent them, the empty one for unauthenticated clients.
+func EnqueueKeyed(client, key string, users []int64, message Message, at time.Time) (id int64, duplicate bool, e error) {
+
+	if key != "" && !ValidIdempotencyKey(key) {
+		return 0, false, ErrInvalidIdempotencyKey
+	}
+
+	users = uniqueUsers(users)
+
+	switch {
+	case len(users) == 0:
+		return 0, false, ErrNoRecipients
+	case len(users) > MaxRecipients:
+		return 0, false, ErrTooManyRecipients
+	}
+
+	data, e := json.Marshal(message)
+
+	if e != nil {
+		return
+	}
+
+	return enqueueKeyed(client, key, users, sql.NullString{}, sql.NullString{}, data, at)
+}
+
+func idempotencyWindow() time.Duration {
+
+	if globalOutbox == nil {
+		return OutboxDefaultIdempotencyWindow
+	}
+
+	return globalOutbox.config.IdempotencyWindow
+}
+
+// claimKey binds key of client to message id, unless a message already has it. Concurrent requests with the
+// same key wait on each other's transaction, so only one of them can get it.
+func claimKey(tx *sql.Tx, client, key string, id int64) (claimed bool, e error) {
+
+	window := idempotencyWindow().Seconds()
+
+	if _, e = tx.Exec("DELETE FROM IDEMPOTENCYKEYS WHERE CREATED < now() - $1::float8 * interval '1 second'", window); e != nil {
+		return
+	}
+
+	res, e := tx.Exec("INSERT INTO IDEMPOTENCYKEYS (CLIENT, KEY, MESSAGE) VALUES ($1,$2,$3) ON CONFLICT (CLIENT, KEY) DO NOTHING",
+		client, key, id)
+
+	if e != nil {
+		return
+	}
+
+	n, e := res.RowsAffected()
+
+	return n > 0, e
+}
+
+// keyedMessage returns the ID of the message queued by client with key
+func keyedMessage(client, key string) (id int64, e error) {
+
+	e = globalDb.conn.QueryRow("SELECT MESSAGE FROM IDEMPOTENCYKEYS WHERE CLIENT = $1 AND KEY = $2", client, key).Scan(&id)
+
+	return
+}
@@ -0,0 +1,128 @@
+/*  Pushed - a daemon for parallel handling of push operations to mobile devices
+ *  Copyright (C) 2014  Marco Cilloni <marco.cilloni@yahoo.com>
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *  Exhibit B is not attached; this software is compatible with the
+ *  licenses expressed under Section 1.12 of the MPL v2.
+ */
+
+package backend
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+)
+
+var (
+	ErrInvalidPrivateKey = errors.New("Cannot decode private key (expected a PEM encoded PKCS#1, PKCS#8 or SEC 1 key)")
+)
+
+type jwtHeader struct {
+	Alg   string `json:"alg"`
+	Typ   string `json:"typ,omitempty"`
+	KeyId string `json:"kid,omitempty"`
+}
+
+func jwtEncodeSegment(v interface{}) (string, error) {
+
+	data, e := json.Marshal(v)
+
+	if e != nil {
+		return "", e
+	}
+
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func jwtSigningInput(header *jwtHeader, claims interface{}) (string, error) {
+
+	head, e := jwtEncodeSegment(header)
+
+	if e != nil {
+		return "", e
+	}
+
+	body, e := jwtEncodeSegment(claims)
+
+	if e != nil {
+		return "", e
+	}
+
+	return head + "." + body, nil
+}
+
+func jwtSignRS256(key *rsa.PrivateKey, keyId string, claims interface{}) (string, error) {
+
+	input, e := jwtSigningInput(&jwtHeader{Alg: "RS256", Typ: "JWT", KeyId: keyId}, claims)
+
+	if e != nil {
+		return "", e
+	}
+
+	hash := sha256.Sum256([]byte(input))
+
+	sig, e := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+
+	if e != nil {
+		return "", e
+	}
+
+	return input + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// jwtSignES256 produces the raw R || S signature JWS mandates, not the ASN.1 one crypto/ecdsa defaults to
+func jwtSignES256(key *ecdsa.PrivateKey, keyId string, claims interface{}) (string, error) {
+
+	input, e := jwtSigningInput(&jwtHeader{Alg: "ES256", Typ: "JWT", KeyId: keyId}, claims)
+
+	if e != nil {
+		return "", e
+	}
+
+	hash := sha256.Sum256([]byte(input))
+
+	r, s, e := ecdsa.Sign(rand.Reader, key, hash[:])
+
+	if e != nil {
+		return "", e
+	}
+
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+
+	return input + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+func parsePrivateKey(pemData []byte) (interface{}, error) {
+
+	block, _ := pem.Decode(pemData)
+
+	if block == nil {
+		return nil, ErrInvalidPrivateKey
+	}
+
+	if key, e := x509.ParsePKCS8PrivateKey(block.Bytes); e == nil {
+		return key, nil
+	}
+
+	if key, e := x509.ParsePKCS1PrivateKey(block.Bytes); e == nil {
+		return key, nil
+	}
+
+	if key, e := x509.ParseECPrivateKey(block.Bytes); e == nil {
+		return key, nil
+	}
+
+	return nil, ErrInvalidPrivateKey
+}
@@ -0,0 +1,515 @@
+/*  Pushed - a daemon for parallel handling of push operations to mobile devices
+ *  Copyright (C) 2014  Marco Cilloni <marco.cilloni@yahoo.com>
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *  Exhibit B is not attached; this software is compatible with the
+ *  licenses expressed under Section 1.12 of the MPL v2.
+ */
+
+package backend
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	MemoryDefaultSnapshotInterval = time.Minute
+)
+
+// memoryStore keeps users and devices in memory, for tests and deployments that can lose them. If it has a
+// snapshot file, it starts from its contents and writes them back periodically and on Close.
+type memoryStore struct {
+	lock     sync.RWMutex
+	users    map[int64]bool
+	tables   map[string]*memoryDevices
+	snapshot string
+	dirty    bool
+	quit     chan bool
+	done     chan bool
+}
+
+type memoryDevices struct {
+	name   string
+	store  *memoryStore
+	policy DevicePolicy
+	users  map[int64][]Device //in registration order
+	tokens map[string]int64   //owner of each token
+}
+
+// memorySnapshot is the JSON format of the snapshot file. Version is the schema version of the pushed that
+// saved it: older snapshots can be loaded, as fields they lack are left empty, but not newer ones. Devices
+// without a registration time are taken as registered when loaded, like the migrations do.
+type memorySnapshot struct {
+	Version int                 `json:"version"`
+	Users   []int64             `json:"users"`
+	Devices map[string][]Device `json:"devices"` //by table
+}
+
+// OpenMemoryStore makes the store a memoryStore, loading snapshot if it exists and then saving to it every
+// interval, or MemoryDefaultSnapshotInterval if it is 0. An empty snapshot keeps everything in memory only.
+func OpenMemoryStore(snapshot string, interval time.Duration) error {
+
+	store, e := newMemoryStore(snapshot, interval)
+
+	if e != nil {
+		return e
+	}
+
+	globalDb, globalStore = nil, store
+
+	return nil
+}
+
+func newMemoryStore(snapshot string, interval time.Duration) (*memoryStore, error) {
+
+	store := &memoryStore{
+		users:    make(map[int64]bool),
+		tables:   make(map[string]*memoryDevices),
+		snapshot: snapshot,
+	}
+
+	if snapshot == "" {
+		return store, nil
+	}
+
+	if e := store.load(); e != nil {
+		return nil, e
+	}
+
+	if interval <= 0 {
+		interval = MemoryDefaultSnapshotInterval
+	}
+
+	store.quit, store.done = make(chan bool), make(chan bool)
+
+	go store.saveEvery(interval)
+
+	return store, nil
+}
+
+func (store *memoryStore) table(name string) *memoryDevices {
+
+	t, ok := store.tables[name]
+
+	if !ok {
+		t = &memoryDevices{name: name, store: store, users: make(map[int64][]Device), tokens: make(map[string]int64)}
+		store.tables[name] = t
+	}
+
+	return t
+}
+
+func (store *memoryStore) load() error {
+
+	contents, e := ioutil.ReadFile(store.snapshot)
+
+	if os.IsNotExist(e) {
+		log.Printf("No snapshot in %s yet, starting empty", store.snapshot)
+		return nil
+	}
+
+	if e != nil {
+		return e
+	}
+
+	var snap memorySnapshot
+
+	if e = json.Unmarshal(contents, &snap); e != nil {
+		return errors.New("Invalid snapshot " + store.snapshot + ": " + e.Error())
+	}
+
+	if snap.Version > Version {
+		return fmt.Errorf("Snapshot %s has schema version %d, newer than the %d this pushed knows", store.snapshot, snap.Version, Version)
+	}
+
+	for _, user := range snap.Users {
+		store.users[user] = true
+	}
+
+	for name, devices := range snap.Devices {
+
+		t := store.table(name)
+
+		for _, dev := range devices {
+
+			if dev.Registered.IsZero() {
+				dev.Registered = time.Now()
+			}
+
+			t.users[dev.User] = append(t.users[dev.User], dev)
+			t.tokens[dev.Token] = dev.User
+		}
+	}
+
+	log.Printf("Loaded %d users from snapshot %s", len(snap.Users), store.snapshot)
+
+	return nil
+}
+
+// save writes the snapshot if anything changed since the last one. The file is replaced at once, so a crash
+// while writing leaves the previous one.
+func (store *memoryStore) save() error {
+
+	store.lock.Lock()
+
+	if !store.dirty {
+		store.lock.Unlock()
+		return nil
+	}
+
+	snap := memorySnapshot{Version: Version, Users: make([]int64, 0, len(store.users)), Devices: make(map[string][]Device)}
+
+	for user := range store.users {
+		snap.Users = append(snap.Users, user)
+	}
+
+	sort.Slice(snap.Users, func(i, j int) bool {
+		return snap.Users[i] < snap.Users[j]
+	})
+
+	for name, t := range store.tables {
+
+		devices := make([]Device, 0, len(t.tokens))
+
+		for _, user := range snap.Users {
+			devices = append(devices, t.users[user]...)
+		}
+
+		snap.Devices[name] = devices
+	}
+
+	store.dirty = false
+	store.lock.Unlock()
+
+	contents, e := json.Marshal(&snap)
+
+	if e == nil {
+		e = writeFileAtomic(store.snapshot, contents)
+	}
+
+	if e != nil {
+		store.lock.Lock()
+		store.dirty = true //try again next time
+		store.lock.Unlock()
+	}
+
+	return e
+}
+
+func writeFileAtomic(path string, contents []byte) error {
+
+	tmp, e := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*")
+
+	if e != nil {
+		return e
+	}
+
+	defer os.Remove(tmp.Name())
+
+	if _, e = tmp.Write(contents); e == nil {
+		e = tmp.Sync()
+	}
+
+	if closeErr := tmp.Close(); e == nil {
+		e = closeErr
+	}
+
+	if e != nil {
+		return e
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+func (store *memoryStore) saveEvery(interval time.Duration) {
+
+	defer close(store.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if e := store.save(); e != nil {
+				log.Printf("Cannot save snapshot %s: %s", store.snapshot, e.Error())
+			}
+		case <-store.quit:
+			return
+		}
+	}
+}
+
+func (store *memoryStore) AddUser(id int64) error {
+	log.Printf("Adding user %d...", id)
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	if id < 0 {
+		return errors.New("User IDs cannot be negative")
+	}
+
+	if store.users[id] {
+		return ErrUserExists
+	}
+
+	store.users[id] = true
+	store.dirty = true
+
+	return nil
+}
+
+func (store *memoryStore) DelUser(id int64) error {
+	log.Printf("Deleting user %d...", id)
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	delete(store.users, id)
+
+	for _, t := range store.tables { //like ON DELETE CASCADE
+		for _, dev := range t.users[id] {
+			delete(t.tokens, dev.Token)
+		}
+
+		delete(t.users, id)
+	}
+
+	store.dirty = true
+
+	return nil
+}
+
+func (store *memoryStore) UserExists(id int64) (bool, error) {
+
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	return store.users[id], nil
+}
+
+func (store *memoryStore) Devices(instance string, policy DevicePolicy) (DeviceStore, error) {
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	t := store.table(deviceTableName(instance))
+	t.policy = policy
+
+	return t, nil
+}
+
+// Close stops the snapshots, then takes the last one
+func (store *memoryStore) Close() error {
+
+	if store.snapshot == "" {
+		return nil
+	}
+
+	close(store.quit)
+	<-store.done
+
+	return store.save()
+}
+
+func (t *memoryDevices) Add(id int64, token, data string) error {
+	log.Printf("Adding %s token for %d", t.name, id)
+
+	t.store.lock.Lock()
+	defer t.store.lock.Unlock()
+
+	if _, exists := t.tokens[token]; exists {
+		return ErrDeviceExists
+	}
+
+	if !t.store.users[id] {
+		return ErrUserNotExisting
+	}
+
+	victims, e := t.policy.makeRoom(t.users[id])
+
+	if e != nil {
+		return e
+	}
+
+	for _, victim := range victims {
+		t.remove(victim)
+	}
+
+	t.users[id] = append(t.users[id], Device{User: id, Token: token, Data: data, Registered: time.Now()})
+	t.tokens[token] = id
+	t.store.dirty = true
+
+	return nil
+}
+
+func (t *memoryDevices) Delete(token string) error {
+
+	log.Printf("Deleting a %s token", t.name)
+
+	t.store.lock.Lock()
+	defer t.store.lock.Unlock()
+
+	t.remove(token)
+
+	return nil
+}
+
+// remove deletes a device, with the lock held
+func (t *memoryDevices) remove(token string) {
+
+	id, exists := t.tokens[token]
+
+	if !exists {
+		return
+	}
+
+	devices := t.users[id]
+
+	for i := range devices {
+		if devices[i].Token == token {
+			devices = append(devices[:i:i], devices[i+1:]...)
+			break
+		}
+	}
+
+	if len(devices) == 0 {
+		delete(t.users, id)
+	} else {
+		t.users[id] = devices
+	}
+
+	delete(t.tokens, token)
+	t.store.dirty = true
+}
+
+func (t *memoryDevices) Exists(token string) (bool, error) {
+
+	t.store.lock.RLock()
+	defer t.store.lock.RUnlock()
+
+	_, exists := t.tokens[token]
+
+	return exists, nil
+}
+
+func (t *memoryDevices) Owner(token string) (int64, bool, error) {
+
+	t.store.lock.RLock()
+	defer t.store.lock.RUnlock()
+
+	user, found := t.tokens[token]
+
+	return user, found, nil
+}
+
+func (t *memoryDevices) Subscribed(id int64) (bool, error) {
+
+	t.store.lock.RLock()
+	defer t.store.lock.RUnlock()
+
+	return len(t.users[id]) > 0, nil
+}
+
+func (t *memoryDevices) ForUser(id int64) ([]Device, error) {
+	return t.ForUsers([]int64{id})
+}
+
+func (t *memoryDevices) ForUsers(ids []int64) ([]Device, error) {
+
+	t.store.lock.RLock()
+	defer t.store.lock.RUnlock()
+
+	var devices []Device
+
+	for _, id := range uniqueUsers(ids) {
+		devices = append(devices, t.users[id]...) //copied, so they can be used without the lock
+	}
+
+	if len(devices) == 0 {
+		return nil, ErrNotRegistered
+	}
+
+	return devices, nil
+}
+
+// update applies change to the device with the given token, if there is one
+func (t *memoryDevices) update(token string, change func(dev *Device) error) error {
+
+	t.store.lock.Lock()
+	defer t.store.lock.Unlock()
+
+	id, exists := t.tokens[token]
+
+	if !exists {
+		return nil
+	}
+
+	for i := range t.users[id] {
+		if dev := &t.users[id][i]; dev.Token == token {
+
+			if e := change(dev); e != nil {
+				return e
+			}
+
+			t.store.dirty = true
+
+			break
+		}
+	}
+
+	return nil
+}
+
+func (t *memoryDevices) SetData(token, data string) error {
+
+	return t.update(token, func(dev *Device) error {
+		dev.Data = data
+		return nil
+	})
+}
+
+func (t *memoryDevices) UpdateToken(oldToken, newToken string) error {
+
+	return t.update(oldToken, func(dev *Device) error {
+
+		if _, exists := t.tokens[newToken]; exists {
+			return ErrDeviceExists
+		}
+
+		delete(t.tokens, oldToken)
+		t.tokens[newToken] = dev.User
+		dev.Token = newToken
+
+		return nil
+	})
+}
+
+func (t *memoryDevices) Succeeded(tokens []string, at time.Time) error {
+
+	for _, token := range tokens {
+
+		e := t.update(token, func(dev *Device) error {
+			dev.LastSuccess = at
+			return nil
+		})
+
+		if e != nil {
+			return e
+		}
+	}
+
+	return nil
+}
@@ -10,8 +10,159 @@
 
 package backend
 
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+)
+
 const (
-	Version = 0
+	MaxTimeToLive  = 4 * 7 * 24 * 60 * 60 //four weeks, the longest GCM and FCM keep a message
+	maxCollapseKey = 64                   //bytes of an apns-collapse-id
+	PriorityHigh   = "high"
+	PriorityNormal = "normal"
 )
 
-type Message map[string]string
+var (
+	ErrInvalidCollapseKey = errors.New("collapse_key must be at most 64 bytes long")
+	ErrInvalidPriority    = errors.New("priority must be either normal or high")
+	ErrInvalidTtl         = errors.New("time_to_live must be between 0 and 2419200 seconds")
+)
+
+// Message is what gets pushed to the devices of a user. Data is arbitrary JSON for the app, while Notification
+// is meant to be shown to the user. Each connector translates Notification and Options to its native fields,
+// ignoring those it has no equivalent for.
+type Message struct {
+	Data         map[string]interface{} `json:"data"`
+	Notification *Notification          `json:"notification,omitempty"`
+	Options      PushOptions            `json:"options"`
+}
+
+// Notification is a cross-platform notification. Localization keys refer to strings shipped with the app,
+// which are formatted with the matching arguments.
+type Notification struct {
+	Title        string   `json:"title,omitempty"`
+	Body         string   `json:"body,omitempty"`
+	Icon         string   `json:"icon,omitempty"`
+	Sound        string   `json:"sound,omitempty"`
+	Badge        *int     `json:"badge,omitempty"`
+	ClickAction  string   `json:"click_action,omitempty"`
+	TitleLocKey  string   `json:"title_loc_key,omitempty"`
+	TitleLocArgs []string `json:"title_loc_args,omitempty"`
+	BodyLocKey   string   `json:"body_loc_key,omitempty"`
+	BodyLocArgs  []string `json:"body_loc_args,omitempty"`
+}
+
+type PushOptions struct {
+	TimeToLive            *int   `json:"time_to_live,omitempty"` //seconds, nil for the default of each service
+	CollapseKey           string `json:"collapse_key,omitempty"`
+	Priority              string `json:"priority,omitempty"`
+	DelayWhileIdle        bool   `json:"delay_while_idle,omitempty"`
+	RestrictedPackageName string `json:"restricted_package_name,omitempty"`
+	DryRun                bool   `json:"dry_run,omitempty"` //check the message without delivering it
+}
+
+// UnmarshalJSON also accepts a bare object of data, which is what PUSH took before messages had sections.
+// Objects made only of data, notification and options objects are taken as sections.
+func (message *Message) UnmarshalJSON(b []byte) error {
+
+	var fields map[string]json.RawMessage
+
+	if e := json.Unmarshal(b, &fields); e != nil {
+		return e
+	}
+
+	if !isEnvelope(fields) {
+		*message = Message{}
+		return decodeJson(b, &message.Data, false)
+	}
+
+	type envelope Message
+
+	*message = Message{}
+
+	return decodeJson(b, (*envelope)(message), true) //a typo in an option must not go unnoticed
+}
+
+func isEnvelope(fields map[string]json.RawMessage) bool {
+
+	if len(fields) == 0 {
+		return false
+	}
+
+	for key, value := range fields {
+
+		switch key {
+		case "data", "notification", "options":
+		default:
+			return false
+		}
+
+		if value = bytes.TrimSpace(value); !bytes.HasPrefix(value, []byte("{")) && !bytes.Equal(value, []byte("null")) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// decodeJson keeps numbers as they are written, so that large IDs in data are not rounded to a float64
+func decodeJson(b []byte, v interface{}, strict bool) error {
+
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+
+	if strict {
+		dec.DisallowUnknownFields()
+	}
+
+	return dec.Decode(v)
+}
+
+// stringData renders data for services that only take string values, encoding anything else as JSON
+func stringData(data map[string]interface{}) (map[string]string, error) {
+
+	if data == nil {
+		return nil, nil
+	}
+
+	strData := make(map[string]string, len(data))
+
+	for key, value := range data {
+
+		if str, ok := value.(string); ok {
+			strData[key] = str
+			continue
+		}
+
+		encoded, e := json.Marshal(value)
+
+		if e != nil {
+			return nil, e
+		}
+
+		strData[key] = string(encoded)
+	}
+
+	return strData, nil
+}
+
+// Validate checks options before they are queued, because services reject invalid ones only at delivery time
+func (options *PushOptions) Validate() error {
+
+	if options.TimeToLive != nil && (*options.TimeToLive < 0 || *options.TimeToLive > MaxTimeToLive) {
+		return ErrInvalidTtl
+	}
+
+	if len(options.CollapseKey) > maxCollapseKey {
+		return ErrInvalidCollapseKey
+	}
+
+	switch options.Priority {
+	case "", PriorityHigh, PriorityNormal:
+	default:
+		return ErrInvalidPriority
+	}
+
+	return nil
+}
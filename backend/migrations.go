@@ -0,0 +1,538 @@
+/*  Pushed - a daemon for parallel handling of push operations to mobile devices
+ *  Copyright (C) 2014  Marco Cilloni <marco.cilloni@yahoo.com>
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *  Exhibit B is not attached; this software is compatible with the
+ *  licenses expressed under Section 1.12 of the MPL v2.
+ */
+
+package backend
+
+import (
+	"bytes"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+const (
+	Version = 6 //schema version this pushed needs, every store has migrations up to it
+
+	schemaShared = "" //name of the SCHEMA_VERSION row of the tables shared by every connector
+
+	createSchemaVersion = "CREATE TABLE SCHEMA_VERSION (NAME VARCHAR(255) PRIMARY KEY, VERSION INTEGER NOT NULL)"
+	legacyPrefix        = "legacy." //scripts upgrading the tables of -initdb, see loadLegacy
+)
+
+var (
+	ErrUnknownVersion = errors.New("No schema version like that, must be between 0 and " + strconv.Itoa(Version))
+	migrationRegexp   = regexp.MustCompile(`^(\d{4})_[a-z0-9_]+\.(devices\.)?(up|down)\.sql$`)
+
+	//go:embed migrations
+	migrationFiles embed.FS
+)
+
+// migration changes the schema from version-1 to version when up, and back when down. The devices scripts are
+// templates run on each device table, named by {{.Table}}. Either pair of scripts may be missing, if the migration
+// leaves those tables alone, or both if it only concerns other stores.
+type migration struct {
+	version                          int
+	up, down, devicesUp, devicesDown *template.Template
+}
+
+// dialect holds what migrations do differently on each store
+type dialect struct {
+	dir, tableExists, version, setVersion string
+}
+
+var dialects = map[string]*dialect{
+	StoragePostgres: {
+		dir:         "postgres",
+		tableExists: "SELECT to_regclass($1) IS NOT NULL",
+		version:     "SELECT VERSION FROM SCHEMA_VERSION WHERE NAME = $1",
+		setVersion:  "INSERT INTO SCHEMA_VERSION VALUES ($1,$2) ON CONFLICT (NAME) DO UPDATE SET VERSION = EXCLUDED.VERSION",
+	},
+	StorageSqlite: {
+		dir:         "sqlite",
+		tableExists: "SELECT EXISTS (SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = ? COLLATE NOCASE)",
+		version:     "SELECT VERSION FROM SCHEMA_VERSION WHERE NAME = ?",
+		setVersion:  "INSERT INTO SCHEMA_VERSION VALUES (?,?) ON CONFLICT (NAME) DO UPDATE SET VERSION = EXCLUDED.VERSION",
+	},
+}
+
+type migrator struct {
+	conn    *sql.DB
+	dialect *dialect
+}
+
+// Migrate brings the shared tables of a store of the given kind (see OpenStore) and the device tables of the
+// given connector instances to the target schema version, or to Version if target is negative. Device tables
+// that were migrated before follow, even if their instances are gone from the configuration.
+func Migrate(kind, source string, instances []string, target int) error {
+
+	if target < 0 {
+		target = Version
+	}
+
+	if target > Version {
+		return ErrUnknownVersion
+	}
+
+	var (
+		conn *sql.DB
+		e    error
+	)
+
+	switch kind {
+	case "", StoragePostgres:
+		kind = StoragePostgres
+		conn, e = dialPostgres(source)
+	case StorageSqlite:
+		conn, e = dialSqlite(source)
+	case StorageMemory:
+		log.Println("The memory store has no schema to migrate")
+		return nil
+	default:
+		return ErrUnknownStorage
+	}
+
+	if e != nil {
+		return e
+	}
+
+	defer conn.Close()
+
+	tables := make([]string, len(instances))
+
+	for i, instance := range instances {
+		tables[i] = deviceTableName(instance)
+	}
+
+	m := &migrator{conn: conn, dialect: dialects[kind]}
+
+	return m.migrate(tables, target)
+}
+
+// loadMigrations parses the migrations of a store from 1 to Version, checking that each goes both ways
+func loadMigrations(dir string) ([]*migration, error) {
+
+	migrations := make([]*migration, Version)
+
+	for i := range migrations {
+		migrations[i] = &migration{version: i + 1}
+	}
+
+	files, e := fs.ReadDir(migrationFiles, path.Join("migrations", dir))
+
+	if e != nil {
+		return nil, e
+	}
+
+	for _, file := range files {
+
+		if strings.HasPrefix(file.Name(), legacyPrefix) {
+			continue
+		}
+
+		parts := migrationRegexp.FindStringSubmatch(file.Name())
+
+		if parts == nil {
+			return nil, errors.New("Misnamed migration " + file.Name())
+		}
+
+		version, _ := strconv.Atoi(parts[1])
+
+		if version < 1 || version > Version {
+			return nil, errors.New("Migration " + file.Name() + " is beyond version " + strconv.Itoa(Version))
+		}
+
+		tpl, e := loadScript(dir, file.Name())
+
+		if e != nil {
+			return nil, e
+		}
+
+		mig := migrations[version-1]
+
+		switch parts[2] + parts[3] {
+		case "up":
+			mig.up = tpl
+		case "down":
+			mig.down = tpl
+		case "devices.up":
+			mig.devicesUp = tpl
+		default:
+			mig.devicesDown = tpl
+		}
+	}
+
+	for i, mig := range migrations {
+		if (mig.up == nil) != (mig.down == nil) || (mig.devicesUp == nil) != (mig.devicesDown == nil) {
+			return nil, errors.New("Migration " + strconv.Itoa(i+1) + " of " + dir + " lacks some of its scripts")
+		}
+	}
+
+	return migrations, nil
+}
+
+// loadLegacy parses the scripts that bring the tables created by -initdb, before migrations existed, to version 1.
+// The last -initdb created them as they are at version 1, but older ones left them in the layout of their time.
+// Either script may be missing, if the store has no such tables.
+func loadLegacy(dir string) (*migration, error) {
+
+	mig := &migration{version: 1}
+
+	for name, script := range map[string]**template.Template{legacyPrefix + "up.sql": &mig.up, legacyPrefix + "devices.up.sql": &mig.devicesUp} {
+
+		tpl, e := loadScript(dir, name)
+
+		if e != nil && !errors.Is(e, fs.ErrNotExist) {
+			return nil, e
+		}
+
+		*script = tpl
+	}
+
+	return mig, nil
+}
+
+func loadScript(dir, name string) (*template.Template, error) {
+
+	contents, e := migrationFiles.ReadFile(path.Join("migrations", dir, name))
+
+	if e != nil {
+		return nil, e
+	}
+
+	return template.New(name).Option("missingkey=error").Parse(string(contents))
+}
+
+func (m *migrator) tableExists(name string) (b bool, e error) {
+	e = m.conn.QueryRow(m.dialect.tableExists, name).Scan(&b)
+	return
+}
+
+// version returns the schema version of a table, or of the shared tables if name is empty
+func (m *migrator) version(name string) (version int, e error) {
+
+	exists, e := m.tableExists("SCHEMA_VERSION")
+
+	if e != nil || !exists {
+		return
+	}
+
+	if e = m.conn.QueryRow(m.dialect.version, name).Scan(&version); e == sql.ErrNoRows {
+		return 0, nil
+	}
+
+	return
+}
+
+// versions returns the version of the shared tables and of every device table, including the given ones.
+// SCHEMA_VERSION is created if missing: if the tables were created by -initdb before migrations existed,
+// they are upgraded to version 1.
+func (m *migrator) versions(tables []string) (map[string]int, error) {
+
+	versions := map[string]int{schemaShared: 0}
+
+	for _, table := range tables {
+		versions[table] = 0
+	}
+
+	exists, e := m.tableExists("SCHEMA_VERSION")
+
+	if e != nil {
+		return nil, e
+	}
+
+	if !exists {
+
+		legacy, e := m.tableExists("USERS")
+
+		if e != nil {
+			return nil, e
+		}
+
+		if !legacy {
+			_, e = m.conn.Exec(createSchemaVersion)
+			return versions, e
+		}
+
+		log.Println("Found tables created by -initdb, upgrading them to schema version 1")
+
+		if e = m.upgradeLegacy(versions); e != nil {
+			return nil, e
+		}
+	}
+
+	rows, e := m.conn.Query("SELECT NAME, VERSION FROM SCHEMA_VERSION")
+
+	if e != nil {
+		return nil, e
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+
+		var (
+			name    string
+			version int
+		)
+
+		if e = rows.Scan(&name, &version); e != nil {
+			return nil, e
+		}
+
+		versions[name] = version
+	}
+
+	return versions, rows.Err()
+}
+
+// upgradeLegacy brings the tables created by -initdb among versions to version 1, creating SCHEMA_VERSION in the
+// same transaction so that a failed upgrade can be tried again
+func (m *migrator) upgradeLegacy(versions map[string]int) (e error) {
+
+	mig, e := loadLegacy(m.dialect.dir)
+
+	if e != nil {
+		return
+	}
+
+	names := []string{schemaShared}
+
+	for name := range versions {
+
+		if name == schemaShared {
+			continue
+		}
+
+		exists, e := m.tableExists(name)
+
+		if e != nil {
+			return e
+		}
+
+		if exists {
+			names = append(names, name)
+		}
+	}
+
+	tx, e := m.conn.Begin()
+
+	if e != nil {
+		return
+	}
+
+	defer func() {
+		if e != nil {
+			tx.Rollback()
+		}
+	}()
+
+	if _, e = tx.Exec(createSchemaVersion); e != nil {
+		return
+	}
+
+	for _, name := range names {
+
+		tpl := mig.up
+
+		if name != schemaShared {
+			tpl = mig.devicesUp
+		}
+
+		if e = execScript(tx, tpl, name); e != nil {
+			return
+		}
+
+		if _, e = tx.Exec(m.dialect.setVersion, name, 1); e != nil {
+			return
+		}
+	}
+
+	if e = tx.Commit(); e != nil {
+		return
+	}
+
+	for _, name := range names {
+		versions[name] = 1
+		log.Printf("Upgraded %s from -initdb to version 1", schemaName(name))
+	}
+
+	return nil
+}
+
+func (m *migrator) migrate(tables []string, target int) error {
+
+	migrations, e := loadMigrations(m.dialect.dir)
+
+	if e != nil {
+		return e
+	}
+
+	versions, e := m.versions(tables)
+
+	if e != nil {
+		return e
+	}
+
+	for name, version := range versions {
+		if version > Version {
+			return schemaError(name, version)
+		}
+	}
+
+	for _, mig := range migrations {
+		if mig.version <= target {
+			if e = m.step(mig, versions, true); e != nil {
+				return e
+			}
+		}
+	}
+
+	for i := len(migrations) - 1; i >= target; i-- {
+		if e = m.step(migrations[i], versions, false); e != nil {
+			return e
+		}
+	}
+
+	log.Printf("The schema is at version %d", target)
+
+	return nil
+}
+
+// step applies mig to the tables it applies to, in a single transaction. Going up, the shared tables change
+// before the device tables referencing them, and after them going down.
+func (m *migrator) step(mig *migration, versions map[string]int, up bool) (e error) {
+
+	from, to, script, devicesScript := mig.version-1, mig.version, mig.up, mig.devicesUp
+
+	if !up {
+		from, to, script, devicesScript = to, from, mig.down, mig.devicesDown
+	}
+
+	var names []string
+
+	for name, version := range versions {
+		if version == from {
+			names = append(names, name)
+		}
+	}
+
+	if len(names) == 0 {
+		return nil
+	}
+
+	sort.Slice(names, func(i, j int) bool {
+		return (names[i] < names[j]) == up //the shared tables have the empty name
+	})
+
+	tx, e := m.conn.Begin()
+
+	if e != nil {
+		return
+	}
+
+	defer func() {
+		if e != nil {
+			tx.Rollback()
+		}
+	}()
+
+	for _, name := range names {
+
+		tpl := script
+
+		if name != schemaShared {
+			tpl = devicesScript
+		}
+
+		if e = execScript(tx, tpl, name); e != nil {
+			return
+		}
+
+		if _, e = tx.Exec(m.dialect.setVersion, name, to); e != nil {
+			return
+		}
+	}
+
+	if e = tx.Commit(); e != nil {
+		return
+	}
+
+	for _, name := range names {
+		versions[name] = to
+		log.Printf("Migrated %s from version %d to %d", schemaName(name), from, to)
+	}
+
+	return nil
+}
+
+// execScript runs a migration script on a device table, or on the shared tables if name is empty. A nil script
+// leaves them alone.
+func execScript(tx *sql.Tx, tpl *template.Template, name string) error {
+
+	if tpl == nil {
+		return nil
+	}
+
+	var statements bytes.Buffer
+
+	if e := tpl.Execute(&statements, struct{ Table string }{name}); e != nil {
+		return e
+	}
+
+	if _, e := tx.Exec(statements.String()); e != nil {
+		return fmt.Errorf("%s of %s failed: %s", tpl.Name(), schemaName(name), e.Error())
+	}
+
+	return nil
+}
+
+// checkSchema fails unless the schema of a device table, or of the shared tables if table is empty, is at Version
+func checkSchema(conn *sql.DB, d *dialect, table string) error {
+
+	version, e := (&migrator{conn: conn, dialect: d}).version(table)
+
+	if e != nil {
+		return e
+	}
+
+	if version != Version {
+		return schemaError(table, version)
+	}
+
+	return nil
+}
+
+func schemaError(name string, version int) error {
+
+	if version > Version {
+		return fmt.Errorf("The schema of %s is at version %d, newer than the %d this pushed knows: migrate it down with the pushed that migrated it up",
+			schemaName(name), version, Version)
+	}
+
+	return fmt.Errorf("The schema of %s is at version %d, but pushed needs version %d: run pushed -migrate", schemaName(name), version, Version)
+}
+
+func schemaName(name string) string {
+
+	if name == schemaShared {
+		return "the shared tables"
+	}
+
+	return "table " + name
+}
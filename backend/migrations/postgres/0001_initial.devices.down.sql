@@ -0,0 +1,2 @@
+DROP TABLE {{.Table}};
+DROP FUNCTION CHECK{{.Table}}();
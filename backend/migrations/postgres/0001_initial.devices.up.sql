@@ -0,0 +1,15 @@
+CREATE TABLE {{.Table}} (
+	USERID BIGINT REFERENCES USERS ON DELETE CASCADE,
+	TOKEN CHARACTER VARYING,
+	DATA CHARACTER VARYING NOT NULL DEFAULT '',
+	PRIMARY KEY (USERID, TOKEN));
+
+CREATE FUNCTION CHECK{{.Table}}() RETURNS TRIGGER AS $$
+BEGIN
+	IF ((SELECT COUNT(TOKEN) FROM {{.Table}} WHERE USERID = NEW.USERID) >= 10) THEN
+		RAISE EXCEPTION 'Already 10 tokens for this user';
+	END IF;
+	RETURN NEW;
+END $$ LANGUAGE plpgsql;
+
+CREATE TRIGGER CHECK{{.Table}} BEFORE INSERT ON {{.Table}} FOR EACH ROW EXECUTE PROCEDURE CHECK{{.Table}}();
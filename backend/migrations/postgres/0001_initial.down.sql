@@ -0,0 +1,10 @@
+DROP TABLE OUTBOXUSERS;
+DROP TABLE OUTBOXDEVICES;
+DROP TABLE OUTBOXRESULTS;
+DROP TABLE IDEMPOTENCYKEYS;
+DROP TABLE OUTBOX;
+DROP TABLE TEMPLATES;
+DROP TABLE CLIENTS;
+DROP TABLE BROADCASTS;
+DROP TABLE TOPICS;
+DROP TABLE USERS;
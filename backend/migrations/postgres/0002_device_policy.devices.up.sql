@@ -0,0 +1,6 @@
+DROP TRIGGER CHECK{{.Table}} ON {{.Table}};
+DROP FUNCTION CHECK{{.Table}}();
+
+ALTER TABLE {{.Table}}
+	ADD COLUMN REGISTERED TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+	ADD COLUMN LAST_SUCCESS TIMESTAMP WITH TIME ZONE;
@@ -0,0 +1,5 @@
+UPDATE OUTBOX SET STATE = 'pending' WHERE STATE = 'processing';
+
+DROP INDEX OUTBOX_DUE;
+
+CREATE INDEX OUTBOX_PENDING ON OUTBOX (NEXTTRY) WHERE STATE = 'pending';
@@ -0,0 +1,3 @@
+DROP INDEX OUTBOX_PENDING;
+
+CREATE INDEX OUTBOX_DUE ON OUTBOX (NEXTTRY) WHERE STATE IN ('pending', 'processing');
@@ -0,0 +1 @@
+ALTER TABLE BROADCASTS DROP COLUMN LEASE;
@@ -0,0 +1 @@
+ALTER TABLE BROADCASTS ADD COLUMN LEASE TIMESTAMPTZ;
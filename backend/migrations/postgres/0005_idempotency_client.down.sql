@@ -0,0 +1,7 @@
+DELETE FROM IDEMPOTENCYKEYS WHERE CLIENT <> '';
+
+ALTER TABLE IDEMPOTENCYKEYS DROP CONSTRAINT IDEMPOTENCYKEYS_PKEY;
+
+ALTER TABLE IDEMPOTENCYKEYS DROP COLUMN CLIENT;
+
+ALTER TABLE IDEMPOTENCYKEYS ADD PRIMARY KEY (KEY);
@@ -0,0 +1,5 @@
+ALTER TABLE IDEMPOTENCYKEYS ADD COLUMN CLIENT VARCHAR(255) NOT NULL DEFAULT '';
+
+ALTER TABLE IDEMPOTENCYKEYS DROP CONSTRAINT IDEMPOTENCYKEYS_PKEY;
+
+ALTER TABLE IDEMPOTENCYKEYS ADD PRIMARY KEY (CLIENT, KEY);
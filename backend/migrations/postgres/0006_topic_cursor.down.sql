@@ -0,0 +1 @@
+ALTER TABLE OUTBOX DROP COLUMN LASTUSER;
@@ -0,0 +1 @@
+ALTER TABLE OUTBOX ADD COLUMN LASTUSER BIGINT NOT NULL DEFAULT -1;
@@ -0,0 +1,23 @@
+DO $$
+BEGIN
+	IF EXISTS (SELECT 1 FROM information_schema.columns
+		WHERE table_schema = current_schema() AND table_name = lower('{{.Table}}') AND column_name = 'regid') THEN
+		ALTER TABLE {{.Table}} RENAME COLUMN REGID TO TOKEN;
+	END IF;
+END $$;
+
+ALTER TABLE {{.Table}} ADD COLUMN IF NOT EXISTS DATA CHARACTER VARYING NOT NULL DEFAULT '';
+
+DROP TRIGGER IF EXISTS CHECKTEN ON {{.Table}};
+DROP FUNCTION IF EXISTS CHECKTEN();
+
+CREATE OR REPLACE FUNCTION CHECK{{.Table}}() RETURNS TRIGGER AS $$
+BEGIN
+	IF ((SELECT COUNT(TOKEN) FROM {{.Table}} WHERE USERID = NEW.USERID) >= 10) THEN
+		RAISE EXCEPTION 'Already 10 tokens for this user';
+	END IF;
+	RETURN NEW;
+END $$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS CHECK{{.Table}} ON {{.Table}};
+CREATE TRIGGER CHECK{{.Table}} BEFORE INSERT ON {{.Table}} FOR EACH ROW EXECUTE PROCEDURE CHECK{{.Table}}();
@@ -0,0 +1,79 @@
+ALTER TABLE USERS ADD COLUMN IF NOT EXISTS LOCALE VARCHAR(64);
+
+CREATE TABLE IF NOT EXISTS TOPICS (
+	USERID BIGINT REFERENCES USERS ON DELETE CASCADE,
+	TOPIC VARCHAR(900),
+	PRIMARY KEY (USERID, TOPIC));
+
+CREATE INDEX IF NOT EXISTS TOPICS_TOPIC ON TOPICS (TOPIC, USERID);
+
+CREATE TABLE IF NOT EXISTS BROADCASTS (
+	ID BIGSERIAL PRIMARY KEY,
+	DATA TEXT NOT NULL,
+	RATE INTEGER NOT NULL CHECK (RATE > 0),
+	STATE VARCHAR(16) NOT NULL DEFAULT 'running',
+	LASTUSER BIGINT NOT NULL DEFAULT -1,
+	TOTAL BIGINT NOT NULL,
+	PROCESSED BIGINT NOT NULL DEFAULT 0,
+	DELIVERED BIGINT NOT NULL DEFAULT 0,
+	FAILED BIGINT NOT NULL DEFAULT 0,
+	REMOVED BIGINT NOT NULL DEFAULT 0,
+	LASTERROR VARCHAR,
+	CREATED TIMESTAMPTZ NOT NULL DEFAULT now(),
+	UPDATED TIMESTAMPTZ NOT NULL DEFAULT now());
+
+CREATE TABLE IF NOT EXISTS CLIENTS (
+	ID VARCHAR(255) PRIMARY KEY,
+	SECRET VARCHAR NOT NULL,
+	ACL TEXT);
+
+CREATE TABLE IF NOT EXISTS TEMPLATES (
+	NAME VARCHAR(255),
+	LOCALE VARCHAR(64),
+	BODY TEXT NOT NULL,
+	PRIMARY KEY (NAME, LOCALE));
+
+CREATE TABLE IF NOT EXISTS OUTBOX (
+	ID BIGSERIAL PRIMARY KEY,
+	USERIDS BIGINT[] CHECK (cardinality(USERIDS) > 0),
+	TOPIC VARCHAR(900),
+	TEMPLATE VARCHAR(255),
+	DATA TEXT NOT NULL,
+	STATE VARCHAR(16) NOT NULL DEFAULT 'pending',
+	ATTEMPTS INTEGER NOT NULL DEFAULT 0,
+	CREATED TIMESTAMPTZ NOT NULL DEFAULT now(),
+	NEXTTRY TIMESTAMPTZ NOT NULL DEFAULT now(),
+	CHECK ((USERIDS IS NULL) <> (TOPIC IS NULL)));
+
+CREATE INDEX IF NOT EXISTS OUTBOX_PENDING ON OUTBOX (NEXTTRY) WHERE STATE = 'pending';
+
+CREATE TABLE IF NOT EXISTS IDEMPOTENCYKEYS (
+	KEY VARCHAR(255) PRIMARY KEY,
+	MESSAGE BIGINT NOT NULL REFERENCES OUTBOX ON DELETE CASCADE,
+	CREATED TIMESTAMPTZ NOT NULL DEFAULT now());
+
+CREATE INDEX IF NOT EXISTS IDEMPOTENCYKEYS_CREATED ON IDEMPOTENCYKEYS (CREATED);
+
+CREATE TABLE IF NOT EXISTS OUTBOXRESULTS (
+	MESSAGE BIGINT REFERENCES OUTBOX ON DELETE CASCADE,
+	CONNECTOR VARCHAR NOT NULL,
+	STATUS VARCHAR(16) NOT NULL,
+	ERROR VARCHAR NOT NULL DEFAULT '',
+	PRIMARY KEY (MESSAGE, CONNECTOR));
+
+CREATE TABLE IF NOT EXISTS OUTBOXDEVICES (
+	MESSAGE BIGINT REFERENCES OUTBOX ON DELETE CASCADE,
+	CONNECTOR VARCHAR NOT NULL,
+	TOKEN VARCHAR NOT NULL,
+	USERID BIGINT NOT NULL,
+	STATE VARCHAR(16) NOT NULL,
+	MESSAGEID VARCHAR NOT NULL DEFAULT '',
+	CANONICAL VARCHAR NOT NULL DEFAULT '',
+	REASON VARCHAR NOT NULL DEFAULT '',
+	PRIMARY KEY (MESSAGE, CONNECTOR, TOKEN));
+
+CREATE TABLE IF NOT EXISTS OUTBOXUSERS (
+	MESSAGE BIGINT REFERENCES OUTBOX ON DELETE CASCADE,
+	USERID BIGINT NOT NULL,
+	ERROR VARCHAR NOT NULL,
+	PRIMARY KEY (MESSAGE, USERID));
@@ -0,0 +1,5 @@
+CREATE TABLE {{.Table}} (
+	USERID INTEGER REFERENCES USERS ON DELETE CASCADE,
+	TOKEN TEXT,
+	DATA TEXT NOT NULL DEFAULT '',
+	PRIMARY KEY (USERID, TOKEN));
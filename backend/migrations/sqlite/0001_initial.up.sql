@@ -0,0 +1 @@
+CREATE TABLE USERS (ID INTEGER PRIMARY KEY CHECK (ID > -1));
@@ -0,0 +1,2 @@
+ALTER TABLE {{.Table}} DROP COLUMN LAST_SUCCESS;
+ALTER TABLE {{.Table}} DROP COLUMN REGISTERED;
@@ -0,0 +1,4 @@
+ALTER TABLE {{.Table}} ADD COLUMN REGISTERED TIMESTAMP;
+ALTER TABLE {{.Table}} ADD COLUMN LAST_SUCCESS TIMESTAMP;
+
+UPDATE {{.Table}} SET REGISTERED = CURRENT_TIMESTAMP;
@@ -0,0 +1,967 @@
+/*  Pushed - a daemon for parallel handling of push operations to mobile devices
+ *  Copyright (C) 2014  Marco Cilloni <marco.cilloni@yahoo.com>
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *  Exhibit B is not attached; this software is compatible with the
+ *  licenses expressed under Section 1.12 of the MPL v2.
+ */
+
+package backend
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	OutboxDefaultMaxAttempts  = 5
+	OutboxDefaultPollInterval = 5 * time.Second
+	OutboxDefaultWorkers      = 4
+	MaxRecipients             = 1000 //users of a single PUSH
+	outboxAwaitInterval       = 100 * time.Millisecond
+	outboxBaseDelay           = 10 * time.Second
+	outboxLease               = 5 * time.Minute //renewed while the delivery goes on
+	outboxMaxDelay            = 30 * time.Minute
+
+	MessageCancelled  = "cancelled"
+	MessageDone       = "done"
+	MessageFailed     = "failed"
+	MessagePending    = "pending"
+	MessageProcessing = "processing" //a worker holds a lease on it until NEXTTRY
+
+	ResultDelivered = "delivered"
+	ResultFailed    = "failed"
+	ResultSkipped   = "skipped"   //the user has no devices on the connector
+	ResultValidated = "validated" //dry run, the message would have been sent to some of its devices
+)
+
+var (
+	ErrNoRecipients      = errors.New("A push needs at least one user")
+	ErrOutboxStarted     = errors.New("Outbox workers are already running")
+	ErrTooManyRecipients = errors.New("Too many users for a single push")
+	ErrUnknownMessage    = errors.New("No message with the given ID")
+	errLeaseLost         = errors.New("Another worker took the message over")
+	globalOutbox         *outbox
+)
+
+// OutboxConfig tunes the workers delivering queued messages
+type OutboxConfig struct {
+	Workers      int
+	PollInterval time.Duration //how often workers look for messages due for a retry
+	MaxAttempts  int           //delivery attempts before a message is given up as failed
+
+	IdempotencyWindow time.Duration //how long idempotency keys are remembered
+}
+
+// outbox delivers the messages queued in OUTBOX. Each worker claims a message by marking it processing with
+// a lease in NEXTTRY, delivers it with no transaction open and records the outcome in a second transaction.
+// The lease is renewed during the delivery, so if a worker dies the message is picked up again once it expires.
+// Scheduled messages are queued with a NEXTTRY in the future, so the workers fire them once they are due.
+type outbox struct {
+	config *OutboxConfig
+	quit   chan bool
+	wake   chan bool
+	wg     sync.WaitGroup
+}
+
+// ConnectorStatus is the outcome of the last delivery attempt of a message through a connector
+type ConnectorStatus struct {
+	Status  string    `json:"status"`
+	Error   string    `json:"error,omitempty"`
+	Devices []Receipt `json:"devices"`
+}
+
+type MessageStatus struct {
+	Id         int64                       `json:"id"`
+	User       int64                       `json:"user"`               //the first of Users, meaningless for topic messages
+	Users      []int64                     `json:"users,omitempty"`    //unset for topic messages
+	Topic      string                      `json:"topic,omitempty"`    //set for PUSHTOPIC messages
+	Template   string                      `json:"template,omitempty"` //set for PUSHTPL messages
+	State      string                      `json:"state"`
+	Attempts   int                         `json:"attempts"`
+	NextTry    time.Time                   `json:"next_try"` //when a pending message is due
+	Connectors map[string]*ConnectorStatus `json:"connectors"`
+	Recipients map[int64]string            `json:"recipients"`       //outcome for each user, summing up its devices
+	Errors     map[int64]string            `json:"errors,omitempty"` //users a template could not be rendered for
+}
+
+type queuedMessage struct {
+	id       int64
+	users    pq.Int64Array
+	topic    sql.NullString
+	template sql.NullString
+	message  Message
+	vars     []byte //template variables, instead of message
+	state    string
+	attempts int
+	lastUser int64 //last subscriber of the topic fan-out pass in progress, -1 if none
+}
+
+// Enqueue stores message in the outbox and returns its ID. Delivery happens later, from the outbox workers.
+func Enqueue(user int64, message Message) (id int64, e error) {
+	return EnqueueMany([]int64{user}, message)
+}
+
+// EnqueueMany is like Enqueue, but for many users at once. Their devices are fetched together, so connectors
+// with multicast can reach all of them in a few requests.
+func EnqueueMany(users []int64, message Message) (id int64, e error) {
+	return EnqueueAt(users, message, time.Time{})
+}
+
+// EnqueueAt is like EnqueueMany, but the message is not delivered before at. A zero at means now.
+func EnqueueAt(users []int64, message Message, at time.Time) (id int64, e error) {
+
+	id, _, e = EnqueueKeyed("", "", users, message, at)
+
+	return
+}
+
+// uniqueUsers sorts users and drops duplicates, so that no user gets the same message twice
+func uniqueUsers(users []int64) []int64 {
+
+	sorted := append([]int64(nil), users...)
+
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i] < sorted[j]
+	})
+
+	unique := sorted[:0]
+
+	for i, user := range sorted {
+		if i == 0 || user != sorted[i-1] {
+			unique = append(unique, user)
+		}
+	}
+
+	return unique
+}
+
+// EnqueueTopic is like Enqueue, but the message goes to every subscriber of topic
+func EnqueueTopic(topic string, message Message) (id int64, e error) {
+
+	if !ValidTopicName(topic) {
+		return 0, ErrInvalidTopic
+	}
+
+	data, e := json.Marshal(message)
+
+	if e != nil {
+		return
+	}
+
+	return enqueue(nil, sql.NullString{String: topic, Valid: true}, sql.NullString{}, data, time.Time{})
+}
+
+// enqueue stores data, which holds either a message or the variables of template
+func enqueue(users []int64, topic, template sql.NullString, data []byte, at time.Time) (id int64, e error) {
+
+	id, _, e = enqueueKeyed("", "", users, topic, template, data, at)
+
+	return
+}
+
+// enqueueKeyed is enqueue, plus the idempotency key check of EnqueueKeyed
+func enqueueKeyed(client, key string, users []int64, topic, template sql.NullString, data []byte, at time.Time) (id int64, duplicate bool, e error) {
+
+	if e = needsPostgres(); e != nil {
+		return
+	}
+
+	tx, e := globalDb.conn.Begin()
+
+	if e != nil {
+		return
+	}
+
+	defer func() {
+		if e != nil {
+			tx.Rollback()
+		}
+	}()
+
+	if e = tx.Stmt(globalDb.outboxAddStmt).QueryRow(pq.Array(users), topic, template, string(data),
+		sql.NullTime{Time: at, Valid: !at.IsZero()}).Scan(&id); e != nil {
+		return
+	}
+
+	if key != "" {
+
+		var claimed bool
+
+		if claimed, e = claimKey(tx, client, key, id); e != nil {
+			return
+		}
+
+		if !claimed {
+
+			if e = tx.Rollback(); e != nil {
+				return
+			}
+
+			id, e = keyedMessage(client, key)
+
+			return id, true, e
+		}
+	}
+
+	if e = tx.Commit(); e != nil {
+		return
+	}
+
+	if globalOutbox != nil && !at.After(time.Now()) {
+		select {
+		case globalOutbox.wake <- true:
+		default: //all workers are already awake
+		}
+	}
+
+	return
+}
+
+// CancelMessage stops a message from being delivered, if it is still pending. It returns false for a message
+// being delivered, as the attempt in progress cannot be stopped.
+func CancelMessage(id int64) (bool, error) {
+
+	if e := needsPostgres(); e != nil {
+		return false, e
+	}
+
+	res, e := globalDb.conn.Exec("UPDATE OUTBOX SET STATE = $2 WHERE ID = $1 AND STATE = $3", id, MessageCancelled, MessagePending)
+
+	if e != nil {
+		return false, e
+	}
+
+	n, e := res.RowsAffected()
+
+	if e != nil || n == 0 {
+		return false, e
+	}
+
+	log.Printf("Message %d has been cancelled", id)
+
+	return true, nil
+}
+
+// StartOutbox must be called after every connector has been initialized. Messages left pending from a
+// previous run are resumed right away.
+func StartOutbox(config *OutboxConfig) error {
+
+	if globalOutbox != nil {
+		return ErrOutboxStarted
+	}
+
+	if !UsesPostgres() {
+		log.Println("The outbox needs the postgres storage, PUSH will deliver messages right away")
+		return nil
+	}
+
+	if config.Workers <= 0 {
+		config.Workers = OutboxDefaultWorkers
+	}
+
+	if config.PollInterval <= 0 {
+		config.PollInterval = OutboxDefaultPollInterval
+	}
+
+	if config.MaxAttempts <= 0 {
+		config.MaxAttempts = OutboxDefaultMaxAttempts
+	}
+
+	if config.IdempotencyWindow <= 0 {
+		config.IdempotencyWindow = OutboxDefaultIdempotencyWindow
+	}
+
+	globalOutbox = &outbox{
+		config: config,
+		quit:   make(chan bool),
+		wake:   make(chan bool, config.Workers),
+	}
+
+	for i := 0; i < config.Workers; i++ {
+		globalOutbox.wg.Add(1)
+		go globalOutbox.work()
+	}
+
+	return nil
+}
+
+// StopOutbox waits for the deliveries in progress to finish
+func StopOutbox() {
+
+	if globalOutbox == nil {
+		return
+	}
+
+	close(globalOutbox.quit)
+	globalOutbox.wg.Wait()
+
+	globalOutbox = nil
+}
+
+func (ob *outbox) work() {
+
+	defer ob.wg.Done()
+
+	for {
+		claimed, e := ob.deliverNext()
+
+		if e != nil {
+			log.Printf("Outbox error: %s", e.Error())
+		}
+
+		if claimed && e == nil {
+			select {
+			case <-ob.quit:
+				return
+			default:
+				continue
+			}
+		}
+
+		select {
+		case <-ob.quit:
+			return
+		case <-ob.wake:
+		case <-time.After(ob.config.PollInterval):
+		}
+	}
+}
+
+// outboxDelay is the exponential backoff before the next attempt of a message failed attempts times
+func outboxDelay(attempts int) time.Duration {
+
+	delay := outboxBaseDelay
+
+	for i := 1; i < attempts && delay < outboxMaxDelay; i++ {
+		delay *= 2
+	}
+
+	if delay > outboxMaxDelay {
+		delay = outboxMaxDelay
+	}
+
+	return delay
+}
+
+// deliverNext claims a due message, if any, and pushes it to the devices that did not get it yet
+func (ob *outbox) deliverNext() (claimed bool, e error) {
+
+	msg, resume, e := ob.claim()
+
+	if msg == nil || e != nil {
+		return msg != nil, e
+	}
+
+	done := make(chan bool)
+	go renewLease(msg, done)
+
+	var (
+		results  map[string]*pushResult
+		failures map[int64]string
+	)
+
+	switch {
+	case msg.topic.Valid:
+		results, e = pushTopic(msg, resume)
+	case msg.template.Valid:
+		results, failures, e = pushTemplate(msg, resume)
+	default:
+		results = pushEach(msg.users, msg.message, resume)
+	}
+
+	close(done)
+
+	if e != nil {
+		return true, e //the lease expires and the message is tried again
+	}
+
+	return true, ob.record(msg, results, failures)
+}
+
+// claim takes the lease of the first due message, along with what its previous attempts achieved. Messages
+// whose lease expired are claimed again, unless they are out of attempts.
+func (ob *outbox) claim() (msg *queuedMessage, resume map[string]*progress, e error) {
+
+	tx, e := globalDb.conn.Begin()
+
+	if e != nil {
+		return
+	}
+
+	defer func() {
+		if e != nil {
+			tx.Rollback()
+		}
+	}()
+
+	if msg, e = claimMessage(tx); e == sql.ErrNoRows {
+		return nil, nil, tx.Rollback()
+	}
+
+	if e != nil {
+		return
+	}
+
+	if msg.state == MessageProcessing {
+		log.Printf("The lease of message %d expired during attempt %d", msg.id, msg.attempts)
+
+		if msg.attempts >= ob.config.MaxAttempts {
+			log.Printf("Message %d failed %d times, giving up", msg.id, msg.attempts)
+
+			if _, e = tx.Exec("UPDATE OUTBOX SET STATE = $2 WHERE ID = $1", msg.id, MessageFailed); e != nil {
+				return
+			}
+
+			return nil, nil, tx.Commit()
+		}
+	}
+
+	msg.attempts++
+
+	if _, e = tx.Exec("UPDATE OUTBOX SET STATE = $2, ATTEMPTS = $3, NEXTTRY = now() + $4::float8 * interval '1 second' WHERE ID = $1",
+		msg.id, MessageProcessing, msg.attempts, outboxLease.Seconds()); e != nil {
+		return
+	}
+
+	if resume, e = messageProgress(tx, msg); e != nil {
+		return
+	}
+
+	e = tx.Commit()
+
+	return
+}
+
+// renewLease keeps the lease of msg until done is closed, so that long deliveries are not taken over
+func renewLease(msg *queuedMessage, done <-chan bool) {
+
+	ticker := time.NewTicker(outboxLease / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if _, e := globalDb.conn.Exec(`UPDATE OUTBOX SET NEXTTRY = now() + $4::float8 * interval '1 second'
+				WHERE ID = $1 AND STATE = $2 AND ATTEMPTS = $3`, msg.id, MessageProcessing, msg.attempts, outboxLease.Seconds()); e != nil {
+				log.Printf("Cannot renew the lease of message %d: %s", msg.id, e.Error())
+			}
+		}
+	}
+}
+
+// record stores the outcome of a delivery, unless another worker took the message over in the meantime
+func (ob *outbox) record(msg *queuedMessage, results map[string]*pushResult, failures map[int64]string) (e error) {
+
+	failed := false
+
+	for _, res := range results {
+		if res.e != nil && res.e != ErrNotRegistered {
+			failed = true
+		}
+	}
+
+	state := MessageDone
+
+	if failed {
+		state = MessagePending
+
+		if msg.attempts >= ob.config.MaxAttempts {
+			log.Printf("Message %d failed %d times, giving up", msg.id, msg.attempts)
+			state = MessageFailed
+		}
+	}
+
+	tx, e := globalDb.conn.Begin()
+
+	if e != nil {
+		return
+	}
+
+	defer func() {
+		if e != nil {
+			tx.Rollback()
+		}
+	}()
+
+	res, e := tx.Exec(`UPDATE OUTBOX SET STATE = $2, NEXTTRY = now() + $4::float8 * interval '1 second', LASTUSER = -1
+		WHERE ID = $1 AND STATE = $5 AND ATTEMPTS = $3`, msg.id, state, msg.attempts, outboxDelay(msg.attempts).Seconds(), MessageProcessing)
+
+	if e != nil {
+		return
+	}
+
+	n, e := res.RowsAffected()
+
+	if e != nil {
+		return
+	}
+
+	if n == 0 {
+		log.Printf("Message %d has been taken over by another worker, dropping the outcome of attempt %d", msg.id, msg.attempts)
+		return tx.Rollback()
+	}
+
+	for name, res := range results {
+
+		if e = recordResult(tx, msg.id, name, res); e != nil {
+			return
+		}
+	}
+
+	if msg.template.Valid {
+		if e = recordTemplateErrors(tx, msg.id, failures); e != nil {
+			return
+		}
+	}
+
+	return tx.Commit()
+}
+
+// recordPage stores the outcome of a page of a topic fan-out and moves the cursor of msg past it, unless another
+// worker took the message over. results sums up the pages pushed so far by this pass, page is this one.
+func recordPage(msg *queuedMessage, results, page map[string]*pushResult, lastUser int64) (e error) {
+
+	tx, e := globalDb.conn.Begin()
+
+	if e != nil {
+		return
+	}
+
+	defer func() {
+		if e != nil {
+			tx.Rollback()
+		}
+	}()
+
+	res, e := tx.Exec("UPDATE OUTBOX SET LASTUSER = $4 WHERE ID = $1 AND STATE = $2 AND ATTEMPTS = $3",
+		msg.id, MessageProcessing, msg.attempts, lastUser)
+
+	if e != nil {
+		return
+	}
+
+	n, e := res.RowsAffected()
+
+	if e != nil {
+		return
+	}
+
+	if n == 0 {
+		tx.Rollback()
+		return errLeaseLost
+	}
+
+	for name, res := range results {
+
+		pageRes := pushResult{e: res.e}
+
+		if pushed, ok := page[name]; ok {
+			pageRes.receipts = pushed.receipts
+		}
+
+		if e = recordResult(tx, msg.id, name, &pageRes); e != nil {
+			return
+		}
+	}
+
+	return tx.Commit()
+}
+
+// recordResult stores the outcome of a message through a connector, and the receipts in res
+func recordResult(tx *sql.Tx, id int64, name string, res *pushResult) (e error) {
+
+	status, errMsg := ResultDelivered, ""
+
+	switch res.e {
+	case nil:
+	case ErrNotRegistered:
+		status = ResultSkipped
+	default:
+		status, errMsg = ResultFailed, res.e.Error()
+	}
+
+	if _, e = tx.Exec(`INSERT INTO OUTBOXRESULTS (MESSAGE, CONNECTOR, STATUS, ERROR) VALUES ($1,$2,$3,$4)
+		ON CONFLICT (MESSAGE, CONNECTOR) DO UPDATE SET STATUS = EXCLUDED.STATUS, ERROR = EXCLUDED.ERROR`,
+		id, name, status, errMsg); e != nil {
+		return
+	}
+
+	for _, receipt := range res.receipts {
+		if _, e = tx.Exec(`INSERT INTO OUTBOXDEVICES (MESSAGE, CONNECTOR, TOKEN, USERID, STATE, MESSAGEID, CANONICAL, REASON)
+			VALUES ($1,$2,$3,$4,$5,$6,$7,$8) ON CONFLICT (MESSAGE, CONNECTOR, TOKEN) DO UPDATE SET STATE = EXCLUDED.STATE,
+			MESSAGEID = EXCLUDED.MESSAGEID, CANONICAL = EXCLUDED.CANONICAL, REASON = EXCLUDED.REASON`,
+			id, name, receipt.Token, receipt.User, string(receipt.State), receipt.MessageId, receipt.Canonical,
+			receipt.Reason); e != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// passResults returns the outcome through each connector of the pages a topic fan-out pass already recorded
+func passResults(id int64) (map[string]*pushResult, error) {
+
+	rows, e := globalDb.conn.Query("SELECT CONNECTOR, STATUS, ERROR FROM OUTBOXRESULTS WHERE MESSAGE = $1", id)
+
+	if e != nil {
+		return nil, e
+	}
+
+	defer rows.Close()
+
+	results := make(map[string]*pushResult)
+
+	for rows.Next() {
+
+		var name, status, errMsg string
+
+		if e = rows.Scan(&name, &status, &errMsg); e != nil {
+			return nil, e
+		}
+
+		res := &pushResult{name: name}
+
+		switch status {
+		case ResultSkipped:
+			res.e = ErrNotRegistered
+		case ResultFailed:
+			res.e = errors.New(errMsg)
+		}
+
+		results[name] = res
+	}
+
+	return results, rows.Err()
+}
+
+// claimMessage locks the first message that is due or whose lease expired
+func claimMessage(tx *sql.Tx) (*queuedMessage, error) {
+
+	var (
+		data string
+		msg  queuedMessage
+	)
+
+	e := tx.QueryRow(`SELECT ID, USERIDS, TOPIC, TEMPLATE, DATA, STATE, ATTEMPTS, LASTUSER FROM OUTBOX WHERE STATE IN ($1, $2)
+		AND NEXTTRY <= now() ORDER BY ID LIMIT 1 FOR UPDATE SKIP LOCKED`, MessagePending, MessageProcessing).Scan(&msg.id, &msg.users,
+		&msg.topic, &msg.template, &data, &msg.state, &msg.attempts, &msg.lastUser)
+
+	if e != nil {
+		return nil, e
+	}
+
+	if msg.template.Valid {
+		msg.vars = []byte(data)
+		return &msg, nil
+	}
+
+	if e = json.Unmarshal([]byte(data), &msg.message); e != nil {
+		return nil, e
+	}
+
+	return &msg, nil
+}
+
+// messageProgress returns what the previous attempts of msg achieved through each connector. Halfway through a
+// topic fan-out the statuses only tell about the pages already pushed, so no connector is settled.
+func messageProgress(tx *sql.Tx, msg *queuedMessage) (map[string]*progress, error) {
+
+	rows, e := tx.Query("SELECT CONNECTOR, STATUS FROM OUTBOXRESULTS WHERE MESSAGE = $1", msg.id)
+
+	if e != nil {
+		return nil, e
+	}
+
+	defer rows.Close()
+
+	resume := make(map[string]*progress)
+
+	for rows.Next() {
+
+		var name, status string
+
+		if e = rows.Scan(&name, &status); e != nil {
+			return nil, e
+		}
+
+		resume[name] = &progress{settled: status != ResultFailed && msg.lastUser < 0, reached: make(map[string]bool), done: make(map[int64]bool)}
+	}
+
+	if e = rows.Err(); e != nil {
+		return nil, e
+	}
+
+	rows, e = tx.Query("SELECT CONNECTOR, TOKEN, USERID, STATE, CANONICAL FROM OUTBOXDEVICES WHERE MESSAGE = $1", msg.id)
+
+	if e != nil {
+		return nil, e
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+
+		var (
+			name, token, state, canonical string
+			user                          int64
+		)
+
+		if e = rows.Scan(&name, &token, &user, &state, &canonical); e != nil {
+			return nil, e
+		}
+
+		prog := resume[name]
+
+		if prog == nil || prog.settled {
+			continue
+		}
+
+		switch DeviceState(state) {
+		case DeviceFailed, DevicePending:
+			prog.done[user] = false
+			continue
+		}
+
+		prog.reached[token] = true
+
+		if canonical != "" {
+			prog.reached[canonical] = true //the store knows the device by its new token now
+		}
+
+		if _, ok := prog.done[user]; !ok {
+			prog.done[user] = true
+		}
+	}
+
+	return resume, rows.Err()
+}
+
+// MessageRecipients returns the users of the queued message with the given ID, or all if it goes to the
+// subscribers of a topic
+func MessageRecipients(id int64) (users []int64, all bool, e error) {
+
+	if e = needsPostgres(); e != nil {
+		return
+	}
+
+	var (
+		ids   pq.Int64Array
+		topic sql.NullString
+	)
+
+	switch e = globalDb.conn.QueryRow("SELECT USERIDS, TOPIC FROM OUTBOX WHERE ID = $1", id).Scan(&ids, &topic); e {
+	case nil:
+		return ids, topic.Valid, nil
+	case sql.ErrNoRows:
+		return nil, false, ErrUnknownMessage
+	}
+
+	return
+}
+
+// PushStatus reports how far the delivery of the message with the given ID went, for each connector and device
+func PushStatus(id int64) (*MessageStatus, error) {
+
+	if e := needsPostgres(); e != nil {
+		return nil, e
+	}
+
+	var (
+		status   = &MessageStatus{Id: id, Connectors: make(map[string]*ConnectorStatus)}
+		topic    sql.NullString
+		template sql.NullString
+		users    pq.Int64Array
+	)
+
+	e := globalDb.conn.QueryRow("SELECT USERIDS, TOPIC, TEMPLATE, STATE, ATTEMPTS, NEXTTRY FROM OUTBOX WHERE ID = $1", id).Scan(&users,
+		&topic, &template, &status.State, &status.Attempts, &status.NextTry)
+
+	if e == sql.ErrNoRows {
+		return nil, ErrUnknownMessage
+	}
+
+	if e != nil {
+		return nil, e
+	}
+
+	status.Users, status.Topic, status.Template = users, topic.String, template.String
+
+	if len(users) > 0 {
+		status.User = users[0]
+	}
+
+	rows, e := globalDb.conn.Query("SELECT CONNECTOR, STATUS, ERROR FROM OUTBOXRESULTS WHERE MESSAGE = $1", id)
+
+	if e != nil {
+		return nil, e
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+
+		var (
+			name      string
+			connector = &ConnectorStatus{Devices: []Receipt{}}
+		)
+
+		if e = rows.Scan(&name, &connector.Status, &connector.Error); e != nil {
+			return nil, e
+		}
+
+		status.Connectors[name] = connector
+	}
+
+	if e = rows.Err(); e != nil {
+		return nil, e
+	}
+
+	devRows, e := globalDb.conn.Query(`SELECT CONNECTOR, TOKEN, USERID, STATE, MESSAGEID, CANONICAL, REASON FROM OUTBOXDEVICES
+		WHERE MESSAGE = $1 ORDER BY CONNECTOR, TOKEN`, id)
+
+	if e != nil {
+		return nil, e
+	}
+
+	defer devRows.Close()
+
+	for devRows.Next() {
+
+		var (
+			name    string
+			receipt Receipt
+		)
+
+		if e = devRows.Scan(&name, &receipt.Token, &receipt.User, &receipt.State, &receipt.MessageId, &receipt.Canonical, &receipt.Reason); e != nil {
+			return nil, e
+		}
+
+		if connector, ok := status.Connectors[name]; ok {
+			connector.Devices = append(connector.Devices, receipt)
+		}
+	}
+
+	if e = devRows.Err(); e != nil {
+		return nil, e
+	}
+
+	if status.Errors, e = templateErrors(id); e != nil {
+		return nil, e
+	}
+
+	status.Recipients = recipientResults(status.Users, status.Connectors, status.Errors)
+
+	return status, nil
+}
+
+// AwaitAttempt waits until the first delivery attempt of message id is over, or ctx is done, and returns the
+// status of the message. Connectors that failed are retried later, as usual.
+func AwaitAttempt(ctx context.Context, id int64) (*MessageStatus, error) {
+
+	ticker := time.NewTicker(outboxAwaitInterval)
+	defer ticker.Stop()
+
+	for {
+		status, e := PushStatus(id)
+
+		if e != nil {
+			return nil, e
+		}
+
+		switch {
+		case status.State == MessagePending && status.Attempts > 0, status.State != MessagePending && status.State != MessageProcessing:
+			return status, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return status, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// templateErrors returns why the template of message id could not be rendered for some of its users
+func templateErrors(id int64) (map[int64]string, error) {
+
+	rows, e := globalDb.conn.Query("SELECT USERID, ERROR FROM OUTBOXUSERS WHERE MESSAGE = $1", id)
+
+	if e != nil {
+		return nil, e
+	}
+
+	defer rows.Close()
+
+	var errs map[int64]string
+
+	for rows.Next() {
+
+		var (
+			user   int64
+			reason string
+		)
+
+		if e = rows.Scan(&user, &reason); e != nil {
+			return nil, e
+		}
+
+		if errs == nil {
+			errs = make(map[int64]string)
+		}
+
+		errs[user] = reason
+	}
+
+	return errs, rows.Err()
+}
+
+// recipientResults sums up the receipts of each user: delivered if any of its devices got the message, failed
+// if none did or its template could not be rendered, skipped if the user has no devices at all.
+// Topic messages only list users with devices.
+func recipientResults(users []int64, connectors map[string]*ConnectorStatus, errs map[int64]string) map[int64]string {
+
+	results := make(map[int64]string, len(users))
+
+	for _, user := range users {
+		results[user] = ResultSkipped
+	}
+
+	for _, connector := range connectors {
+		for _, receipt := range connector.Devices {
+			switch receipt.State {
+			case DeviceDelivered, DeviceCanonicalized:
+				results[receipt.User] = ResultDelivered
+			case DeviceValidated:
+				if results[receipt.User] != ResultDelivered {
+					results[receipt.User] = ResultValidated
+				}
+			default:
+				if results[receipt.User] != ResultDelivered && results[receipt.User] != ResultValidated {
+					results[receipt.User] = ResultFailed
+				}
+			}
+		}
+	}
+
+	for user := range errs {
+		if results[user] != ResultDelivered {
+			results[user] = ResultFailed
+		}
+	}
+
+	return results
+}
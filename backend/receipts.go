@@ -0,0 +1,113 @@
+/*  Pushed - a daemon for parallel handling of push operations to mobile devices
+ *  Copyright (C) 2014  Marco Cilloni <marco.cilloni@yahoo.com>
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *  Exhibit B is not attached; this software is compatible with the
+ *  licenses expressed under Section 1.12 of the MPL v2.
+ */
+
+package backend
+
+type DeviceState string
+
+const (
+	DeviceCanonicalized DeviceState = "canonicalized" //delivered, but the service replaced the token
+	DeviceDelivered     DeviceState = "delivered"
+	DeviceFailed        DeviceState = "failed"
+	DevicePending       DeviceState = "pending"
+	DeviceRemoved       DeviceState = "removed"   //the service rejected the token, which has been deleted
+	DeviceValidated     DeviceState = "validated" //dry run, the message was checked but not delivered
+)
+
+// Receipt is the outcome of a push to a single device of a connector
+type Receipt struct {
+	Token     string      `json:"token"`
+	User      int64       `json:"user"`
+	State     DeviceState `json:"state"`
+	MessageId string      `json:"message_id,omitempty"` //ID given to the message by the push service, if any
+	Canonical string      `json:"canonical,omitempty"`  //token that replaced this one
+	Reason    string      `json:"reason,omitempty"`
+}
+
+func newReceipts(tokens []string) []Receipt {
+
+	receipts := make([]Receipt, len(tokens))
+
+	for i, token := range tokens {
+		receipts[i] = Receipt{Token: token, State: DevicePending}
+	}
+
+	return receipts
+}
+
+// forUser tells which user owns the devices of receipts
+func forUser(receipts []Receipt, user int64) []Receipt {
+
+	for i := range receipts {
+		receipts[i].User = user
+	}
+
+	return receipts
+}
+
+func (receipt *Receipt) canonicalized(token string) {
+	receipt.State, receipt.Canonical = DeviceCanonicalized, token
+}
+
+func (receipt *Receipt) delivered(messageId string) {
+	receipt.State, receipt.MessageId = DeviceDelivered, messageId
+}
+
+func (receipt *Receipt) failed(reason string) {
+	receipt.State, receipt.Reason = DeviceFailed, reason
+}
+
+func (receipt *Receipt) removed(reason string) {
+	receipt.State, receipt.Reason = DeviceRemoved, reason
+}
+
+// settle gives a state to a receipt the connector left pending, from the outcome of its push
+func (receipt *Receipt) settle(e error) {
+
+	if receipt.State != DevicePending {
+		return
+	}
+
+	if e != nil {
+		receipt.failed(e.Error())
+	} else {
+		receipt.State = DeviceDelivered
+	}
+}
+
+// validated is for receipts of a dry run the service has accepted, which is all it tells
+func (receipt *Receipt) validated() {
+
+	if receipt.State == DeviceDelivered {
+		receipt.State, receipt.MessageId = DeviceValidated, ""
+	}
+}
+
+// validateAll settles the receipts of a dry run, which reaches no device
+func validateAll(receipts []Receipt) ([]Receipt, error) {
+
+	for i := range receipts {
+		if receipts[i].State == DevicePending {
+			receipts[i].State = DeviceValidated
+		}
+	}
+
+	return receipts, nil
+}
+
+// settleAll is for errors that hit every device at once, like a malformed payload
+func settleAll(receipts []Receipt, e error) ([]Receipt, error) {
+
+	for i := range receipts {
+		receipts[i].settle(e)
+	}
+
+	return receipts, e
+}
@@ -0,0 +1,273 @@
+/*  Pushed - a daemon for parallel handling of push operations to mobile devices
+ *  Copyright (C) 2014  Marco Cilloni <marco.cilloni@yahoo.com>
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *  Exhibit B is not attached; this software is compatible with the
+ *  licenses expressed under Section 1.12 of the MPL v2.
+ */
+
+package backend
+
+import (
+	"database/sql"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// sqliteStore keeps users and devices in an SQLite database file. The device cap is checked in transactions
+// that lock the database as soon as they begin.
+type sqliteStore struct {
+	conn *sql.DB
+}
+
+type sqliteDevices struct {
+	name   string
+	conn   *sql.DB
+	policy DevicePolicy
+}
+
+func dialSqlite(path string) (*sql.DB, error) {
+
+	log.Printf("Opening SQLite database %s...", path)
+
+	conn, e := sql.Open("sqlite3", "file:"+path+"?_foreign_keys=on&_busy_timeout=5000&_txlock=immediate")
+
+	if e != nil {
+		return nil, e
+	}
+
+	if e = conn.Ping(); e != nil {
+		conn.Close()
+		return nil, e
+	}
+
+	return conn, nil
+}
+
+func openSqlite(path string) (*sqliteStore, error) {
+
+	conn, e := dialSqlite(path)
+
+	if e != nil {
+		return nil, e
+	}
+
+	if e = checkSchema(conn, dialects[StorageSqlite], schemaShared); e != nil {
+		conn.Close()
+		return nil, e
+	}
+
+	return &sqliteStore{conn: conn}, nil
+}
+
+func (store *sqliteStore) AddUser(id int64) error {
+	log.Printf("Adding user %d...", id)
+
+	_, e := store.conn.Exec("INSERT INTO USERS VALUES (?)", id)
+
+	if sqliteErr, ok := e.(sqlite3.Error); ok && sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey {
+		return ErrUserExists
+	}
+
+	return e
+}
+
+func (store *sqliteStore) DelUser(id int64) error {
+	log.Printf("Deleting user %d...", id)
+
+	_, e := store.conn.Exec("DELETE FROM USERS WHERE ID = ?", id)
+
+	return e
+}
+
+func (store *sqliteStore) UserExists(id int64) (b bool, e error) {
+
+	e = store.conn.QueryRow("SELECT EXISTS (SELECT 1 FROM USERS WHERE ID = ?)", id).Scan(&b)
+
+	return
+}
+
+func (store *sqliteStore) Devices(instance string, policy DevicePolicy) (DeviceStore, error) {
+
+	name := deviceTableName(instance)
+
+	if e := checkSchema(store.conn, dialects[StorageSqlite], name); e != nil {
+		return nil, e
+	}
+
+	return &sqliteDevices{name: name, conn: store.conn, policy: policy}, nil
+}
+
+func (store *sqliteStore) Close() error {
+	return store.conn.Close()
+}
+
+func (t *sqliteDevices) Add(id int64, token, data string) error {
+	log.Printf("Adding %s token for %d", t.name, id)
+
+	tx, e := t.conn.Begin()
+
+	if e != nil {
+		return e
+	}
+
+	defer tx.Rollback()
+
+	var exists bool
+
+	if e = tx.QueryRow("SELECT EXISTS (SELECT 1 FROM "+t.name+" WHERE TOKEN = ?)", token).Scan(&exists); e != nil {
+		return e
+	}
+
+	if exists {
+		return ErrDeviceExists
+	}
+
+	rows, e := tx.Query("SELECT USERID, TOKEN, DATA, REGISTERED, LAST_SUCCESS FROM "+t.name+" WHERE USERID = ?", id)
+
+	if e != nil {
+		return e
+	}
+
+	devices, e := scanDevices(rows, deviceDefaultCap)
+
+	if e != nil && e != ErrNotRegistered {
+		return e
+	}
+
+	victims, e := t.policy.makeRoom(devices)
+
+	if e != nil {
+		return e
+	}
+
+	for _, victim := range victims {
+		if _, e = tx.Exec("DELETE FROM "+t.name+" WHERE TOKEN = ?", victim); e != nil {
+			return e
+		}
+	}
+
+	if _, e = tx.Exec("INSERT INTO "+t.name+" (USERID, TOKEN, DATA, REGISTERED) VALUES (?,?,?,?)", id, token, data, time.Now()); e != nil {
+		return e
+	}
+
+	return tx.Commit()
+}
+
+func (t *sqliteDevices) Delete(token string) error {
+
+	log.Printf("Deleting a %s token", t.name)
+
+	_, e := t.conn.Exec("DELETE FROM "+t.name+" WHERE TOKEN = ?", token)
+
+	return e
+}
+
+func (t *sqliteDevices) Exists(token string) (b bool, e error) {
+	e = t.conn.QueryRow("SELECT EXISTS (SELECT 1 FROM "+t.name+" WHERE TOKEN = ?)", token).Scan(&b)
+	return
+}
+
+func (t *sqliteDevices) Owner(token string) (user int64, found bool, e error) {
+
+	switch e = t.conn.QueryRow("SELECT USERID FROM "+t.name+" WHERE TOKEN = ?", token).Scan(&user); e {
+	case nil:
+		return user, true, nil
+	case sql.ErrNoRows:
+		return 0, false, nil
+	}
+
+	return
+}
+
+func (t *sqliteDevices) Subscribed(id int64) (b bool, e error) {
+	e = t.conn.QueryRow("SELECT EXISTS (SELECT 1 FROM "+t.name+" WHERE USERID = ?)", id).Scan(&b)
+	return
+}
+
+func (t *sqliteDevices) ForUser(id int64) ([]Device, error) {
+
+	rows, e := t.conn.Query("SELECT USERID, TOKEN, DATA, REGISTERED, LAST_SUCCESS FROM "+t.name+" WHERE USERID = ?", id)
+
+	if e != nil {
+		return nil, e
+	}
+
+	return scanDevices(rows, deviceDefaultCap)
+}
+
+func (t *sqliteDevices) ForUsers(ids []int64) ([]Device, error) {
+
+	if len(ids) == 0 {
+		return nil, ErrNotRegistered
+	}
+
+	args := make([]interface{}, len(ids))
+
+	for i, id := range ids {
+		args[i] = id
+	}
+
+	placeholders := strings.Repeat(",?", len(ids))[1:]
+
+	rows, e := t.conn.Query("SELECT USERID, TOKEN, DATA, REGISTERED, LAST_SUCCESS FROM "+t.name+" WHERE USERID IN ("+placeholders+") ORDER BY USERID", args...)
+
+	if e != nil {
+		return nil, e
+	}
+
+	return scanDevices(rows, len(ids))
+}
+
+func (t *sqliteDevices) SetData(token, data string) error {
+
+	_, e := t.conn.Exec("UPDATE "+t.name+" SET DATA = ? WHERE TOKEN = ?", data, token)
+
+	return e
+}
+
+func (t *sqliteDevices) UpdateToken(oldToken, newToken string) error {
+
+	result, e := t.conn.Exec("UPDATE "+t.name+" SET TOKEN = ? WHERE TOKEN = ?", newToken, oldToken)
+
+	if e != nil {
+		return e
+	}
+
+	rowsAffected, e := result.RowsAffected()
+
+	if e != nil {
+		return e
+	}
+
+	if rowsAffected > 1 {
+		log.Panicf("Database inconsistency found (%s token found twice or more)", t.name)
+	}
+
+	return nil
+}
+
+func (t *sqliteDevices) Succeeded(tokens []string, at time.Time) error {
+
+	if len(tokens) == 0 {
+		return nil
+	}
+
+	args := make([]interface{}, len(tokens)+1)
+	args[0] = at
+
+	for i, token := range tokens {
+		args[i+1] = token
+	}
+
+	placeholders := strings.Repeat(",?", len(tokens))[1:]
+
+	_, e := t.conn.Exec("UPDATE "+t.name+" SET LAST_SUCCESS = ? WHERE TOKEN IN ("+placeholders+")", args...)
+
+	return e
+}
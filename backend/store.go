@@ -0,0 +1,245 @@
+/*  Pushed - a daemon for parallel handling of push operations to mobile devices
+ *  Copyright (C) 2014  Marco Cilloni <marco.cilloni@yahoo.com>
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *  Exhibit B is not attached; this software is compatible with the
+ *  licenses expressed under Section 1.12 of the MPL v2.
+ */
+
+package backend
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"time"
+)
+
+const (
+	StoragePostgres = "postgres"
+	StorageSqlite   = "sqlite"
+	StorageMemory   = "memory"
+
+	EvictReject = "reject" //devices past the cap are refused
+	EvictOldest = "oldest" //the device registered first makes room
+	EvictLru    = "lru"    //the device that went longest without a successful push makes room
+)
+
+var (
+	ErrNeedsPostgres   = errors.New("This feature needs the postgres storage")
+	ErrTooManyDevices  = errors.New("The user has reached the device cap of this connector")
+	ErrUnknownEviction = errors.New("Unknown eviction policy, must be reject, oldest or lru")
+	ErrUnknownStorage  = errors.New("Unknown storage, must be postgres, sqlite or memory")
+	globalStore        Store
+)
+
+// Store keeps users and the devices they registered on each connector instance. The outbox, topics,
+// broadcasts, templates, clients and idempotency keys are only available with the Postgres store.
+type Store interface {
+	AddUser(id int64) error
+	DelUser(id int64) error
+	UserExists(id int64) (bool, error)
+	Devices(instance string, policy DevicePolicy) (DeviceStore, error) //opens the devices of a connector instance
+	Close() error
+}
+
+// DeviceStore keeps the devices of a connector instance. Add makes room for new devices as its DevicePolicy
+// says, and methods returning devices fail with ErrNotRegistered if there are none.
+type DeviceStore interface {
+	Add(user int64, token, data string) error
+	Delete(token string) error
+	Exists(token string) (bool, error)
+	Owner(token string) (user int64, found bool, e error) //the user that registered token
+	Subscribed(user int64) (bool, error)
+	ForUser(user int64) ([]Device, error)
+	ForUsers(users []int64) ([]Device, error) //sorted by user
+	SetData(token, data string) error
+	UpdateToken(oldToken, newToken string) error
+	Succeeded(tokens []string, at time.Time) error //records a successful push to the given devices
+}
+
+// Device is a token registered by a user, plus an opaque Data field connectors may use for per-device details
+// they need besides the token
+type Device struct {
+	User        int64
+	Token       string
+	Data        string
+	Registered  time.Time
+	LastSuccess time.Time //zero if no push reached it yet
+}
+
+// DevicePolicy limits the devices a user can have on a connector instance
+type DevicePolicy struct {
+	MaxDevices int    //deviceDefaultCap if 0
+	Eviction   string //EvictReject if empty
+}
+
+func (policy *DevicePolicy) Validate() error {
+
+	if policy.MaxDevices < 0 {
+		return errors.New("MaxDevices cannot be negative")
+	}
+
+	switch policy.Eviction {
+	case "", EvictReject, EvictOldest, EvictLru:
+		return nil
+	default:
+		return ErrUnknownEviction
+	}
+}
+
+func (policy *DevicePolicy) maxDevices() int {
+
+	if policy.MaxDevices == 0 {
+		return deviceDefaultCap
+	}
+
+	return policy.MaxDevices
+}
+
+// makeRoom returns the tokens to delete before the user owning devices registers another one, evicting as
+// many as needed if the cap was lowered, or ErrTooManyDevices if the policy is to reject
+func (policy *DevicePolicy) makeRoom(devices []Device) ([]string, error) {
+
+	excess := len(devices) - policy.maxDevices() + 1
+
+	if excess <= 0 {
+		return nil, nil
+	}
+
+	if policy.Eviction == "" || policy.Eviction == EvictReject {
+		return nil, ErrTooManyDevices
+	}
+
+	victims := append([]Device(nil), devices...)
+
+	sort.SliceStable(victims, func(i, j int) bool {
+		return policy.lastUsed(&victims[i]).Before(policy.lastUsed(&victims[j]))
+	})
+
+	log.Printf("Evicting %d devices of user %d, policy %s", excess, devices[0].User, policy.Eviction)
+
+	return deviceTokens(victims[:excess]), nil
+}
+
+func (policy *DevicePolicy) lastUsed(dev *Device) time.Time {
+
+	if policy.Eviction == EvictLru && !dev.LastSuccess.IsZero() {
+		return dev.LastSuccess
+	}
+
+	return dev.Registered
+}
+
+// OpenStore opens the store of the given kind, source being a connection string for Postgres, the path of
+// the database file for SQLite and the path of the snapshot file, if any, for memory (see OpenMemoryStore)
+func OpenStore(kind, source string) error {
+
+	switch kind {
+	case "", StoragePostgres:
+
+		db, e := dialDb(source)
+
+		if e != nil {
+			return e
+		}
+
+		globalDb, globalStore = db, db
+
+	case StorageSqlite:
+
+		store, e := openSqlite(source)
+
+		if e != nil {
+			return e
+		}
+
+		globalDb, globalStore = nil, store
+
+	case StorageMemory:
+		return OpenMemoryStore(source, 0)
+
+	default:
+		return ErrUnknownStorage
+	}
+
+	return nil
+}
+
+func CloseStore() error {
+	return globalStore.Close()
+}
+
+// UsesPostgres tells if the features needing the Postgres store are available
+func UsesPostgres() bool {
+	return globalDb != nil
+}
+
+func needsPostgres() error {
+
+	if globalDb == nil {
+		return ErrNeedsPostgres
+	}
+
+	return nil
+}
+
+func AddUser(id int64) error {
+	return globalStore.AddUser(id)
+}
+
+func DelUser(id int64) error {
+	return globalStore.DelUser(id)
+}
+
+func Exists(id int64) (bool, error) {
+	return globalStore.UserExists(id)
+}
+
+func userTokens(devices DeviceStore, user int64) ([]string, error) {
+
+	found, e := devices.ForUser(user)
+
+	if e != nil {
+		return nil, e
+	}
+
+	return deviceTokens(found), nil
+}
+
+// devicesExcept returns the devices of users whose tokens are not in reached, or ErrNotRegistered if none is left
+func devicesExcept(devices DeviceStore, users []int64, reached map[string]bool) ([]Device, error) {
+
+	found, e := devices.ForUsers(users)
+
+	if e != nil {
+		return nil, e
+	}
+
+	left := found[:0]
+
+	for _, dev := range found {
+		if !reached[dev.Token] {
+			left = append(left, dev)
+		}
+	}
+
+	if len(left) == 0 {
+		return nil, ErrNotRegistered
+	}
+
+	return left, nil
+}
+
+func deviceTokens(devices []Device) []string {
+
+	tokens := make([]string, len(devices))
+
+	for i, dev := range devices {
+		tokens[i] = dev.Token
+	}
+
+	return tokens
+}
@@ -0,0 +1,442 @@
+/*  Pushed - a daemon for parallel handling of push operations to mobile devices
+ *  Copyright (C) 2014  Marco Cilloni <marco.cilloni@yahoo.com>
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *  Exhibit B is not attached; this software is compatible with the
+ *  licenses expressed under Section 1.12 of the MPL v2.
+ */
+
+package backend
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	DefaultLocale = "default" //used by users without a locale, and when a template lacks the locale of a user
+)
+
+var (
+	ErrInvalidLocale       = errors.New("Locales must be default or look like en, en-US or en_US")
+	ErrInvalidTemplateName = errors.New("Template names must match [a-zA-Z0-9-_.]+")
+	ErrUnknownTemplate     = errors.New("No template with the given name")
+	localeRegexp           = regexp.MustCompile(`^[a-zA-Z]{2,8}([-_][a-zA-Z0-9]{1,8})*$`)
+	templateNameRegexp     = regexp.MustCompile(`^[a-zA-Z0-9\-_.]{1,255}$`)
+	templateFuncs          = template.FuncMap{"json": templateJson}
+)
+
+// Template renders, for each user, the JSON of a message like the data line of PUSH
+type Template struct {
+	Name   string `json:"name"`
+	Locale string `json:"locale"`
+	Body   string `json:"body"`
+}
+
+// templateContext is what templates get as their dot
+type templateContext struct {
+	User   int64
+	Locale string
+	Vars   map[string]interface{}
+}
+
+// templateGroup holds the users a template rendered the same message for, so they can be pushed together
+type templateGroup struct {
+	message Message
+	users   []int64
+}
+
+func ValidLocale(locale string) bool {
+	return locale == DefaultLocale || localeRegexp.MatchString(locale)
+}
+
+func ValidTemplateName(name string) bool {
+	return templateNameRegexp.MatchString(name)
+}
+
+// templateJson lets templates put values in the JSON they render without breaking it, as in {{json .Vars.name}}
+func templateJson(value interface{}) (string, error) {
+
+	encoded, e := json.Marshal(value)
+
+	return string(encoded), e
+}
+
+func parseTemplate(name, body string) (*template.Template, error) {
+	return template.New(name).Funcs(templateFuncs).Option("missingkey=error").Parse(body)
+}
+
+// Validate checks the name, the locale and the syntax of tpl
+func (tpl *Template) Validate() error {
+
+	if !ValidTemplateName(tpl.Name) {
+		return ErrInvalidTemplateName
+	}
+
+	if !ValidLocale(tpl.Locale) {
+		return ErrInvalidLocale
+	}
+
+	_, e := parseTemplate(tpl.Name, tpl.Body)
+
+	return e
+}
+
+// SetTemplate stores a template, replacing the one with the same name and locale
+func SetTemplate(tpl *Template) error {
+
+	if e := needsPostgres(); e != nil {
+		return e
+	}
+
+	if e := tpl.Validate(); e != nil {
+		return e
+	}
+
+	log.Printf("Setting template %s for locale %s", tpl.Name, tpl.Locale)
+
+	_, e := globalDb.conn.Exec(`INSERT INTO TEMPLATES VALUES ($1,$2,$3)
+		ON CONFLICT (NAME, LOCALE) DO UPDATE SET BODY = EXCLUDED.BODY`, tpl.Name, tpl.Locale, tpl.Body)
+
+	return e
+}
+
+func GetTemplate(name, locale string) (*Template, error) {
+
+	if e := needsPostgres(); e != nil {
+		return nil, e
+	}
+
+	tpl := &Template{Name: name, Locale: locale}
+
+	e := globalDb.conn.QueryRow("SELECT BODY FROM TEMPLATES WHERE NAME = $1 AND LOCALE = $2", name, locale).Scan(&tpl.Body)
+
+	if e == sql.ErrNoRows {
+		return nil, ErrUnknownTemplate
+	}
+
+	if e != nil {
+		return nil, e
+	}
+
+	return tpl, nil
+}
+
+// DelTemplate deletes a locale of a template, or all of them if locale is empty
+func DelTemplate(name, locale string) (e error) {
+
+	if e = needsPostgres(); e != nil {
+		return
+	}
+
+	log.Printf("Deleting template %s for locale %s", name, locale)
+
+	if locale == "" {
+		_, e = globalDb.conn.Exec("DELETE FROM TEMPLATES WHERE NAME = $1", name)
+	} else {
+		_, e = globalDb.conn.Exec("DELETE FROM TEMPLATES WHERE NAME = $1 AND LOCALE = $2", name, locale)
+	}
+
+	return
+}
+
+// SetLocale sets the locale templates are rendered in for user. DefaultLocale clears it.
+func SetLocale(user int64, locale string) error {
+
+	if e := needsPostgres(); e != nil {
+		return e
+	}
+
+	if !ValidLocale(locale) {
+		return ErrInvalidLocale
+	}
+
+	value := sql.NullString{String: locale, Valid: locale != DefaultLocale}
+
+	res, e := globalDb.conn.Exec("UPDATE USERS SET LOCALE = $2 WHERE ID = $1", user, value)
+
+	if e != nil {
+		return e
+	}
+
+	if n, e := res.RowsAffected(); e != nil || n == 0 {
+
+		if e == nil {
+			e = ErrUserNotExisting
+		}
+
+		return e
+	}
+
+	return nil
+}
+
+// EnqueueTemplate is like EnqueueAt, but the message is rendered from a template for each user on delivery,
+// so it always has the latest copy of the template
+func EnqueueTemplate(users []int64, name string, vars map[string]interface{}, at time.Time) (id int64, e error) {
+
+	if e = needsPostgres(); e != nil {
+		return
+	}
+
+	users = uniqueUsers(users)
+
+	switch {
+	case len(users) == 0:
+		return 0, ErrNoRecipients
+	case len(users) > MaxRecipients:
+		return 0, ErrTooManyRecipients
+	}
+
+	var found bool
+
+	if e = globalDb.conn.QueryRow("SELECT EXISTS (SELECT 1 FROM TEMPLATES WHERE NAME = $1)", name).Scan(&found); e != nil {
+		return
+	}
+
+	if !found {
+		return 0, ErrUnknownTemplate
+	}
+
+	data, e := json.Marshal(vars)
+
+	if e != nil {
+		return
+	}
+
+	return enqueue(users, sql.NullString{}, sql.NullString{String: name, Valid: true}, data, at)
+}
+
+// templateLocales tries the locale of a user, then its language and then DefaultLocale
+func templateLocales(locale string) []string {
+
+	if locale == "" || locale == DefaultLocale {
+		return []string{DefaultLocale}
+	}
+
+	tried := []string{locale}
+
+	if i := strings.IndexAny(locale, "-_"); i > 0 {
+		tried = append(tried, locale[:i])
+	}
+
+	return append(tried, DefaultLocale)
+}
+
+// renderTemplate renders the message of each user, and groups the users that got the same one.
+// Users whose message could not be rendered are returned with the reason, without affecting the others.
+func renderTemplate(name string, data []byte, users []int64) ([]*templateGroup, map[int64]string, error) {
+
+	var vars map[string]interface{}
+
+	if e := decodeJson(data, &vars, false); e != nil {
+		return nil, nil, e
+	}
+
+	bodies, e := templateBodies(name)
+
+	if e != nil {
+		return nil, nil, e
+	}
+
+	userLocales, e := localesOf(users)
+
+	if e != nil {
+		return nil, nil, e
+	}
+
+	groups, failures := renderMessages(name, bodies, userLocales, vars, users)
+
+	return groups, failures, nil
+}
+
+// renderMessages renders the template with the given body for each locale, see renderTemplate
+func renderMessages(name string, bodies map[string]string, userLocales map[int64]string, vars map[string]interface{},
+	users []int64) ([]*templateGroup, map[int64]string) {
+
+	var (
+		context  = templateContext{Vars: vars}
+		e        error
+		groups   = make(map[string]*templateGroup)
+		ordered  []*templateGroup
+		failures = make(map[int64]string)
+		parsed   = make(map[string]*template.Template)
+	)
+
+	for _, user := range users {
+
+		var (
+			tpl    *template.Template
+			locale string
+		)
+
+		for _, locale = range templateLocales(userLocales[user]) {
+
+			if tpl = parsed[locale]; tpl != nil {
+				break
+			}
+
+			if body, ok := bodies[locale]; ok {
+
+				if tpl, e = parseTemplate(name, body); e != nil {
+					failures[user] = e.Error()
+				}
+
+				parsed[locale] = tpl
+
+				break
+			}
+		}
+
+		if tpl == nil {
+
+			if _, failed := failures[user]; !failed {
+				failures[user] = "Template " + name + " has no locale fitting " + strings.Join(templateLocales(userLocales[user]), ", ")
+			}
+
+			continue
+		}
+
+		var rendered bytes.Buffer
+
+		context.User, context.Locale = user, locale
+
+		if e = tpl.Execute(&rendered, &context); e != nil {
+			failures[user] = e.Error()
+			continue
+		}
+
+		key := rendered.String()
+
+		if group, ok := groups[key]; ok {
+			group.users = append(group.users, user)
+			continue
+		}
+
+		group := &templateGroup{users: []int64{user}}
+
+		if e = json.Unmarshal(rendered.Bytes(), &group.message); e == nil {
+			e = group.message.Options.Validate()
+		}
+
+		if e != nil {
+			failures[user] = "Template rendered an invalid message: " + e.Error()
+			continue
+		}
+
+		groups[key] = group
+		ordered = append(ordered, group)
+	}
+
+	return ordered, failures
+}
+
+func templateBodies(name string) (map[string]string, error) {
+
+	rows, e := globalDb.conn.Query("SELECT LOCALE, BODY FROM TEMPLATES WHERE NAME = $1", name)
+
+	if e != nil {
+		return nil, e
+	}
+
+	defer rows.Close()
+
+	bodies := make(map[string]string)
+
+	for rows.Next() {
+
+		var locale, body string
+
+		if e = rows.Scan(&locale, &body); e != nil {
+			return nil, e
+		}
+
+		bodies[locale] = body
+	}
+
+	return bodies, rows.Err()
+}
+
+// localesOf returns the locale of each of users that has one
+func localesOf(users []int64) (map[int64]string, error) {
+
+	rows, e := globalDb.conn.Query("SELECT ID, LOCALE FROM USERS WHERE ID = ANY($1) AND LOCALE IS NOT NULL", pq.Array(users))
+
+	if e != nil {
+		return nil, e
+	}
+
+	defer rows.Close()
+
+	userLocales := make(map[int64]string, len(users))
+
+	for rows.Next() {
+
+		var (
+			user   int64
+			locale string
+		)
+
+		if e = rows.Scan(&user, &locale); e != nil {
+			return nil, e
+		}
+
+		userLocales[user] = locale
+	}
+
+	return userLocales, rows.Err()
+}
+
+// pushTemplate renders msg for its users and pushes each group of them with the same message. It also returns
+// the users the template could not be rendered for.
+func pushTemplate(msg *queuedMessage, resume map[string]*progress) (map[string]*pushResult, map[int64]string, error) {
+
+	groups, failures, e := renderTemplate(msg.template.String, msg.vars, msg.users)
+
+	if e != nil {
+		return nil, nil, e
+	}
+
+	results := make(map[string]*pushResult)
+
+	for _, group := range groups {
+		for name, res := range pushEach(group.users, group.message, resume) {
+
+			if merged, ok := results[name]; ok {
+				merged.merge(*res)
+			} else {
+				results[name] = res
+			}
+		}
+	}
+
+	return results, failures, nil
+}
+
+// recordTemplateErrors replaces the users the template of message id could not be rendered for
+func recordTemplateErrors(tx *sql.Tx, id int64, failures map[int64]string) error {
+
+	if _, e := tx.Exec("DELETE FROM OUTBOXUSERS WHERE MESSAGE = $1", id); e != nil { //failures of a previous attempt
+		return e
+	}
+
+	for user, reason := range failures {
+		if _, e := tx.Exec(`INSERT INTO OUTBOXUSERS (MESSAGE, USERID, ERROR) VALUES ($1,$2,$3)
+			ON CONFLICT (MESSAGE, USERID) DO UPDATE SET ERROR = EXCLUDED.ERROR`, id, user, reason); e != nil {
+			return e
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,199 @@
+/*  Pushed - a daemon for parallel handling of push operations to mobile devices
+ *  Copyright (C) 2014  Marco Cilloni <marco.cilloni@yahoo.com>
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *  Exhibit B is not attached; this software is compatible with the
+ *  licenses expressed under Section 1.12 of the MPL v2.
+ */
+
+package backend
+
+import (
+	"errors"
+	"log"
+	"regexp"
+)
+
+const (
+	topicPageSize = 1000 //subscribers fetched and pushed at once by a topic fan-out
+)
+
+var (
+	ErrInvalidTopic = errors.New("Topic names must match [a-zA-Z0-9-_.~%]+")
+	topicNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9\-_.~%]{1,900}$`)
+)
+
+func ValidTopicName(topic string) bool {
+	return topicNameRegexp.MatchString(topic)
+}
+
+func TopicSubscribe(user int64, topic string) error {
+
+	if e := needsPostgres(); e != nil {
+		return e
+	}
+
+	if !ValidTopicName(topic) {
+		return ErrInvalidTopic
+	}
+
+	log.Printf("Subscribing %d to topic %s", user, topic)
+
+	_, e := globalDb.topicSubStmt.Exec(user, topic)
+
+	return e
+}
+
+func TopicUnsubscribe(user int64, topic string) error {
+
+	if e := needsPostgres(); e != nil {
+		return e
+	}
+
+	log.Printf("Unsubscribing %d from topic %s", user, topic)
+
+	_, e := globalDb.topicUnsubStmt.Exec(user, topic)
+
+	return e
+}
+
+func TopicList(user int64) ([]string, error) {
+
+	if e := needsPostgres(); e != nil {
+		return nil, e
+	}
+
+	rows, e := globalDb.topicListStmt.Query(user)
+
+	if e != nil {
+		return nil, e
+	}
+
+	defer rows.Close()
+
+	var topics []string
+
+	for rows.Next() {
+
+		var topic string
+
+		if e = rows.Scan(&topic); e != nil {
+			return nil, e
+		}
+
+		topics = append(topics, topic)
+	}
+
+	return topics, rows.Err()
+}
+
+// topicPage returns up to topicPageSize subscribers of topic with an ID greater than after, sorted
+func (db *db) topicPage(topic string, after int64) ([]int64, error) {
+
+	rows, e := db.topicPageStmt.Query(topic, after, topicPageSize)
+
+	if e != nil {
+		return nil, e
+	}
+
+	defer rows.Close()
+
+	users := make([]int64, 0, topicPageSize)
+
+	for rows.Next() {
+
+		var user int64
+
+		if e = rows.Scan(&user); e != nil {
+			return nil, e
+		}
+
+		users = append(users, user)
+	}
+
+	return users, rows.Err()
+}
+
+// pushTopic fans msg out to the subscribers of its topic, a page at a time so that multicast connectors can
+// coalesce the devices of a whole page in a few requests. Each page is recorded as soon as it is pushed, so a
+// pass that stops halfway is resumed after the last page recorded instead of starting over.
+func pushTopic(msg *queuedMessage, resume map[string]*progress) (results map[string]*pushResult, e error) {
+
+	if msg.lastUser < 0 {
+		results = make(map[string]*pushResult)
+	} else if results, e = passResults(msg.id); e != nil {
+		return
+	}
+
+	for after := msg.lastUser; ; {
+
+		users, e := globalDb.topicPage(msg.topic.String, after)
+
+		if e != nil {
+			return nil, e
+		}
+
+		if len(users) == 0 {
+			break
+		}
+
+		page := pushEach(users, msg.message, resume)
+
+		for name, res := range page {
+
+			if merged, ok := results[name]; ok {
+				merged.merge(pushResult{e: res.e})
+			} else {
+				results[name] = &pushResult{name: name, e: res.e} //receipts are recorded with their page
+			}
+		}
+
+		after = users[len(users)-1]
+
+		if e = recordPage(msg, results, page, after); e != nil {
+			return nil, e
+		}
+	}
+
+	return results, nil
+}
+
+func (db *db) prepareTopics() (e error) {
+
+	c := db.conn
+
+	if db.topicSubStmt, e = c.Prepare("INSERT INTO TOPICS VALUES ($1,$2) ON CONFLICT DO NOTHING"); e != nil {
+		return
+	}
+
+	if db.topicUnsubStmt, e = c.Prepare("DELETE FROM TOPICS WHERE USERID = $1 AND TOPIC = $2"); e != nil {
+		return
+	}
+
+	if db.topicListStmt, e = c.Prepare("SELECT TOPIC FROM TOPICS WHERE USERID = $1 ORDER BY TOPIC"); e != nil {
+		return
+	}
+
+	db.topicPageStmt, e = c.Prepare("SELECT USERID FROM TOPICS WHERE TOPIC = $1 AND USERID > $2 ORDER BY USERID LIMIT $3")
+
+	return
+}
+
+func (db *db) closeTopics() (e error) {
+
+	if e = db.topicSubStmt.Close(); e != nil {
+		return
+	}
+
+	if e = db.topicUnsubStmt.Close(); e != nil {
+		return
+	}
+
+	if e = db.topicListStmt.Close(); e != nil {
+		return
+	}
+
+	return db.topicPageStmt.Close()
+}
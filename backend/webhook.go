@@ -0,0 +1,483 @@
+/*  Pushed - a daemon for parallel handling of push operations to mobile devices
+ *  Copyright (C) 2014  Marco Cilloni <marco.cilloni@yahoo.com>
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *  Exhibit B is not attached; this software is compatible with the
+ *  licenses expressed under Section 1.12 of the MPL v2.
+ */
+
+package backend
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	WebhookDefaultMaxFailures        = 5
+	WebhookDefaultMaxHttpConns       = 5
+	WebhookDefaultMaxSleepBeforeFail = 8 * time.Second
+	WebhookDefaultSignatureHeader    = "X-Pushed-Signature"
+	WebhookDefaultTimeout            = 10 * time.Second
+)
+
+var (
+	WebhookForbiddenHost       = errors.New("Webhook target is a loopback, private or link-local address missing from AllowedHosts")
+	WebhookInvalidUrl          = errors.New("Webhook target must be an absolute http or https URL")
+	WebhookInternalServerError = errors.New("Webhook target replied with an internal server error.")
+	WebhookTimeoutError        = errors.New("Timeout or webhook target unavailable.")
+	WebhookWontTryAgain        = errors.New("Connector has given up with message delivery")
+)
+
+type WebhookConfig struct {
+	Secret          string //HMAC-SHA256 key shared with the receivers
+	SignatureHeader string
+	MaxFailures     int //consecutive 4xx replies before a URL is unregistered
+	Timeout         time.Duration
+	MaxTcpConns     int
+	MaxRetryTime    time.Duration
+	AllowedHosts    []string //host names and CIDRs that can be targeted even if not public, like "10.0.0.0/8"
+}
+
+type webhook struct {
+	client          *http.Client
+	devices         DeviceStore
+	hosts           *webhookHosts
+	maxFailures     int
+	maxSleep        time.Duration
+	secret          []byte
+	signatureHeader string
+}
+
+// webhookPayload keeps the data under message, like before options existed, and hands the options over as they are
+type webhookPayload struct {
+	User         int64                  `json:"user"`
+	Message      map[string]interface{} `json:"message"`
+	Notification *Notification          `json:"notification,omitempty"`
+	Options      *PushOptions           `json:"options,omitempty"`
+}
+
+// webhookHosts keeps webhooks from reaching the hosts around pushed, unless they have been explicitly allowed
+type webhookHosts struct {
+	names map[string]bool
+	nets  []*net.IPNet
+}
+
+type webhookOpData struct {
+	Delay    time.Duration
+	Target   Device
+	Receipt  *Receipt
+	Data     []byte
+	Response *http.Response
+}
+
+func init() {
+	RegisterConnectorFactory("webhook", func(name string, settings json.RawMessage) (Connector, error) {
+
+		var config WebhookConfig
+
+		if e := json.Unmarshal(settings, &config); e != nil {
+			return nil, e
+		}
+
+		if config.Secret == "" {
+			return nil, errors.New("Webhook config object set but no Secret field set")
+		}
+
+		config.MaxRetryTime *= time.Second
+		config.Timeout *= time.Second
+
+		return newWebhook(name, &config)
+	})
+}
+
+func newWebhook(name string, config *WebhookConfig) (*webhook, error) {
+
+	if config.MaxFailures == 0 {
+		config.MaxFailures = WebhookDefaultMaxFailures
+	}
+
+	if config.MaxTcpConns == 0 {
+		config.MaxTcpConns = WebhookDefaultMaxHttpConns
+	}
+
+	if config.MaxRetryTime == 0 {
+		config.MaxRetryTime = WebhookDefaultMaxSleepBeforeFail
+	}
+
+	if config.SignatureHeader == "" {
+		config.SignatureHeader = WebhookDefaultSignatureHeader
+	}
+
+	if config.Timeout == 0 {
+		config.Timeout = WebhookDefaultTimeout
+	}
+
+	hosts, e := newWebhookHosts(config.AllowedHosts)
+
+	if e != nil {
+		return nil, e
+	}
+
+	devices, e := openDevices(name)
+
+	if e != nil {
+		return nil, e
+	}
+
+	return &webhook{
+		client: &http.Client{
+			Timeout: config.Timeout,
+			Transport: &http.Transport{
+				DialContext:         hosts.dial,
+				MaxIdleConnsPerHost: config.MaxTcpConns,
+			},
+		},
+		devices:         devices,
+		hosts:           hosts,
+		maxFailures:     config.MaxFailures,
+		maxSleep:        config.MaxRetryTime,
+		secret:          []byte(config.Secret),
+		signatureHeader: config.SignatureHeader,
+	}, nil
+
+}
+
+func (wh *webhook) Exists(deviceTargetId string) (bool, error) {
+
+	return wh.devices.Exists(deviceTargetId)
+
+}
+
+func (wh *webhook) Owner(deviceTargetId string) (int64, bool, error) {
+
+	return wh.devices.Owner(deviceTargetId)
+
+}
+
+func (wh *webhook) Push(user int64, message Message) ([]Receipt, error) {
+
+	targets, e := wh.devices.ForUser(user)
+
+	if e != nil {
+		return nil, e
+	}
+
+	return wh.targetsPush(user, targets, message)
+
+}
+
+// PushExcept pushes to the URLs of users that are not in reached
+func (wh *webhook) PushExcept(users []int64, message Message, reached map[string]bool) ([]Receipt, error) {
+
+	targets, e := devicesExcept(wh.devices, users, reached)
+
+	if e != nil {
+		return nil, e
+	}
+
+	return pushGroups(targets, func(user int64, targets []Device) ([]Receipt, error) {
+		return wh.targetsPush(user, targets, message)
+	})
+
+}
+
+func (wh *webhook) targetsPush(user int64, targets []Device, message Message) ([]Receipt, error) {
+
+	receipts := make([]Receipt, len(targets))
+
+	for i, target := range targets {
+		receipts[i] = Receipt{Token: target.Token, State: DevicePending}
+	}
+
+	options := &message.Options
+
+	if *options == (PushOptions{}) {
+		options = nil
+	}
+
+	payload, e := json.Marshal(&webhookPayload{User: user, Message: message.Data, Notification: message.Notification, Options: options})
+
+	if e != nil {
+		return settleAll(receipts, e)
+	}
+
+	if message.Options.DryRun {
+		return validateAll(receipts)
+	}
+
+	errChan := make(chan error, len(targets))
+
+	for i := range targets {
+		go func(target Device, receipt *Receipt) {
+
+			e := wh.payloadPush(target, receipt, payload, time.Second)
+
+			receipt.settle(e)
+
+			errChan <- e
+		}(targets[i], &receipts[i])
+	}
+
+	var err error
+
+	for range targets {
+		if e := <-errChan; e != nil && err == nil {
+			err = e
+		}
+	}
+
+	return receipts, err
+
+}
+
+func (wh *webhook) Register(user int64, deviceTargetId string) error {
+
+	u, e := url.Parse(deviceTargetId)
+
+	if e != nil || !u.IsAbs() || u.Scheme != "http" && u.Scheme != "https" || u.Hostname() == "" {
+		return WebhookInvalidUrl
+	}
+
+	if e = wh.hosts.check(u.Hostname()); e != nil {
+		return e
+	}
+
+	return wh.devices.Add(user, deviceTargetId, "")
+
+}
+
+func (wh *webhook) Subscribed(user int64) (bool, error) {
+	return wh.devices.Subscribed(user)
+}
+
+func (wh *webhook) Unregister(deviceTargetId string) error {
+
+	return wh.devices.Delete(deviceTargetId)
+
+}
+
+func newWebhookHosts(allowed []string) (*webhookHosts, error) {
+
+	hosts := &webhookHosts{names: make(map[string]bool)}
+
+	for _, host := range allowed {
+
+		if !strings.Contains(host, "/") {
+			hosts.names[strings.ToLower(host)] = true
+			continue
+		}
+
+		_, ipNet, e := net.ParseCIDR(host)
+
+		if e != nil {
+			return nil, errors.New("Invalid AllowedHosts entry " + host + ": " + e.Error())
+		}
+
+		hosts.nets = append(hosts.nets, ipNet)
+	}
+
+	return hosts, nil
+}
+
+// allowsIP tells if ip is public, or in one of the allowed networks
+func (hosts *webhookHosts) allowsIP(ip net.IP) bool {
+
+	if !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() &&
+		!ip.IsInterfaceLocalMulticast() && !ip.IsMulticast() && !ip.IsUnspecified() {
+		return true
+	}
+
+	for _, ipNet := range hosts.nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+
+	return hosts.names[ip.String()]
+}
+
+// check refuses host if it is not allowed by name and any of its addresses is not allowed
+func (hosts *webhookHosts) check(host string) error {
+
+	if hosts.names[strings.ToLower(host)] {
+		return nil
+	}
+
+	ips, e := net.LookupIP(host)
+
+	if e != nil {
+		return e
+	}
+
+	for _, ip := range ips {
+		if !hosts.allowsIP(ip) {
+			return WebhookForbiddenHost
+		}
+	}
+
+	return nil
+}
+
+// dial checks again the address a target resolves to right before connecting, as it may have changed since Register
+func (hosts *webhookHosts) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+
+	dialer := &net.Dialer{Timeout: WebhookDefaultTimeout}
+
+	if host, _, e := net.SplitHostPort(addr); e != nil || !hosts.names[strings.ToLower(host)] {
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+
+			host, _, e := net.SplitHostPort(address)
+
+			if ip := net.ParseIP(host); e != nil || ip == nil || !hosts.allowsIP(ip) {
+				return WebhookForbiddenHost
+			}
+
+			return nil
+		}
+	}
+
+	return dialer.DialContext(ctx, network, addr)
+}
+
+func (wh *webhook) sign(payload []byte) string {
+
+	mac := hmac.New(sha256.New, wh.secret)
+	mac.Write(payload)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (wh *webhook) expRetry(opData *webhookOpData) error {
+
+	if opData.Delay > wh.maxSleep {
+		return WebhookWontTryAgain
+	}
+
+	sleep := opData.Delay
+
+	if 2*opData.Delay > wh.maxSleep {
+		sleep = wh.maxSleep
+	}
+
+	time.Sleep(sleep)
+
+	return wh.payloadPush(opData.Target, opData.Receipt, opData.Data, 2*opData.Delay)
+
+}
+
+// failed counts consecutive client errors in the DATA field of the target, and drops it once they exceed the threshold
+func (wh *webhook) failed(target Device, receipt *Receipt, status string) error {
+
+	failures, _ := strconv.Atoi(target.Data)
+	failures++
+
+	if failures >= wh.maxFailures {
+		log.Printf("Webhook %s replied %s %d times in a row and has been deleted.", target.Token, status, failures)
+		receipt.removed(status)
+		return wh.devices.Delete(target.Token)
+	}
+
+	if e := wh.devices.SetData(target.Token, strconv.Itoa(failures)); e != nil {
+		return e
+	}
+
+	return errors.New("Webhook " + target.Token + " replied " + status)
+}
+
+func (wh *webhook) evalResponse(opData *webhookOpData) error {
+
+	res := opData.Response
+
+	defer res.Body.Close()
+
+	switch {
+	case res.StatusCode >= 200 && res.StatusCode <= 299:
+
+		opData.Receipt.delivered("")
+
+		if opData.Target.Data != "" && opData.Target.Data != "0" {
+			return wh.devices.SetData(opData.Target.Token, "0")
+		}
+
+		return nil
+
+	case res.StatusCode == 408, res.StatusCode == 429:
+		log.Println("Webhook target is throttling, beginning exponential retry")
+
+		if e := wh.expRetry(opData); e != WebhookWontTryAgain {
+			return e
+		}
+
+		return WebhookTimeoutError
+
+	case res.StatusCode >= 400 && res.StatusCode <= 499:
+		return wh.failed(opData.Target, opData.Receipt, res.Status)
+
+	case res.StatusCode == 500:
+		log.Println("Webhook internal server error, beginning exponential retry")
+
+		if e := wh.expRetry(opData); e != WebhookWontTryAgain {
+			return e
+		}
+
+		return WebhookInternalServerError
+
+	case res.StatusCode >= 501 && res.StatusCode <= 599:
+		log.Println("Webhook timeout, beginning exponential retry")
+
+		if e := wh.expRetry(opData); e != WebhookWontTryAgain {
+			return e
+		}
+
+		return WebhookTimeoutError
+
+	default:
+		return errors.New("Webhook " + opData.Target.Token + " replied " + res.Status)
+	}
+
+}
+
+func (wh *webhook) payloadPush(target Device, receipt *Receipt, payload []byte, retryTime time.Duration) error {
+
+	req, e := http.NewRequest("POST", target.Token, bytes.NewReader(payload))
+
+	if e != nil {
+		return e
+	}
+
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add(wh.signatureHeader, wh.sign(payload))
+
+	res, e := wh.client.Do(req)
+
+	if e != nil {
+		return e
+	}
+
+	opData := &webhookOpData{
+		Delay:    retryTime,
+		Target:   target,
+		Receipt:  receipt,
+		Data:     payload,
+		Response: res,
+	}
+
+	return wh.evalResponse(opData)
+
+}
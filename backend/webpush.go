@@ -0,0 +1,663 @@
+/*  Pushed - a daemon for parallel handling of push operations to mobile devices
+ *  Copyright (C) 2014  Marco Cilloni <marco.cilloni@yahoo.com>
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *  Exhibit B is not attached; this software is compatible with the
+ *  licenses expressed under Section 1.12 of the MPL v2.
+ */
+
+package backend
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	WebPushDefaultMaxHttpConns       = 5
+	WebPushDefaultMaxSleepBeforeFail = 8 * time.Second
+	WebPushDefaultTimeout            = 10 * time.Second
+	WebPushDefaultTtl                = 24 * 60 * 60
+	webPushMaxPayloadSize            = 4096
+	webPushRecordSize                = 4096
+	webPushVapidLifetime             = 12 * time.Hour
+	webPushVapidSlack                = time.Hour
+)
+
+var (
+	WebPushForbiddenHost        = errors.New("Web push endpoint is a loopback, private or link-local address missing from AllowedHosts")
+	WebPushInternalServerError  = errors.New("Push service internal server error.")
+	WebPushInvalidSubscription  = errors.New("Malformed web push subscription (expected the PushSubscription JSON with endpoint, p256dh and auth)")
+	WebPushInvalidVapidKey      = errors.New("VAPID PrivateKey must be a base64url encoded P-256 private key")
+	WebPushMessageTooLargeError = errors.New("Encrypted message is bigger than 4 KiBs (4096 bytes)")
+	WebPushTimeoutError         = errors.New("Timeout or push service unavailable.")
+	WebPushTooManyRequestsError = errors.New("Push service is throttling requests.")
+	WebPushWontTryAgain         = errors.New("Connector has given up with message delivery")
+)
+
+type WebPushConfig struct {
+	PrivateKey   string //VAPID private key, base64url encoded like the web-push tools generate it
+	Subject      string //VAPID contact, mailto: or https: URL
+	Ttl          int    //seconds the push service should keep undelivered messages
+	MaxTcpConns  int
+	MaxRetryTime time.Duration
+	Timeout      time.Duration
+	AllowedHosts []string //host names or CIDRs endpoints may resolve to even if loopback, private or link-local
+}
+
+type webPushKeys struct {
+	P256dh string `json:"p256dh"`
+	Auth   string `json:"auth"`
+}
+
+type webPushSubscription struct {
+	Endpoint string      `json:"endpoint"`
+	Keys     webPushKeys `json:"keys"`
+}
+
+type webPushClaims struct {
+	Audience string `json:"aud"`
+	Expires  int64  `json:"exp"`
+	Subject  string `json:"sub,omitempty"`
+}
+
+type webPushVapid struct {
+	Token string
+	Until time.Time
+}
+
+type webPush struct {
+	client    *http.Client
+	devices   DeviceStore
+	hosts     *webhookHosts
+	key       *ecdsa.PrivateKey
+	maxSleep  time.Duration
+	publicKey string
+	subject   string
+	ttl       string
+
+	vapidLock sync.Mutex
+	vapid     map[string]webPushVapid
+}
+
+type webPushOpData struct {
+	Delay    time.Duration
+	Receipt  *Receipt //Receipt.Token is the endpoint
+	Data     []byte
+	Options  *PushOptions
+	Response *http.Response
+}
+
+func decodeBase64Url(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+// webPushEndpoint accepts both the bare endpoint URL and the whole subscription, so UNSUBSCRIBE and EXISTS can be fed what SUBSCRIBE was
+func webPushEndpoint(deviceTargetId string) string {
+
+	if !strings.HasPrefix(deviceTargetId, "{") {
+		return deviceTargetId
+	}
+
+	var sub webPushSubscription
+
+	if e := json.Unmarshal([]byte(deviceTargetId), &sub); e != nil {
+		return deviceTargetId
+	}
+
+	return sub.Endpoint
+}
+
+func parseWebPushSubscription(deviceTargetId string) (*webPushSubscription, error) {
+
+	var sub webPushSubscription
+
+	if e := json.Unmarshal([]byte(deviceTargetId), &sub); e != nil {
+		return nil, WebPushInvalidSubscription
+	}
+
+	if u, e := url.Parse(sub.Endpoint); e != nil || u.Scheme != "https" || u.Host == "" {
+		return nil, WebPushInvalidSubscription
+	}
+
+	if p256dh, e := decodeBase64Url(sub.Keys.P256dh); e != nil || len(p256dh) != 65 {
+		return nil, WebPushInvalidSubscription
+	}
+
+	if auth, e := decodeBase64Url(sub.Keys.Auth); e != nil || len(auth) != 16 {
+		return nil, WebPushInvalidSubscription
+	}
+
+	return &sub, nil
+}
+
+func init() {
+	RegisterConnectorFactory("webpush", func(name string, settings json.RawMessage) (Connector, error) {
+
+		var config WebPushConfig
+
+		if e := json.Unmarshal(settings, &config); e != nil {
+			return nil, e
+		}
+
+		if config.PrivateKey == "" {
+			return nil, errors.New("WebPush config object set but no PrivateKey field set")
+		}
+
+		config.MaxRetryTime *= time.Second
+		config.Timeout *= time.Second
+
+		return newWebPush(name, &config)
+	})
+}
+
+func newWebPush(name string, config *WebPushConfig) (*webPush, error) {
+
+	if config.MaxTcpConns == 0 {
+		config.MaxTcpConns = WebPushDefaultMaxHttpConns
+	}
+
+	if config.MaxRetryTime == 0 {
+		config.MaxRetryTime = WebPushDefaultMaxSleepBeforeFail
+	}
+
+	if config.Timeout == 0 {
+		config.Timeout = WebPushDefaultTimeout
+	}
+
+	if config.Ttl == 0 {
+		config.Ttl = WebPushDefaultTtl
+	}
+
+	hosts, e := newWebhookHosts(config.AllowedHosts)
+
+	if e != nil {
+		return nil, e
+	}
+
+	rawKey, e := decodeBase64Url(config.PrivateKey)
+
+	if e != nil {
+		return nil, WebPushInvalidVapidKey
+	}
+
+	key, e := ecdsa.ParseRawPrivateKey(elliptic.P256(), rawKey)
+
+	if e != nil {
+		return nil, WebPushInvalidVapidKey
+	}
+
+	ecdhKey, e := key.ECDH()
+
+	if e != nil {
+		return nil, e
+	}
+
+	devices, e := openDevices(name)
+
+	if e != nil {
+		return nil, e
+	}
+
+	return &webPush{
+		client: &http.Client{
+			Timeout: config.Timeout,
+			Transport: &http.Transport{
+				DialContext:         hosts.dial,
+				MaxIdleConnsPerHost: config.MaxTcpConns,
+			},
+		},
+		devices:   devices,
+		hosts:     hosts,
+		key:       key,
+		maxSleep:  config.MaxRetryTime,
+		publicKey: base64.RawURLEncoding.EncodeToString(ecdhKey.PublicKey().Bytes()),
+		subject:   config.Subject,
+		ttl:       strconv.Itoa(config.Ttl),
+		vapid:     make(map[string]webPushVapid),
+	}, nil
+
+}
+
+func (wp *webPush) Exists(deviceTargetId string) (bool, error) {
+
+	return wp.devices.Exists(webPushEndpoint(deviceTargetId))
+
+}
+
+func (wp *webPush) Owner(deviceTargetId string) (int64, bool, error) {
+
+	return wp.devices.Owner(webPushEndpoint(deviceTargetId))
+
+}
+
+func (wp *webPush) Push(user int64, message Message) ([]Receipt, error) {
+
+	devices, e := wp.devices.ForUser(user)
+
+	if e != nil {
+		return nil, e
+	}
+
+	return wp.devicesPush(devices, message)
+
+}
+
+// PushExcept pushes to the subscriptions of users whose endpoints are not in reached
+func (wp *webPush) PushExcept(users []int64, message Message, reached map[string]bool) ([]Receipt, error) {
+
+	devices, e := devicesExcept(wp.devices, users, reached)
+
+	if e != nil {
+		return nil, e
+	}
+
+	receipts, e := wp.devicesPush(devices, message)
+
+	for i := range receipts {
+		receipts[i].User = devices[i].User
+	}
+
+	return receipts, e
+
+}
+
+func (wp *webPush) Register(user int64, deviceTargetId string) error {
+
+	sub, e := parseWebPushSubscription(deviceTargetId)
+
+	if e != nil {
+		return e
+	}
+
+	u, _ := url.Parse(sub.Endpoint)
+
+	if e := wp.hosts.check(u.Hostname()); e == WebhookForbiddenHost {
+		return WebPushForbiddenHost
+	} else if e != nil {
+		return e
+	}
+
+	keys, e := json.Marshal(&sub.Keys)
+
+	if e != nil {
+		return e
+	}
+
+	return wp.devices.Add(user, sub.Endpoint, string(keys))
+
+}
+
+func (wp *webPush) Subscribed(user int64) (bool, error) {
+	return wp.devices.Subscribed(user)
+}
+
+func (wp *webPush) Unregister(deviceTargetId string) error {
+
+	return wp.devices.Delete(webPushEndpoint(deviceTargetId))
+
+}
+
+// authorization returns the RFC 8292 header for the origin of endpoint, reusing signed tokens until they're about to expire
+func (wp *webPush) authorization(endpoint string) (string, error) {
+
+	u, e := url.Parse(endpoint)
+
+	if e != nil {
+		return "", e
+	}
+
+	audience := u.Scheme + "://" + u.Host
+
+	wp.vapidLock.Lock()
+	defer wp.vapidLock.Unlock()
+
+	now := time.Now()
+
+	vapid, ok := wp.vapid[audience]
+
+	if !ok || now.Add(webPushVapidSlack).After(vapid.Until) {
+
+		vapid.Until = now.Add(webPushVapidLifetime)
+
+		vapid.Token, e = jwtSignES256(wp.key, "", &webPushClaims{
+			Audience: audience,
+			Expires:  vapid.Until.Unix(),
+			Subject:  wp.subject,
+		})
+
+		if e != nil {
+			return "", e
+		}
+
+		wp.vapid[audience] = vapid
+	}
+
+	return "vapid t=" + vapid.Token + ", k=" + wp.publicKey, nil
+}
+
+func hkdfExpand(prk, info []byte, length int) []byte {
+
+	mac := hmac.New(sha256.New, prk)
+	mac.Write(info)
+	mac.Write([]byte{1})
+
+	return mac.Sum(nil)[:length]
+}
+
+func hmacSha256(key, data []byte) []byte {
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+
+	return mac.Sum(nil)
+}
+
+// webPushEncrypt implements the aes128gcm content coding of RFC 8188 as profiled by RFC 8291, in a single record
+func webPushEncrypt(keys *webPushKeys, plaintext []byte) ([]byte, error) {
+
+	uaPublicRaw, e := decodeBase64Url(keys.P256dh)
+
+	if e != nil {
+		return nil, WebPushInvalidSubscription
+	}
+
+	authSecret, e := decodeBase64Url(keys.Auth)
+
+	if e != nil {
+		return nil, WebPushInvalidSubscription
+	}
+
+	uaPublic, e := ecdh.P256().NewPublicKey(uaPublicRaw)
+
+	if e != nil {
+		return nil, WebPushInvalidSubscription
+	}
+
+	asPrivate, e := ecdh.P256().GenerateKey(rand.Reader)
+
+	if e != nil {
+		return nil, e
+	}
+
+	asPublic := asPrivate.PublicKey().Bytes()
+
+	ecdhSecret, e := asPrivate.ECDH(uaPublic)
+
+	if e != nil {
+		return nil, e
+	}
+
+	keyInfo := append([]byte("WebPush: info\x00"), uaPublicRaw...)
+	keyInfo = append(keyInfo, asPublic...)
+
+	ikm := hkdfExpand(hmacSha256(authSecret, ecdhSecret), keyInfo, 32)
+
+	salt := make([]byte, 16)
+
+	if _, e = rand.Read(salt); e != nil {
+		return nil, e
+	}
+
+	prk := hmacSha256(salt, ikm)
+
+	cek := hkdfExpand(prk, []byte("Content-Encoding: aes128gcm\x00"), 16)
+	nonce := hkdfExpand(prk, []byte("Content-Encoding: nonce\x00"), 12)
+
+	block, e := aes.NewCipher(cek)
+
+	if e != nil {
+		return nil, e
+	}
+
+	gcm, e := cipher.NewGCM(block)
+
+	if e != nil {
+		return nil, e
+	}
+
+	header := make([]byte, 16+4+1, 16+4+1+len(asPublic))
+	copy(header, salt)
+	binary.BigEndian.PutUint32(header[16:], webPushRecordSize)
+	header[20] = byte(len(asPublic))
+	header = append(header, asPublic...)
+
+	padded := make([]byte, len(plaintext)+1)
+	copy(padded, plaintext)
+	padded[len(plaintext)] = 2 //last record delimiter, no padding
+
+	if len(header)+len(padded)+gcm.Overhead() > webPushMaxPayloadSize {
+		return nil, WebPushMessageTooLargeError
+	}
+
+	return gcm.Seal(header, nonce, padded, nil), nil
+}
+
+func (wp *webPush) expRetry(opData *webPushOpData) error {
+
+	if opData.Delay > wp.maxSleep {
+		return WebPushWontTryAgain
+	}
+
+	sleep := opData.Delay
+
+	if 2*opData.Delay > wp.maxSleep {
+		sleep = wp.maxSleep
+	}
+
+	time.Sleep(sleep)
+
+	return wp.payloadPush(opData.Receipt, opData.Data, opData.Options, 2*opData.Delay)
+
+}
+
+func (wp *webPush) evalResponse(opData *webPushOpData) error {
+
+	res := opData.Response
+
+	defer res.Body.Close()
+
+	switch {
+	case res.StatusCode >= 200 && res.StatusCode <= 299:
+		opData.Receipt.delivered(res.Header.Get("Location")) //the URL of the message resource is its ID
+		return nil
+
+	case res.StatusCode == 404, res.StatusCode == 410: //subscription expired or the user revoked it
+		opData.Receipt.removed(res.Status)
+		return wp.devices.Delete(opData.Receipt.Token)
+
+	case res.StatusCode == 413:
+		return WebPushMessageTooLargeError
+
+	case res.StatusCode == 429:
+		log.Println("Push service throttling, beginning exponential retry")
+
+		if e := wp.expRetry(opData); e != WebPushWontTryAgain {
+			return e
+		}
+
+		return WebPushTooManyRequestsError
+
+	case res.StatusCode == 500:
+		log.Println("Push service internal server error, beginning exponential retry")
+
+		if e := wp.expRetry(opData); e != WebPushWontTryAgain {
+			return e
+		}
+
+		return WebPushInternalServerError
+
+	case res.StatusCode >= 501 && res.StatusCode <= 599:
+		log.Println("Push service timeout, beginning exponential retry")
+
+		if e := wp.expRetry(opData); e != WebPushWontTryAgain {
+			return e
+		}
+
+		return WebPushTimeoutError
+
+	default:
+		body, e := ioutil.ReadAll(res.Body)
+
+		if e != nil {
+			return e
+		}
+
+		return errors.New("Push service replied " + res.Status + ": " + string(body))
+	}
+
+}
+
+func (wp *webPush) payloadPush(receipt *Receipt, payload []byte, options *PushOptions, retryTime time.Duration) error {
+
+	endpoint := receipt.Token
+
+	auth, e := wp.authorization(endpoint)
+
+	if e != nil {
+		return e
+	}
+
+	req, e := http.NewRequest("POST", endpoint, bytes.NewReader(payload))
+
+	if e != nil {
+		return e
+	}
+
+	req.Header.Add("Authorization", auth)
+	req.Header.Add("Content-Encoding", "aes128gcm")
+	req.Header.Add("Content-Type", "application/octet-stream")
+	req.Header.Add("TTL", wp.ttl)
+
+	if options.TimeToLive != nil {
+		req.Header.Set("TTL", strconv.Itoa(*options.TimeToLive))
+	}
+
+	if options.Priority != "" {
+		req.Header.Add("Urgency", options.Priority) //normal and high are valid urgencies too
+	}
+
+	if webPushValidTopic(options.CollapseKey) {
+		req.Header.Add("Topic", options.CollapseKey)
+	}
+
+	res, e := wp.client.Do(req)
+
+	if e != nil {
+		return e
+	}
+
+	opData := &webPushOpData{
+		Delay:    retryTime,
+		Receipt:  receipt,
+		Data:     payload,
+		Options:  options,
+		Response: res,
+	}
+
+	return wp.evalResponse(opData)
+
+}
+
+// webPushValidTopic tells if a collapse key can be used as a Topic, which may only have up to 32 base64url characters
+func webPushValidTopic(topic string) bool {
+
+	const alphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_"
+
+	return topic != "" && len(topic) <= 32 && strings.Trim(topic, alphabet) == ""
+}
+
+func (wp *webPush) devicePush(dev *Device, receipt *Receipt, plaintext []byte, options *PushOptions) error {
+
+	var keys webPushKeys
+
+	if e := json.Unmarshal([]byte(dev.Data), &keys); e != nil {
+		return e
+	}
+
+	payload, e := webPushEncrypt(&keys, plaintext)
+
+	if e != nil {
+		return e
+	}
+
+	return wp.payloadPush(receipt, payload, options, time.Second)
+}
+
+// webPushPlaintext is the bare data for data-only messages, like before notifications existed, and otherwise an
+// object with notification and data, the layout service workers like Angular's expect
+func webPushPlaintext(message *Message) ([]byte, error) {
+
+	if message.Notification == nil {
+		return json.Marshal(message.Data)
+	}
+
+	return json.Marshal(&struct {
+		Notification *Notification          `json:"notification"`
+		Data         map[string]interface{} `json:"data,omitempty"`
+	}{message.Notification, message.Data})
+}
+
+func (wp *webPush) devicesPush(devices []Device, message Message) ([]Receipt, error) {
+
+	receipts := make([]Receipt, len(devices))
+
+	for i, dev := range devices {
+		receipts[i] = Receipt{Token: dev.Token, State: DevicePending}
+	}
+
+	plaintext, e := webPushPlaintext(&message)
+
+	if e != nil {
+		return settleAll(receipts, e)
+	}
+
+	if message.Options.DryRun { //there is no dry run in the Web Push protocol
+		return validateAll(receipts)
+	}
+
+	errChan := make(chan error, len(devices))
+
+	for i := range devices {
+		go func(dev *Device, receipt *Receipt) {
+
+			e := wp.devicePush(dev, receipt, plaintext, &message.Options)
+
+			receipt.settle(e)
+
+			errChan <- e
+		}(&devices[i], &receipts[i])
+	}
+
+	var err error
+
+	for range devices {
+		if e := <-errChan; e != nil && err == nil {
+			err = e
+		}
+	}
+
+	return receipts, err
+
+}
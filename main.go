@@ -11,27 +11,35 @@
 package main
 
 import (
+	"bufio"
 	"flag"
 	"fmt"
 	"log"
 	"os"
 	"os/signal"
 	"runtime/debug"
+	"strings"
 
+	"github.com/mcilloni/pushed/backend"
 	"github.com/mcilloni/pushed/server"
 )
 
 var (
-	confPath string
-	help     bool
-	initDb   bool
-	logPath  string
+	confPath   string
+	hashSecret bool
+	help       bool
+	logPath    string
+	migrate    bool
+	target     int
 )
 
 func init() {
 	flag.BoolVar(&help, "help", false, "prints this help")
 	flag.BoolVar(&help, "h", false, "shorthand for -help")
-	flag.BoolVar(&initDb, "initdb", false, "initializes PostgreSQL with pushed tables as by the Postgres parameter in conffile. createdb the db first, and ensure you have permissions for the given user")
+	flag.BoolVar(&hashSecret, "hashsecret", false, "reads a client secret from stdin and prints its hash, for the Auth.Clients section of conffile")
+	flag.BoolVar(&migrate, "migrate", false, "migrates the schema of the storage of conffile to the -target version, creating the pushed tables if needed. With PostgreSQL, createdb the db first, and ensure you have permissions for the given user")
+	flag.BoolVar(&migrate, "initdb", false, "same as -migrate, kept for compatibility")
+	flag.IntVar(&target, "target", -1, "schema version -migrate migrates up or down to, 0 drops every table. If negative, the one this pushed needs")
 	flag.StringVar(&logPath, "logfile", "", "sets the path of the pushed log file. If not set, it will default to stdout")
 	flag.StringVar(&logPath, "l", "", "shorthand for -logfile")
 }
@@ -63,6 +71,11 @@ func main() {
 		return
 	}
 
+	if hashSecret {
+		printSecretHash()
+		return
+	}
+
 	if logPath != "" {
 		logFile, e := os.OpenFile(logPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
 
@@ -84,8 +97,8 @@ func main() {
 
 	var e error
 
-	if initDb {
-		e = server.InitDatabase(args[0])
+	if migrate {
+		e = server.MigrateDatabase(args[0], target)
 	} else {
 
 		interr := make(chan os.Signal, 1)
@@ -105,3 +118,22 @@ func main() {
 	}
 
 }
+
+func printSecretHash() {
+
+	secret, e := bufio.NewReader(os.Stdin).ReadString('\n')
+
+	if e != nil && secret == "" {
+		fmt.Printf("Cannot read the secret: %s\n", e.Error())
+		return
+	}
+
+	hash, e := backend.HashSecret(strings.TrimRight(secret, "\r\n"))
+
+	if e != nil {
+		fmt.Println(e.Error())
+		return
+	}
+
+	fmt.Println(hash)
+}
@@ -0,0 +1,403 @@
+/*  Pushed - a daemon for parallel handling of push operations to mobile devices
+ *  Copyright (C) 2014  Marco Cilloni <marco.cilloni@yahoo.com>
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *  Exhibit B is not attached; this software is compatible with the
+ *  licenses expressed under Section 1.12 of the MPL v2.
+ */
+
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/mcilloni/pushed/backend"
+)
+
+const (
+	DefaultAuthMaxFailures = 5
+	DefaultAuthLockout     = time.Minute
+	DefaultAuthMaxChecks   = 2
+
+	authCacheSize    = 1024 //verified secrets remembered, the cache starts over past them
+	authFailuresSize = 4096 //addresses with failures tracked before stale ones are dropped
+)
+
+var (
+	authRequiredResp = newResponse(rejected, "Authentication required")
+	authFailedResp   = newResponse(rejected, "Authentication failed")
+	authLockedResp   = newResponse(rejected, "Too many failed attempts, try again later")
+	authBusyResp     = newResponse(rejected, "Too many authentication attempts in progress, try again later")
+
+	errAuthBusy = errors.New("Too many secrets being checked")
+)
+
+// authConfig enables the AUTH handshake on the line protocol. Clients are checked against Clients first, then
+// against those added with CLIENTADD.
+type authConfig struct {
+	Required    bool
+	Clients     []authClient
+	MaxFailures int           //failed attempts from an address before it is locked out
+	Lockout     time.Duration //seconds
+	MaxChecks   int           //secrets hashed at once, further attempts are refused until one is done
+}
+
+type authClient struct {
+	Id     string       //also matched against the subject of TLS client certificates
+	Secret string       //as given by pushed -hashsecret, empty for clients with a certificate
+	Acl    *backend.Acl //nil allows everything
+}
+
+// session is a connection to the line protocol, with the client it authenticated as and what it can do
+type session struct {
+	conn    net.Conn
+	client  string
+	acl     *backend.Acl
+	subject string //of the TLS client certificate, if verified
+}
+
+// authenticator checks AUTH requests, locking out addresses after too many failures in a row. Hashing a secret
+// takes a while on purpose, so it remembers those already verified and only hashes a few at once.
+type authenticator struct {
+	config   *authConfig
+	lock     sync.Mutex
+	failures map[string]*authFailures
+	checks   chan bool         //one for each secret being hashed
+	cacheKey []byte            //random, so that verified does not hold anything usable outside this process
+	verified map[string][]byte //HMAC of the last secret that matched each hash
+}
+
+type authFailures struct {
+	count int
+	last  time.Time //of the last failure
+	until time.Time
+}
+
+func newAuthenticator(config *authConfig) *authenticator {
+
+	if !config.Required {
+		return nil
+	}
+
+	if config.MaxFailures <= 0 {
+		config.MaxFailures = DefaultAuthMaxFailures
+	}
+
+	if config.Lockout <= 0 {
+		config.Lockout = DefaultAuthLockout
+	}
+
+	if config.MaxChecks <= 0 {
+		config.MaxChecks = DefaultAuthMaxChecks
+	}
+
+	cacheKey := make([]byte, sha256.Size)
+
+	if _, e := rand.Read(cacheKey); e != nil {
+		log.Panicf("Cannot generate the key of the AUTH cache: %s", e.Error())
+	}
+
+	return &authenticator{
+		config:   config,
+		failures: make(map[string]*authFailures),
+		checks:   make(chan bool, config.MaxChecks),
+		cacheKey: cacheKey,
+		verified: make(map[string][]byte),
+	}
+}
+
+// authorize handles AUTH, and rejects any other request on a session that did not authenticate. It returns nil
+// for requests that need the usual parseRequest.
+func (auth *authenticator) authorize(sess *session, head []byte) *response {
+
+	if sess.subject == "" {
+		if sess.subject = peerSubject(sess.conn); sess.subject != "" {
+			log.Printf("Connection from %s with certificate %s", remoteHost(sess.conn), sess.subject)
+			auth.certificate(sess)
+		}
+	}
+
+	fields := bytes.Fields(head)
+
+	if len(fields) > 0 && command(fields[0]) == authcmd {
+
+		if auth == nil {
+			return newResponse(rejected, "Authentication is not enabled")
+		}
+
+		if len(fields) != 3 {
+			return newResponse(rejected, "Wrong number of arguments for %s: %d", fields[0], len(fields))
+		}
+
+		resp := auth.authenticate(sess, remoteHost(sess.conn), string(fields[1]), string(fields[2]))
+
+		if resp.Status == yes {
+			log.Printf("Client %s authenticated from %s", sess.client, remoteHost(sess.conn))
+		}
+
+		return resp
+	}
+
+	if auth != nil && sess.client == "" {
+		return authRequiredResp
+	}
+
+	return nil
+}
+
+// authenticate checks the secret of client id for sess, coming from addr
+func (auth *authenticator) authenticate(sess *session, addr, id, secret string) *response {
+
+	auth.lock.Lock()
+	failures := auth.failures[addr]
+	locked := failures != nil && time.Now().Before(failures.until)
+	auth.lock.Unlock()
+
+	if locked {
+		log.Printf("Refused AUTH as %s from locked out %s", id, addr)
+		return authLockedResp
+	}
+
+	acl, ok, e := auth.check(id, secret)
+
+	if e == errAuthBusy {
+		log.Printf("Refused AUTH as %s from %s, too many secrets being checked", id, addr)
+		return authBusyResp
+	}
+
+	if e != nil {
+		log.Printf("Error: %s", e.Error())
+		return internalErrorResp
+	}
+
+	auth.lock.Lock()
+	defer auth.lock.Unlock()
+
+	if ok {
+		delete(auth.failures, addr)
+		sess.client, sess.acl = id, acl
+
+		return newResponse(yes, "Authenticated")
+	}
+
+	now := time.Now()
+
+	if failures = auth.failures[addr]; failures == nil {
+
+		if len(auth.failures) >= authFailuresSize {
+			auth.pruneFailures(now)
+		}
+
+		failures = new(authFailures)
+		auth.failures[addr] = failures
+	}
+
+	failures.count++
+	failures.last = now
+
+	log.Printf("Failed AUTH as %s from %s (%d in a row)", id, addr, failures.count)
+
+	if failures.count >= auth.config.MaxFailures {
+		log.Printf("Locking out %s for %s", addr, auth.config.Lockout)
+
+		failures.count = 0
+		failures.until = now.Add(auth.config.Lockout)
+	}
+
+	return authFailedResp
+}
+
+// pruneFailures forgets the addresses that are not locked out and failed longer than a lockout ago, or if
+// that is not enough all those that are not locked out. It must be called with auth.lock held.
+func (auth *authenticator) pruneFailures(now time.Time) {
+
+	for addr, failures := range auth.failures {
+		if now.After(failures.until) && now.Sub(failures.last) > auth.config.Lockout {
+			delete(auth.failures, addr)
+		}
+	}
+
+	if len(auth.failures) < authFailuresSize {
+		return
+	}
+
+	for addr, failures := range auth.failures {
+		if now.After(failures.until) {
+			delete(auth.failures, addr)
+		}
+	}
+}
+
+// login authenticates a request of the REST API or gRPC coming from addr, with the credentials it carries if
+// given. They are checked like AUTH, lockouts included. Without Auth.Required, any request can do anything.
+func (auth *authenticator) login(addr, id, secret string, given bool) (*session, *response) {
+
+	if auth == nil {
+		return &session{}, nil
+	}
+
+	if !given {
+		return nil, authRequiredResp
+	}
+
+	sess := new(session)
+
+	if resp := auth.authenticate(sess, addr, id, secret); resp.Status != yes {
+		return nil, resp
+	}
+
+	return sess, nil
+}
+
+// certificate authenticates sess as the client named after the subject of its certificate, if there is one
+func (auth *authenticator) certificate(sess *session) {
+
+	if auth == nil {
+		return
+	}
+
+	for _, client := range auth.config.Clients {
+		if client.Id == sess.subject {
+			sess.client, sess.acl = client.Id, client.Acl
+			return
+		}
+	}
+
+	_, acl, e := backend.ClientSecret(sess.subject)
+
+	switch e {
+	case nil:
+		sess.client, sess.acl = sess.subject, acl
+	case backend.ErrUnknownClient:
+		log.Printf("Certificate %s matches no client, AUTH is still required", sess.subject)
+	default:
+		log.Printf("Error: %s", e.Error())
+	}
+}
+
+// check looks for the client in the configuration first, then in the database. Secrets that already matched
+// are not hashed again; otherwise, it returns errAuthBusy if MaxChecks secrets are already being hashed.
+func (auth *authenticator) check(id, secret string) (*backend.Acl, bool, error) {
+
+	hash, acl, e := auth.client(id)
+	known := e == nil
+
+	if e != nil && e != backend.ErrUnknownClient {
+		return nil, false, e
+	}
+
+	mac := hmac.New(sha256.New, auth.cacheKey)
+	mac.Write([]byte(secret))
+	sum := mac.Sum(nil)
+
+	auth.lock.Lock()
+	cached := known && hmac.Equal(auth.verified[hash], sum)
+	auth.lock.Unlock()
+
+	if cached {
+		return acl, true, nil
+	}
+
+	select {
+	case auth.checks <- true:
+		defer func() { <-auth.checks }()
+	default:
+		return nil, false, errAuthBusy
+	}
+
+	if !known {
+		backend.CheckNoSecret(secret)
+		return nil, false, nil
+	}
+
+	if !backend.CheckSecret(hash, secret) {
+		return acl, false, nil
+	}
+
+	auth.lock.Lock()
+
+	if len(auth.verified) >= authCacheSize {
+		auth.verified = make(map[string][]byte)
+	}
+
+	auth.verified[hash] = sum
+
+	auth.lock.Unlock()
+
+	return acl, true, nil
+}
+
+// client returns the secret hash and the acl of client id, from the configuration or the database
+func (auth *authenticator) client(id string) (string, *backend.Acl, error) {
+
+	for _, client := range auth.config.Clients {
+		if client.Id == id {
+			return client.Secret, client.Acl, nil
+		}
+	}
+
+	return backend.ClientSecret(id)
+}
+
+// permit checks op against the acl of the session, before it is processed
+func (sess *session) permit(op *operation) *response {
+
+	if !sess.acl.AllowsCommand(string(op.Command)) {
+		log.Printf("Client %s is not allowed to %s", sess.client, op.Command)
+		return newResponse(rejected, "Not allowed: client %s cannot %s", sess.client, op.Command)
+	}
+
+	if !sess.acl.RestrictsUsers() {
+		return nil
+	}
+
+	users, all, e := op.users()
+
+	if e != nil {
+		log.Printf("Error: %s", e.Error())
+		return internalErrorResp
+	}
+
+	if all {
+		log.Printf("Client %s is not allowed to %s to every user", sess.client, op.Command)
+		return newResponse(rejected, "Not allowed: client %s cannot reach every user", sess.client)
+	}
+
+	for _, user := range users {
+		if !sess.acl.AllowsUser(user) {
+			log.Printf("Client %s is not allowed to %s on user %d", sess.client, op.Command, user)
+			return newResponse(rejected, "Not allowed: client %s cannot reach user %d", sess.client, user)
+		}
+	}
+
+	return nil
+}
+
+func remoteHost(conn net.Conn) string {
+
+	if conn.RemoteAddr() == nil {
+		return ""
+	}
+
+	return hostOf(conn.RemoteAddr().String())
+}
+
+// hostOf strips the port from addr, if any
+func hostOf(addr string) string {
+
+	if host, _, e := net.SplitHostPort(addr); e == nil {
+		return host
+	}
+
+	return addr
+}
@@ -17,6 +17,7 @@ import (
 	"log"
 	"os"
 	"path"
+	"strings"
 	"time"
 
 	"github.com/mcilloni/pushed/backend"
@@ -25,13 +26,77 @@ import (
 type connParams struct {
 	TcpInfo string
 	Socket  string
+	Http    string //optional address for the REST API
+	Grpc    string //optional address for the gRPC service
+	Tls     *tlsParams
+}
+
+// memoryParams configures the memory store. Without a Snapshot, everything is lost when pushed stops.
+type memoryParams struct {
+	Snapshot         string        //JSON file the store is loaded from and saved to
+	SnapshotInterval time.Duration //seconds
+}
+
+type connectorConfig struct {
+	Type     string
+	Name     string
+	Settings json.RawMessage
+	Devices  backend.DevicePolicy //how many devices each user can register, and what happens past that
 }
 
 type config struct {
 	Listen      *connParams
+	Storage     string //postgres (the default), sqlite or memory
 	Postgres    string
-	Gcm         *backend.GcmConfig
+	Sqlite      string //path of the database file
+	Memory      memoryParams
+	Connectors  []connectorConfig
 	Dispatchers uint8
+	Outbox      backend.OutboxConfig
+	Broadcast   backend.BroadcastConfig
+	Auth        authConfig
+
+	//Single instance connector sections, kept for compatibility. They become connectors named after their type.
+	Gcm     json.RawMessage
+	Fcm     json.RawMessage
+	Apns    json.RawMessage
+	WebPush json.RawMessage
+	Webhook json.RawMessage
+	Email   json.RawMessage
+}
+
+// storeSource returns what OpenStore and Migrate need for the configured store
+func (conf *config) storeSource() string {
+
+	switch conf.Storage {
+	case backend.StorageSqlite:
+		return conf.Sqlite
+	case backend.StorageMemory:
+		return conf.Memory.Snapshot
+	default:
+		return conf.Postgres
+	}
+}
+
+func (conf *config) openStore() error {
+
+	if conf.Storage == backend.StorageMemory {
+		return backend.OpenMemoryStore(conf.Memory.Snapshot, conf.Memory.SnapshotInterval)
+	}
+
+	return backend.OpenStore(conf.Storage, conf.storeSource())
+}
+
+// instances returns the configured connector instance names
+func (conf *config) instances() []string {
+
+	names := make([]string, len(conf.Connectors))
+
+	for i, connector := range conf.Connectors {
+		names[i] = connector.Name
+	}
+
+	return names
 }
 
 func parse(confPath string) (conf *config, e error) {
@@ -70,20 +135,98 @@ func parse(confPath string) (conf *config, e error) {
 
 	}
 
-	if values.Postgres == "" {
-		return nil, errors.New("No postgres connection string in " + confPath)
+	if values.Listen.Tls != nil {
+		if e = values.Listen.Tls.check(); e != nil {
+			return nil, errors.New("Invalid TLS settings in " + confPath + ": " + e.Error())
+		}
 	}
 
-	if values.Gcm != nil {
-		if values.Gcm.ApiKey == "" {
-			return nil, errors.New("Gcm config object set but no ApiKey field set")
+	switch values.Storage {
+	case "", backend.StoragePostgres:
+
+		values.Storage = backend.StoragePostgres
+
+		if values.Postgres == "" {
+			return nil, errors.New("No postgres connection string in " + confPath)
 		}
 
-		if values.Gcm.MaxRetryTime != 0 {
-			values.Gcm.MaxRetryTime *= time.Second //I don't expect people to input nanoseconds ;)
+	case backend.StorageSqlite:
+
+		if values.Sqlite == "" {
+			return nil, errors.New("No SQLite database path in " + confPath)
 		}
+
+	case backend.StorageMemory:
+		values.Memory.SnapshotInterval *= time.Second
+
+	default:
+		return nil, errors.New("Unknown storage " + values.Storage + " in " + confPath + ", must be postgres, sqlite or memory")
 	}
 
+	for _, legacy := range []connectorConfig{
+		{Type: "gcm", Name: "gcm", Settings: values.Gcm},
+		{Type: "fcm", Name: "fcm", Settings: values.Fcm},
+		{Type: "apns", Name: "apns", Settings: values.Apns},
+		{Type: "webpush", Name: "webpush", Settings: values.WebPush},
+		{Type: "webhook", Name: "webhook", Settings: values.Webhook},
+		{Type: "email", Name: "email", Settings: values.Email},
+	} {
+		if legacy.Settings != nil {
+			values.Connectors = append(values.Connectors, legacy)
+		}
+	}
+
+	names := make(map[string]bool, len(values.Connectors))
+
+	for i := range values.Connectors {
+
+		connector := &values.Connectors[i]
+
+		if !backend.ExistsConnectorFactory(connector.Type) {
+			return nil, errors.New("Unknown connector type " + connector.Type + " in " + confPath)
+		}
+
+		if connector.Name == "" {
+			connector.Name = strings.ToLower(connector.Type)
+		}
+
+		if !backend.ValidConnectorName(connector.Name) {
+			return nil, errors.New("Invalid connector name " + connector.Name + ": " + backend.ErrInvalidConnectorName.Error())
+		}
+
+		if names[connector.Name] {
+			return nil, errors.New("Connector " + connector.Name + " is configured twice in " + confPath)
+		}
+
+		if e = connector.Devices.Validate(); e != nil {
+			return nil, errors.New("Invalid device policy for connector " + connector.Name + ": " + e.Error())
+		}
+
+		names[connector.Name] = true
+	}
+
+	for _, client := range values.Auth.Clients {
+		if !backend.ValidClientId(client.Id) || (client.Secret != "" && !backend.ValidSecretHash(client.Secret)) {
+			return nil, errors.New("Invalid client " + client.Id + " in " + confPath + ", secrets must be hashed with pushed -hashsecret")
+		}
+
+		if client.Acl != nil {
+			for _, users := range client.Acl.Users {
+				if users.From > users.To {
+					return nil, errors.New("Invalid user range for client " + client.Id + " in " + confPath)
+				}
+			}
+		}
+	}
+
+	if values.Auth.Required && values.Listen.Tls == nil && (values.Listen.Http != "" || values.Listen.Grpc != "") {
+		return nil, errors.New("Auth.Required with the REST API or gRPC needs Listen.Tls in " + confPath + ", or secrets travel in clear")
+	}
+
+	values.Auth.Lockout *= time.Second
+	values.Outbox.PollInterval *= time.Second
+	values.Outbox.IdempotencyWindow *= time.Second
+
 	if values.Dispatchers == 0 {
 		values.Dispatchers = DefaultDispatchers
 	}
@@ -16,7 +16,6 @@ import (
 	"errors"
 	"io"
 	"log"
-	"net"
 	"sync/atomic"
 	"time"
 
@@ -32,7 +31,7 @@ var (
 	routines      uint64 = 0
 )
 
-func dispatch(incoming chan net.Conn, forward chan<- command, finished chan<- bool) {
+func dispatch(incoming chan *session, auth *authenticator, forward chan<- command, finished chan<- bool) {
 
 	routineN := atomic.AddUint64(&routines, 1)
 
@@ -48,7 +47,9 @@ func dispatch(incoming chan net.Conn, forward chan<- command, finished chan<- bo
 		}
 	}
 
-	for in := range incoming {
+	for sess := range incoming {
+
+		in := sess.conn
 
 		read = bufio.NewReader(in)
 
@@ -67,7 +68,22 @@ func dispatch(incoming chan net.Conn, forward chan<- command, finished chan<- bo
 			continue
 		}
 
-		op, resp := parseRequest(request, data)
+		var op *operation
+
+		resp := auth.authorize(sess, request)
+
+		if resp == nil {
+			op, resp = parseRequest(request, data)
+		}
+
+		if resp == nil {
+			op.Client = sess.client
+			resp = sess.permit(op)
+		}
+
+		if resp == nil {
+			resp = process(op)
+		}
 
 		e = resp.dump(in)
 
@@ -84,8 +100,8 @@ func dispatch(incoming chan net.Conn, forward chan<- command, finished chan<- bo
 			}
 		}
 
-		if resp.Status == rejected || op.Command != halt {
-			incoming <- in //send connection back for further operations
+		if op == nil || op.Command != halt {
+			incoming <- sess //send connection back for further operations
 		} else {
 			in.Close()
 		}
@@ -95,9 +111,17 @@ func dispatch(incoming chan net.Conn, forward chan<- command, finished chan<- bo
 	finished <- true
 }
 
+// execOp runs accepted operations. PUSH, PUSHTOPIC and PUSHTPL need nothing here, the outbox workers deliver them,
+// unless the store has no outbox: then PUSH is delivered here.
 func execOp(op *operation, forward chan<- command) (e error) {
 	switch op.Command {
 
+	case push:
+		if !backend.UsesPostgres() {
+			e = pushNow(op.Parameters[0].([]int64), op.Parameters[1].(backend.Message))
+		}
+		break
+
 	case halt:
 		time.Sleep(op.Parameters[0].(time.Duration))
 		forward <- op.Command
@@ -111,9 +135,12 @@ func execOp(op *operation, forward chan<- command) (e error) {
 		e = backend.DelUser(op.Parameters[0].(int64))
 		break
 
-	case subscribe:
-		conn := op.Parameters[1].(backend.Connector)
-		e = conn.Register(op.Parameters[0].(int64), op.Parameters[2].(string))
+	case clientadd:
+		e = backend.AddClient(op.Parameters[0].(string), op.Parameters[1].(string), op.Parameters[2].(*backend.Acl))
+		break
+
+	case clientdel:
+		e = backend.DelClient(op.Parameters[0].(string))
 		break
 
 	case unsubscribe:
@@ -121,27 +148,49 @@ func execOp(op *operation, forward chan<- command) (e error) {
 		e = conn.Unregister(op.Parameters[2].(string))
 		break
 
-	case push:
-		failed, failures := backend.PushAll(op.Parameters[0].(int64), op.Parameters[1].(backend.Message))
-
-		if failed {
-			buffer := bytes.NewBufferString("Errors from connectors - ")
-			for key, value := range failures {
-				buffer.WriteString(key)
-				buffer.WriteString(": '")
-				buffer.WriteString(value.Error())
-				buffer.WriteString("' ")
-			}
+	case topicsub:
+		e = backend.TopicSubscribe(op.Parameters[0].(int64), op.Parameters[1].(string))
+		break
 
-			e = errors.New(buffer.String())
+	case topicunsub:
+		e = backend.TopicUnsubscribe(op.Parameters[0].(int64), op.Parameters[1].(string))
+		break
 
-		} else {
-			e = nil
-		}
+	case tplset:
+		e = backend.SetTemplate(op.Parameters[0].(*backend.Template))
+		break
+
+	case tpldel:
+		tpl := op.Parameters[0].(*backend.Template)
+		e = backend.DelTemplate(tpl.Name, tpl.Locale)
+		break
 
+	case setlocale:
+		e = backend.SetLocale(op.Parameters[0].(int64), op.Parameters[1].(string))
 		break
 
 	}
 
 	return
 }
+
+// pushNow delivers message to users without the outbox, reporting what failed on each connector
+func pushNow(users []int64, message backend.Message) error {
+
+	failed, failures := backend.PushMany(users, message)
+
+	if !failed {
+		return nil
+	}
+
+	buffer := bytes.NewBufferString("Errors from connectors - ")
+
+	for key, value := range failures {
+		buffer.WriteString(key)
+		buffer.WriteString(": '")
+		buffer.WriteString(value.Error())
+		buffer.WriteString("' ")
+	}
+
+	return errors.New(buffer.String())
+}
@@ -0,0 +1,810 @@
+/*  Pushed - a daemon for parallel handling of push operations to mobile devices
+ *  Copyright (C) 2014  Marco Cilloni <marco.cilloni@yahoo.com>
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *  Exhibit B is not attached; this software is compatible with the
+ *  licenses expressed under Section 1.12 of the MPL v2.
+ */
+
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mcilloni/pushed/backend"
+	"github.com/mcilloni/pushed/rpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+const (
+	grpcBatchWorkers = 16 //pushes of a PushBatch stream that may run at once
+)
+
+type grpcServer struct {
+	rpc.UnimplementedPushedServer
+	auth *authenticator //nil if clients need not authenticate
+}
+
+// grpcSessionKey holds the session of a call in its context
+type grpcSessionKey struct{}
+
+// grpcStream is a stream with the context its session was added to
+type grpcStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (stream *grpcStream) Context() context.Context {
+	return stream.ctx
+}
+
+// newGrpcServer builds the gRPC service, served over TLS if reloader is not nil
+func newGrpcServer(auth *authenticator, reloader *tlsReloader) *grpc.Server {
+
+	handler := &grpcServer{auth: auth}
+
+	opts := []grpc.ServerOption{grpc.UnaryInterceptor(handler.unaryLogin), grpc.StreamInterceptor(handler.streamLogin)}
+
+	if reloader != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(reloader.config("h2"))))
+	}
+
+	srv := grpc.NewServer(opts...)
+
+	rpc.RegisterPushedServer(srv, handler)
+
+	return srv
+}
+
+func (srv *grpcServer) unaryLogin(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+
+	ctx, e := srv.login(ctx)
+
+	if e != nil {
+		return nil, e
+	}
+
+	return handler(ctx, req)
+}
+
+func (srv *grpcServer) streamLogin(handler interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, next grpc.StreamHandler) error {
+
+	ctx, e := srv.login(stream.Context())
+
+	if e != nil {
+		return e
+	}
+
+	return next(handler, &grpcStream{ServerStream: stream, ctx: ctx})
+}
+
+// login authenticates a call with the "authorization: Basic <credentials>" metadata, as HTTP basic authentication
+// does, and returns its context with the session of the client
+func (srv *grpcServer) login(ctx context.Context) (context.Context, error) {
+
+	var (
+		addr, id, secret string
+		given            bool
+	)
+
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		addr = hostOf(p.Addr.String())
+	}
+
+	if md, ok := metadata.FromIncomingContext(ctx); ok && len(md.Get("authorization")) > 0 {
+
+		encoded, basic := strings.CutPrefix(md.Get("authorization")[0], "Basic ")
+		decoded, e := base64.StdEncoding.DecodeString(encoded)
+
+		if !basic || e != nil {
+			return nil, status.Error(codes.Unauthenticated, "Malformed authorization, expected Basic credentials")
+		}
+
+		id, secret, given = strings.Cut(string(decoded), ":")
+	}
+
+	sess, resp := srv.auth.login(addr, id, secret, given)
+
+	switch resp {
+	case nil:
+		return context.WithValue(ctx, grpcSessionKey{}, sess), nil
+	case internalErrorResp:
+		return nil, status.Error(codes.Internal, resp.Message)
+	case authLockedResp, authBusyResp:
+		return nil, status.Error(codes.ResourceExhausted, resp.Message)
+	default:
+		return nil, status.Error(codes.Unauthenticated, resp.Message)
+	}
+}
+
+// grpcSession returns the session login added to ctx
+func grpcSession(ctx context.Context) *session {
+
+	if sess, ok := ctx.Value(grpcSessionKey{}).(*session); ok {
+		return sess
+	}
+
+	return &session{acl: &backend.Acl{}} //not called through the interceptors, nothing is allowed
+}
+
+// grpcPermit checks the operation a call amounts to against the ACL of its client, like dispatch does
+func grpcPermit(ctx context.Context, cmd command, parameters ...interface{}) error {
+
+	switch resp := grpcSession(ctx).permit(&operation{Command: cmd, Parameters: parameters}); resp {
+	case nil:
+		return nil
+	case internalErrorResp:
+		return status.Error(codes.Internal, resp.Message)
+	default:
+		return status.Error(codes.PermissionDenied, resp.Message)
+	}
+}
+
+// grpcError maps backend errors to status codes. Unknown errors are logged and hidden behind Internal, like
+// the line protocol does.
+func grpcError(e error) error {
+
+	switch e {
+	case nil:
+		return nil
+	case backend.ApnsInvalidToken, backend.ErrInvalidIdempotencyKey, backend.ErrInvalidLocale, backend.ErrInvalidTemplateName, backend.ErrInvalidTopic,
+		backend.ErrNoRecipients, backend.ErrTooManyRecipients, backend.WebhookForbiddenHost, backend.WebhookInvalidUrl,
+		backend.WebPushForbiddenHost, backend.WebPushInvalidSubscription:
+		return status.Error(codes.InvalidArgument, e.Error())
+	case backend.ErrDeviceExists:
+		return status.Error(codes.AlreadyExists, e.Error())
+	case backend.ErrNeedsPostgres:
+		return status.Error(codes.FailedPrecondition, e.Error())
+	case backend.ErrTooManyDevices:
+		return status.Error(codes.ResourceExhausted, e.Error())
+	case backend.ErrNotRegistered, backend.ErrUnknownBroadcast, backend.ErrUnknownMessage, backend.ErrUnknownTemplate,
+		backend.ErrUserNotExisting:
+		return status.Error(codes.NotFound, e.Error())
+	case backend.ErrUserExists:
+		return status.Error(codes.AlreadyExists, e.Error())
+	}
+
+	log.Printf("Error: %s", e.Error())
+
+	return status.Error(codes.Internal, "Internal error")
+}
+
+// grpcPushRequest is implemented by every request carrying a message
+type grpcPushRequest interface {
+	GetData() map[string]string
+	GetRichData() *structpb.Struct
+	GetNotification() *rpc.Notification
+	GetOptions() *rpc.PushOptions
+}
+
+// grpcMessage builds a message out of the sections of a request
+func grpcMessage(req grpcPushRequest) (backend.Message, error) {
+
+	message := backend.Message{Data: make(map[string]interface{}, len(req.GetData()))}
+
+	for key, value := range req.GetData() {
+		message.Data[key] = value
+	}
+
+	for key, value := range req.GetRichData().AsMap() {
+		message.Data[key] = value
+	}
+
+	if n := req.GetNotification(); n != nil {
+
+		message.Notification = &backend.Notification{
+			Title:        n.Title,
+			Body:         n.Body,
+			Icon:         n.Icon,
+			Sound:        n.Sound,
+			ClickAction:  n.ClickAction,
+			TitleLocKey:  n.TitleLocKey,
+			TitleLocArgs: n.TitleLocArgs,
+			BodyLocKey:   n.BodyLocKey,
+			BodyLocArgs:  n.BodyLocArgs,
+		}
+
+		if n.Badge != nil {
+			badge := int(*n.Badge)
+			message.Notification.Badge = &badge
+		}
+	}
+
+	options := req.GetOptions()
+
+	if options == nil {
+		return message, nil
+	}
+
+	message.Options = backend.PushOptions{
+		CollapseKey:           options.CollapseKey,
+		Priority:              options.Priority,
+		DelayWhileIdle:        options.DelayWhileIdle,
+		RestrictedPackageName: options.RestrictedPackageName,
+		DryRun:                options.DryRun,
+	}
+
+	if options.TimeToLive != nil {
+		ttl := int(*options.TimeToLive)
+		message.Options.TimeToLive = &ttl
+	}
+
+	if e := message.Options.Validate(); e != nil {
+		return message, status.Error(codes.InvalidArgument, e.Error())
+	}
+
+	return message, nil
+}
+
+func grpcConnector(name string) (backend.Connector, error) {
+
+	conn := backend.GetConnector(name)
+
+	if conn == nil {
+		return nil, status.Errorf(codes.NotFound, "Connector %s does not exist", name)
+	}
+
+	return conn, nil
+}
+
+func grpcUser(user int64) error {
+
+	if user < 0 {
+		return status.Errorf(codes.InvalidArgument, "Invalid user ID %d", user)
+	}
+
+	return nil
+}
+
+func (srv *grpcServer) AddUser(ctx context.Context, req *rpc.UserRequest) (*rpc.Empty, error) {
+
+	if e := grpcUser(req.User); e != nil {
+		return nil, e
+	}
+
+	if e := grpcPermit(ctx, adduser, req.User); e != nil {
+		return nil, e
+	}
+
+	return &rpc.Empty{}, grpcError(backend.AddUser(req.User))
+}
+
+func (srv *grpcServer) DelUser(ctx context.Context, req *rpc.UserRequest) (*rpc.Empty, error) {
+
+	if e := grpcPermit(ctx, deluser, req.User); e != nil {
+		return nil, e
+	}
+
+	return &rpc.Empty{}, grpcError(backend.DelUser(req.User))
+}
+
+func (srv *grpcServer) UserExists(ctx context.Context, req *rpc.UserRequest) (*rpc.ExistsReply, error) {
+
+	if e := grpcPermit(ctx, exists, req.User); e != nil {
+		return nil, e
+	}
+
+	b, e := backend.Exists(req.User)
+
+	return &rpc.ExistsReply{Exists: b}, grpcError(e)
+}
+
+func (srv *grpcServer) Subscribe(ctx context.Context, req *rpc.DeviceRequest) (*rpc.Empty, error) {
+
+	conn, e := grpcConnector(req.Connector)
+
+	if e != nil {
+		return nil, e
+	}
+
+	if e = grpcPermit(ctx, subscribe, req.User, conn, req.Token); e != nil {
+		return nil, e
+	}
+
+	return &rpc.Empty{}, grpcError(conn.Register(req.User, req.Token))
+}
+
+func (srv *grpcServer) Unsubscribe(ctx context.Context, req *rpc.DeviceRequest) (*rpc.Empty, error) {
+
+	conn, e := grpcConnector(req.Connector)
+
+	if e != nil {
+		return nil, e
+	}
+
+	if e = grpcPermit(ctx, unsubscribe, req.User, conn, req.Token); e != nil {
+		return nil, e
+	}
+
+	return &rpc.Empty{}, grpcError(conn.Unregister(req.Token))
+}
+
+func (srv *grpcServer) Subscribed(ctx context.Context, req *rpc.SubscribedRequest) (*rpc.ExistsReply, error) {
+
+	conn, e := grpcConnector(req.Connector)
+
+	if e != nil {
+		return nil, e
+	}
+
+	if e = grpcPermit(ctx, subscribed, req.User, conn); e != nil {
+		return nil, e
+	}
+
+	b, e := conn.Subscribed(req.User)
+
+	return &rpc.ExistsReply{Exists: b}, grpcError(e)
+}
+
+func (srv *grpcServer) DeviceExists(ctx context.Context, req *rpc.DeviceRequest) (*rpc.ExistsReply, error) {
+
+	conn, e := grpcConnector(req.Connector)
+
+	if e != nil {
+		return nil, e
+	}
+
+	if e = grpcPermit(ctx, exists, conn, req.Token); e != nil {
+		return nil, e
+	}
+
+	b, e := conn.Exists(req.Token)
+
+	return &rpc.ExistsReply{Exists: b}, grpcError(e)
+}
+
+// push queues message like PUSH and waits for its first delivery attempt, or delivers it right away without
+// Postgres, as execOp does. It reports failures per connector, instead of concatenating them like execOp does.
+func (srv *grpcServer) push(ctx context.Context, user int64, key string, message backend.Message) (*rpc.PushReply, error) {
+
+	reply := &rpc.PushReply{User: user}
+
+	failures := make(map[string]string)
+
+	if key != "" && !backend.UsesPostgres() { //keys are stored in the outbox, as PUSH does
+		return nil, grpcError(backend.ErrNeedsPostgres)
+	}
+
+	if backend.UsesPostgres() {
+
+		id, _, e := backend.EnqueueKeyed(grpcSession(ctx).client, key, []int64{user}, message, time.Time{})
+
+		if e != nil {
+			return nil, grpcError(e)
+		}
+
+		msg, e := backend.AwaitAttempt(ctx, id)
+
+		switch {
+		case e == nil:
+		case ctx.Err() != nil: //the message stays queued
+			return nil, status.FromContextError(ctx.Err()).Err()
+		default:
+			return nil, grpcError(e)
+		}
+
+		for name, connector := range msg.Connectors {
+			if connector.Status == backend.ResultFailed {
+				failures[name] = connector.Error
+			}
+		}
+	} else if failed, errs := backend.PushAll(user, message); failed {
+		for name, e := range errs {
+			failures[name] = e.Error()
+		}
+	}
+
+	for name, e := range failures {
+		reply.Failures = append(reply.Failures, &rpc.ConnectorFailure{Connector: name, Error: e})
+	}
+
+	sort.Slice(reply.Failures, func(i, j int) bool {
+		return reply.Failures[i].Connector < reply.Failures[j].Connector
+	})
+
+	return reply, nil
+}
+
+func (srv *grpcServer) Push(ctx context.Context, req *rpc.PushRequest) (*rpc.PushReply, error) {
+
+	if e := grpcUser(req.User); e != nil {
+		return nil, e
+	}
+
+	if e := grpcPermit(ctx, push, []int64{req.User}); e != nil {
+		return nil, e
+	}
+
+	message, e := grpcMessage(req)
+
+	if e != nil {
+		return nil, e
+	}
+
+	return srv.push(ctx, req.User, req.IdempotencyKey, message)
+}
+
+// PushBatch replies to each push as soon as its first attempt completes, so replies may come back out of order
+func (srv *grpcServer) PushBatch(stream grpc.BidiStreamingServer[rpc.PushRequest, rpc.PushReply]) error {
+
+	replies := make(chan *rpc.PushReply)
+	done := make(chan error, 1)
+
+	go func() {
+		for reply := range replies {
+			if e := stream.Send(reply); e != nil {
+				done <- e
+				for range replies {
+				}
+				return
+			}
+		}
+
+		done <- nil
+	}()
+
+	var (
+		e       error
+		pending = make(chan bool, grpcBatchWorkers)
+	)
+
+	for {
+		var req *rpc.PushRequest
+
+		if req, e = stream.Recv(); e != nil {
+			break
+		}
+
+		if req.User < 0 {
+			replies <- &rpc.PushReply{User: req.User, Failures: []*rpc.ConnectorFailure{{Error: "Invalid user ID"}}}
+			continue
+		}
+
+		invalid := grpcPermit(stream.Context(), push, []int64{req.User})
+
+		var message backend.Message
+
+		if invalid == nil {
+			message, invalid = grpcMessage(req)
+		}
+
+		if invalid != nil {
+			replies <- &rpc.PushReply{User: req.User, Failures: []*rpc.ConnectorFailure{{Error: status.Convert(invalid).Message()}}}
+			continue
+		}
+
+		pending <- true
+
+		go func(user int64, key string, message backend.Message) {
+
+			reply, e := srv.push(stream.Context(), user, key, message)
+
+			if e != nil {
+				reply = &rpc.PushReply{User: user, Failures: []*rpc.ConnectorFailure{{Error: status.Convert(e).Message()}}}
+			}
+
+			replies <- reply
+			<-pending
+		}(req.User, req.IdempotencyKey, message)
+	}
+
+	for i := 0; i < cap(pending); i++ {
+		pending <- true
+	}
+
+	close(replies)
+
+	if sendErr := <-done; sendErr != nil {
+		return sendErr
+	}
+
+	if e == io.EOF {
+		return nil
+	}
+
+	return e
+}
+
+func (srv *grpcServer) Queue(ctx context.Context, req *rpc.PushRequest) (*rpc.QueueReply, error) {
+
+	users := req.Users
+
+	if len(users) == 0 {
+		users = []int64{req.User}
+	}
+
+	for _, user := range users {
+		if e := grpcUser(user); e != nil {
+			return nil, e
+		}
+	}
+
+	cmd := push
+
+	if req.At != 0 {
+		cmd = pushat
+	}
+
+	if e := grpcPermit(ctx, cmd, users); e != nil {
+		return nil, e
+	}
+
+	var at time.Time
+
+	if req.At != 0 {
+		at = time.Unix(req.At, 0)
+	}
+
+	message, e := grpcMessage(req)
+
+	if e != nil {
+		return nil, e
+	}
+
+	id, dup, e := backend.EnqueueKeyed(grpcSession(ctx).client, req.IdempotencyKey, users, message, at)
+
+	if e != nil {
+		return nil, grpcError(e)
+	}
+
+	return &rpc.QueueReply{Id: id, Duplicate: dup}, nil
+}
+
+func (srv *grpcServer) PushStatus(ctx context.Context, req *rpc.PushStatusRequest) (*rpc.PushStatusReply, error) {
+
+	if e := grpcPermit(ctx, pushstatus, req.Id); e != nil {
+		return nil, e
+	}
+
+	status, e := backend.PushStatus(req.Id)
+
+	if e != nil {
+		return nil, grpcError(e)
+	}
+
+	reply := &rpc.PushStatusReply{
+		Id:         status.Id,
+		User:       status.User,
+		Users:      status.Users,
+		Topic:      status.Topic,
+		State:      status.State,
+		Attempts:   int32(status.Attempts),
+		Recipients: status.Recipients,
+		NextTry:    status.NextTry.Unix(),
+		Template:   status.Template,
+		Errors:     status.Errors,
+	}
+
+	for name, connector := range status.Connectors {
+
+		connStatus := &rpc.ConnectorStatus{Connector: name, Status: connector.Status, Error: connector.Error}
+
+		for _, receipt := range connector.Devices {
+			connStatus.Devices = append(connStatus.Devices, &rpc.DeviceReceipt{
+				Token:     receipt.Token,
+				State:     string(receipt.State),
+				MessageId: receipt.MessageId,
+				Canonical: receipt.Canonical,
+				Reason:    receipt.Reason,
+				User:      receipt.User,
+			})
+		}
+
+		reply.Connectors = append(reply.Connectors, connStatus)
+	}
+
+	sort.Slice(reply.Connectors, func(i, j int) bool {
+		return reply.Connectors[i].Connector < reply.Connectors[j].Connector
+	})
+
+	return reply, nil
+}
+
+func (srv *grpcServer) Cancel(ctx context.Context, req *rpc.PushStatusRequest) (*rpc.CancelReply, error) {
+
+	if e := grpcPermit(ctx, cancel, req.Id); e != nil {
+		return nil, e
+	}
+
+	cancelled, e := backend.CancelMessage(req.Id)
+
+	return &rpc.CancelReply{Cancelled: cancelled}, grpcError(e)
+}
+
+func (srv *grpcServer) TopicSubscribe(ctx context.Context, req *rpc.TopicRequest) (*rpc.Empty, error) {
+
+	if e := grpcUser(req.User); e != nil {
+		return nil, e
+	}
+
+	if e := grpcPermit(ctx, topicsub, req.User, req.Topic); e != nil {
+		return nil, e
+	}
+
+	return &rpc.Empty{}, grpcError(backend.TopicSubscribe(req.User, req.Topic))
+}
+
+func (srv *grpcServer) TopicUnsubscribe(ctx context.Context, req *rpc.TopicRequest) (*rpc.Empty, error) {
+
+	if e := grpcPermit(ctx, topicunsub, req.User, req.Topic); e != nil {
+		return nil, e
+	}
+
+	return &rpc.Empty{}, grpcError(backend.TopicUnsubscribe(req.User, req.Topic))
+}
+
+func (srv *grpcServer) TopicList(ctx context.Context, req *rpc.UserRequest) (*rpc.TopicListReply, error) {
+
+	if e := grpcPermit(ctx, topiclist, req.User); e != nil {
+		return nil, e
+	}
+
+	topics, e := backend.TopicList(req.User)
+
+	return &rpc.TopicListReply{Topics: topics}, grpcError(e)
+}
+
+func (srv *grpcServer) PushTopic(ctx context.Context, req *rpc.PushTopicRequest) (*rpc.QueueReply, error) {
+
+	if e := grpcPermit(ctx, pushtopic, req.Topic); e != nil {
+		return nil, e
+	}
+
+	message, e := grpcMessage(req)
+
+	if e != nil {
+		return nil, e
+	}
+
+	id, e := backend.EnqueueTopic(req.Topic, message)
+
+	if e != nil {
+		return nil, grpcError(e)
+	}
+
+	return &rpc.QueueReply{Id: id}, nil
+}
+
+func (srv *grpcServer) Broadcast(ctx context.Context, req *rpc.BroadcastRequest) (*rpc.QueueReply, error) {
+
+	if e := grpcPermit(ctx, broadcast); e != nil {
+		return nil, e
+	}
+
+	if req.Rate < 0 {
+		return nil, status.Error(codes.InvalidArgument, "The rate must not be negative")
+	}
+
+	message, e := grpcMessage(req)
+
+	if e != nil {
+		return nil, e
+	}
+
+	id, e := backend.Broadcast(message, int(req.Rate))
+
+	if e != nil {
+		return nil, grpcError(e)
+	}
+
+	return &rpc.QueueReply{Id: id}, nil
+}
+
+func (srv *grpcServer) BroadcastStatus(ctx context.Context, req *rpc.BroadcastId) (*rpc.BroadcastStatusReply, error) {
+
+	if e := grpcPermit(ctx, bstatus, req.Id); e != nil {
+		return nil, e
+	}
+
+	status, e := backend.BroadcastProgress(req.Id)
+
+	if e != nil {
+		return nil, grpcError(e)
+	}
+
+	return &rpc.BroadcastStatusReply{
+		Id:        status.Id,
+		State:     status.State,
+		Rate:      int32(status.Rate),
+		Total:     status.Total,
+		Processed: status.Processed,
+		Delivered: status.Delivered,
+		Failed:    status.Failed,
+		Removed:   status.Removed,
+		LastError: status.LastError,
+	}, nil
+}
+
+func (srv *grpcServer) CancelBroadcast(ctx context.Context, req *rpc.BroadcastId) (*rpc.CancelReply, error) {
+
+	if e := grpcPermit(ctx, bcancel, req.Id); e != nil {
+		return nil, e
+	}
+
+	cancelled, e := backend.CancelBroadcast(req.Id)
+
+	return &rpc.CancelReply{Cancelled: cancelled}, grpcError(e)
+}
+
+func (srv *grpcServer) SetTemplate(ctx context.Context, req *rpc.Template) (*rpc.Empty, error) {
+
+	if e := grpcPermit(ctx, tplset, req.Name); e != nil {
+		return nil, e
+	}
+
+	tpl := &backend.Template{Name: req.Name, Locale: req.Locale, Body: req.Body}
+
+	if e := tpl.Validate(); e != nil {
+		return nil, status.Error(codes.InvalidArgument, e.Error())
+	}
+
+	return &rpc.Empty{}, grpcError(backend.SetTemplate(tpl))
+}
+
+func (srv *grpcServer) GetTemplate(ctx context.Context, req *rpc.TemplateRequest) (*rpc.Template, error) {
+
+	if e := grpcPermit(ctx, tplget, req.Name); e != nil {
+		return nil, e
+	}
+
+	tpl, e := backend.GetTemplate(req.Name, req.Locale)
+
+	if e != nil {
+		return nil, grpcError(e)
+	}
+
+	return &rpc.Template{Name: tpl.Name, Locale: tpl.Locale, Body: tpl.Body}, nil
+}
+
+func (srv *grpcServer) DeleteTemplate(ctx context.Context, req *rpc.TemplateRequest) (*rpc.Empty, error) {
+
+	if e := grpcPermit(ctx, tpldel, req.Name); e != nil {
+		return nil, e
+	}
+
+	return &rpc.Empty{}, grpcError(backend.DelTemplate(req.Name, req.Locale))
+}
+
+func (srv *grpcServer) SetLocale(ctx context.Context, req *rpc.LocaleRequest) (*rpc.Empty, error) {
+
+	if e := grpcPermit(ctx, setlocale, req.User, req.Locale); e != nil {
+		return nil, e
+	}
+
+	return &rpc.Empty{}, grpcError(backend.SetLocale(req.User, req.Locale))
+}
+
+func (srv *grpcServer) PushTemplate(ctx context.Context, req *rpc.PushTemplateRequest) (*rpc.QueueReply, error) {
+
+	if e := grpcPermit(ctx, pushtpl, req.Users); e != nil {
+		return nil, e
+	}
+
+	var at time.Time
+
+	if req.At != 0 {
+		at = time.Unix(req.At, 0)
+	}
+
+	id, e := backend.EnqueueTemplate(req.Users, req.Template, req.Vars.AsMap(), at)
+
+	if e != nil {
+		return nil, grpcError(e)
+	}
+
+	return &rpc.QueueReply{Id: id}, nil
+}
@@ -17,6 +17,7 @@ import (
 	"io"
 	"log"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/mcilloni/pushed/backend"
@@ -27,33 +28,135 @@ type Status string
 
 const (
 	adduser     command = "ADDUSER"
+	authcmd     command = "AUTH"
+	broadcast   command = "BROADCAST"
+	bcancel     command = "BROADCASTCANCEL"
+	bstatus     command = "BROADCASTSTATUS"
+	cancel      command = "CANCEL"
+	clientadd   command = "CLIENTADD"
+	clientdel   command = "CLIENTDEL"
 	deluser     command = "DELUSER"
 	exists      command = "EXISTS"
 	halt        command = "HALT"
 	push        command = "PUSH"
+	pushat      command = "PUSHAT"
+	pushstatus  command = "PUSHSTATUS"
+	pushtopic   command = "PUSHTOPIC"
+	pushtpl     command = "PUSHTPL"
+	setlocale   command = "SETLOCALE"
 	subscribe   command = "SUBSCRIBE"
 	subscribed  command = "SUBSCRIBED"
+	template    command = "TEMPLATE"
+	tpldel      command = "TEMPLATE DEL"
+	tplget      command = "TEMPLATE GET"
+	tplset      command = "TEMPLATE SET"
+	topiclist   command = "TOPICLIST"
+	topicsub    command = "TOPICSUB"
+	topicunsub  command = "TOPICUNSUB"
 	unsubscribe command = "UNSUBSCRIBE"
 
-	accepted Status = "ACCEPTED"
-	no       Status = "NO"
-	rejected Status = "REJECTED"
-	yes      Status = "YES"
+	accepted  Status = "ACCEPTED"
+	duplicate Status = "DUPLICATE"
+	no        Status = "NO"
+	rejected  Status = "REJECTED"
+	yes       Status = "YES"
 )
 
 var (
-	noResp  = newResponse(no, "Not existent")
-	yesResp = newResponse(yes, "Exists")
+	acceptedResp      = newResponse(accepted, "Request accepted.")
+	internalErrorResp = newResponse(rejected, "Internal error")
+	noResp            = newResponse(no, "Not existent")
+	yesResp           = newResponse(yes, "Exists")
 )
 
 type operation struct {
 	Command    command
 	Parameters []interface{}
+	Key        string //idempotency key of PUSH and PUSHAT
+	Client     string //authenticated client that sent the operation, which owns its idempotency key
 }
 
 type response struct {
-	Status  Status
-	Message string
+	Status  Status `json:"status"`
+	Message string `json:"message"`
+	Id      int64  `json:"id,omitempty"` //ID of the queued message, for PUSH
+
+	Push   *backend.MessageStatus `json:"push,omitempty"`   //for PUSHSTATUS, and PUSH when DUPLICATE
+	Topics []string               `json:"topics,omitempty"` //for TOPICLIST
+
+	Broadcast *backend.BroadcastStatus `json:"broadcast,omitempty"` //for BROADCASTSTATUS
+	Template  *backend.Template        `json:"template,omitempty"`  //for TEMPLATE GET
+}
+
+// users returns the users op acts on, or all if it reaches users that are not known in advance. Operations
+// on devices and queued messages act on the users that own them, which are looked up.
+func (op *operation) users() (users []int64, all bool, e error) {
+
+	switch op.Command {
+	case broadcast, pushtopic:
+		return nil, true, nil
+	case bcancel, bstatus: //broadcasts reach everybody, whoever started them
+		return nil, true, nil
+	case clientadd, clientdel: //a client could give itself, or take from others, any range
+		return nil, true, nil
+	case cancel, pushstatus:
+		if !backend.UsesPostgres() {
+			return nil, false, nil //rejected anyway
+		}
+
+		if users, all, e = backend.MessageRecipients(op.Parameters[0].(int64)); e == backend.ErrUnknownMessage {
+			return nil, false, nil //replies NO
+		}
+
+		return
+	case push, pushat, pushtpl:
+		return op.Parameters[0].([]int64), false, nil
+	case unsubscribe: //the user is ignored, the device matters
+		return deviceOwner(op.Parameters[1].(backend.Connector), op.Parameters[2].(string))
+	case adduser, deluser, exists, setlocale, subscribe, subscribed, topiclist, topicsub, topicunsub:
+		if user, ok := op.Parameters[0].(int64); ok {
+			return []int64{user}, false, nil
+		}
+
+		if op.Command == exists { //EXISTS may be about a device
+			return deviceOwner(op.Parameters[0].(backend.Connector), op.Parameters[1].(string))
+		}
+	}
+
+	return nil, false, nil
+}
+
+// deviceOwner returns the user that registered target on conn, if any, or all if conn cannot tell who owns
+// its devices
+func deviceOwner(conn backend.Connector, target string) ([]int64, bool, error) {
+
+	owners, ok := conn.(backend.DeviceOwner)
+
+	if !ok {
+		return nil, true, nil
+	}
+
+	user, found, e := owners.Owner(target)
+
+	if e != nil || !found {
+		return nil, false, e
+	}
+
+	return []int64{user}, false, nil
+}
+
+// needsPostgres tells if op uses features only the Postgres store has. Without the outbox, PUSH can still be
+// delivered right away, but not deduplicated.
+func (op *operation) needsPostgres() bool {
+
+	switch op.Command {
+	case push:
+		return op.Key != ""
+	case adduser, deluser, exists, halt, subscribe, subscribed, unsubscribe:
+		return false
+	}
+
+	return true
 }
 
 func (resp *response) dump(w io.Writer) (e error) {
@@ -65,7 +168,18 @@ func (resp *response) dump(w io.Writer) (e error) {
 		return
 	}
 
-	_, e = buffer.WriteString(resp.Message)
+	if details := resp.details(); details != nil { //structured replies go on a single line, as JSON
+		var encoded []byte
+
+		if encoded, e = json.Marshal(details); e != nil {
+			return
+		}
+
+		_, e = buffer.Write(encoded)
+	} else {
+		_, e = buffer.WriteString(resp.Message)
+	}
+
 	if e != nil {
 		return
 	}
@@ -81,6 +195,22 @@ func (resp *response) dump(w io.Writer) (e error) {
 
 }
 
+func (resp *response) details() interface{} {
+
+	switch {
+	case resp.Push != nil:
+		return resp.Push
+	case resp.Topics != nil:
+		return resp.Topics
+	case resp.Broadcast != nil:
+		return resp.Broadcast
+	case resp.Template != nil:
+		return resp.Template
+	default:
+		return nil
+	}
+}
+
 func failure(format string, args ...interface{}) (*operation, *response) {
 	return nil, newResponse(rejected, format, args...)
 }
@@ -89,6 +219,8 @@ func newResponse(status Status, format string, args ...interface{}) *response {
 	return &response{Status: status, Message: fmt.Sprintf(format, args...)}
 }
 
+// parseRequest builds the operation of a request. dispatch checks it against the ACL of the client before
+// calling process.
 func parseRequest(head, data []byte) (op *operation, resp *response) {
 
 	fields := bytes.Fields(head)
@@ -99,13 +231,12 @@ func parseRequest(head, data []byte) (op *operation, resp *response) {
 		return failure("Header too short")
 	}
 
-	op = &operation{Command: command(fields[0])}
-	resp = &response{Status: accepted, Message: "Request accepted."}
+	cmd := command(fields[0])
 
-	switch op.Command {
+	switch cmd {
 	case halt:
 
-		op.Parameters = make([]interface{}, 1)
+		op = &operation{Command: cmd, Parameters: make([]interface{}, 1)}
 
 		switch fieldsLen {
 		case 1:
@@ -125,153 +256,635 @@ func parseRequest(head, data []byte) (op *operation, resp *response) {
 			return failure("Too many arguments for %s : %d", fields[0], fieldsLen)
 		}
 
-		return
-
-	case adduser, deluser, exists:
+	case adduser, deluser, exists, topiclist:
 
 		if fieldsLen != 2 {
 			return failure("Wrong number of arguments for %s: %d", fields[0], fieldsLen)
 		}
 
-		val, e := strconv.ParseInt(string(fields[1]), 10, 64)
-
-		if e != nil {
+		if cmd == exists {
 
-			if op.Command == exists {
+			if _, e := strconv.ParseInt(string(fields[1]), 10, 64); e != nil {
 
 				param2 := bytes.SplitN(fields[1], []byte(":"), 2)
 
-				lenParam2 := len(param2)
-
-				if lenParam2 != 2 {
+				if len(param2) != 2 {
 					return failure("Malformed request string")
 				}
 
-				conn := backend.GetConnector(string(param2[0]))
+				op, resp = deviceOp(string(param2[0]), string(param2[1]))
 
-				if conn == nil {
-					return failure("Connector %s does not exist", param2[0])
-				}
+				break
+			}
+		}
 
-				op.Parameters = []interface{}{conn, string(param2[1])}
+		op, resp = userOp(cmd, string(fields[1]))
 
-			} else {
-				return failure("Cannot parse %s as an integer", fields[1])
-			}
+	case subscribed:
 
-		} else {
-			op.Parameters = []interface{}{val}
+		if fieldsLen != 3 {
+			return failure("Wrong number of arguments for SUBSCRIBED: %d", fieldsLen)
 		}
 
-		if op.Command == exists {
-			resp, e = synchronousRequest(op)
+		op, resp = subscribedOp(string(fields[1]), string(fields[2]))
 
-			if e != nil {
-				log.Printf("Error: %s", e.Error())
-				return failure("Internal error")
-			}
+	case subscribe, unsubscribe:
 
-			return
+		if fieldsLen != 3 {
+			return failure("Wrong number of arguments for %s: %d", fields[0], fieldsLen)
+		}
+
+		param2 := bytes.SplitN(fields[2], []byte(":"), 2)
 
+		if len(param2) != 2 {
+			return failure("Malformed request string")
 		}
 
-		break
+		op, resp = subscribeOp(cmd, string(fields[1]), string(param2[0]), string(param2[1]))
 
-	case subscribed:
+	case push:
 
-		op.Parameters = make([]interface{}, 2)
+		if fieldsLen != 2 && fieldsLen != 3 {
+			return failure("Wrong number of arguments for %s: %d", fields[0], fieldsLen)
+		}
 
-		if fieldsLen != 3 {
-			return failure("Wrong number of arguments for SUBSCRIBED: %d", fieldsLen)
+		if op, resp = pushOp(string(fields[1]), data); resp == nil && fieldsLen == 3 {
+			op, resp = keyOp(op, string(fields[2]))
 		}
 
-		val, e := strconv.ParseInt(string(fields[1]), 10, 64)
+	case pushat:
 
-		if e != nil {
-			return failure("Cannot parse %s as a signed integer", fields[1])
+		if fieldsLen != 3 && fieldsLen != 4 {
+			return failure("Wrong number of arguments for %s: %d", fields[0], fieldsLen)
 		}
 
-		conn := backend.GetConnector(string(fields[2]))
+		if op, resp = pushOp(string(fields[1]), data); resp == nil {
+			op, resp = scheduleOp(op, string(fields[2]))
+		}
 
-		if conn == nil {
-			return failure("Connector %s does not exist", string(fields[2]))
+		if resp == nil && fieldsLen == 4 {
+			op, resp = keyOp(op, string(fields[3]))
 		}
 
-		op.Parameters[0], op.Parameters[1] = val, conn
+	case cancel, pushstatus:
 
-		resp, e = synchronousRequest(op)
+		if fieldsLen != 2 {
+			return failure("Wrong number of arguments for %s: %d", fields[0], fieldsLen)
+		}
 
-		if e != nil {
-			log.Printf("Error: %s", e.Error())
-			return failure("Internal error")
+		op, resp = idOp(cmd, string(fields[1]))
+
+	case broadcast:
+
+		switch fieldsLen {
+		case 1:
+			op, resp = broadcastOp("", data)
+		case 2:
+			op, resp = broadcastOp(string(fields[1]), data)
+		default:
+			return failure("Too many arguments for %s : %d", fields[0], fieldsLen)
 		}
 
-		break
+	case bcancel, bstatus:
 
-	case subscribe, unsubscribe:
+		if fieldsLen != 2 {
+			return failure("Wrong number of arguments for %s: %d", fields[0], fieldsLen)
+		}
 
-		op.Parameters = make([]interface{}, 3)
+		op, resp = idOp(cmd, string(fields[1]))
 
-		if fieldsLen != 3 {
+	case pushtopic:
+
+		if fieldsLen != 2 {
 			return failure("Wrong number of arguments for %s: %d", fields[0], fieldsLen)
 		}
 
-		val, e := strconv.ParseInt(string(fields[1]), 10, 64)
+		op, resp = pushTopicOp(string(fields[1]), data)
 
-		if e != nil {
-			return failure("Cannot parse %s as a signed integer", fields[1])
+	case topicsub, topicunsub:
+
+		if fieldsLen != 3 {
+			return failure("Wrong number of arguments for %s: %d", fields[0], fieldsLen)
 		}
 
-		op.Parameters[0] = val
+		op, resp = topicOp(cmd, string(fields[1]), string(fields[2]))
 
-		param2 := bytes.SplitN(fields[2], []byte(":"), 2)
+	case template:
+
+		if fieldsLen < 3 || fieldsLen > 4 {
+			return failure("Wrong number of arguments for %s: %d", fields[0], fieldsLen)
+		}
 
-		lenParam2 := len(param2)
+		op, resp = templateOp(string(fields[1]), fields[2:], data)
 
-		if lenParam2 != 2 {
-			return failure("Malformed request string")
+	case clientadd:
+
+		if fieldsLen != 3 {
+			return failure("Wrong number of arguments for %s: %d", fields[0], fieldsLen)
 		}
 
-		conn := backend.GetConnector(string(param2[0]))
+		op, resp = clientOp(cmd, string(fields[1]), string(fields[2]), data)
 
-		if conn == nil {
-			return failure("Connector %s does not exist", param2[0])
+	case clientdel:
+
+		if fieldsLen != 2 {
+			return failure("Wrong number of arguments for %s: %d", fields[0], fieldsLen)
 		}
 
-		op.Parameters[1], op.Parameters[2] = conn, string(param2[1])
+		op, resp = clientOp(cmd, string(fields[1]), "", nil)
 
-		break
+	case setlocale:
 
-	case push:
+		if fieldsLen != 3 {
+			return failure("Wrong number of arguments for %s: %d", fields[0], fieldsLen)
+		}
 
-		if fieldsLen != 2 {
+		op, resp = setLocaleOp(string(fields[1]), string(fields[2]))
+
+	case pushtpl:
+
+		if fieldsLen != 3 {
 			return failure("Wrong number of arguments for %s: %d", fields[0], fieldsLen)
 		}
 
-		val, e := strconv.ParseInt(string(fields[1]), 10, 64)
+		var users []int64
+
+		if users, resp = parseUsers(string(fields[1])); resp == nil {
+			op, resp = pushTemplateOp(users, string(fields[2]), data)
+		}
+
+	default:
+		return failure("Unknown request %s", fields[0])
+
+	}
+
+	return
+
+}
+
+// process gives the response to a valid operation, running it right away if it is synchronous.
+// Asynchronous operations are ACCEPTED and must be then passed to execOp by the front-end.
+// PUSH, PUSHAT, PUSHTOPIC and PUSHTPL are stored in the outbox before replying, so they are ACCEPTED with the ID of the
+// queued message, and so is BROADCAST with the ID of the broadcast.
+func process(op *operation) *response {
+
+	if !backend.UsesPostgres() {
+
+		if op.needsPostgres() {
+			return newResponse(rejected, "%s needs the postgres storage", op.Command)
+		}
+
+		if op.Command == push {
+			return acceptedResp //delivered right away by execOp
+		}
+	}
+
+	switch op.Command {
+	case broadcast, push, pushat, pushtopic, pushtpl:
+
+		var (
+			id int64
+			e  error
+		)
+
+		switch op.Command {
+		case broadcast:
+			id, e = backend.Broadcast(op.Parameters[1].(backend.Message), op.Parameters[0].(int))
+		case push, pushat:
+
+			var (
+				at  time.Time
+				dup bool
+			)
+
+			if op.Command == pushat {
+				at = op.Parameters[2].(time.Time)
+			}
+
+			id, dup, e = backend.EnqueueKeyed(op.Client, op.Key, op.Parameters[0].([]int64), op.Parameters[1].(backend.Message), at)
+
+			if dup && e == nil {
+				return duplicateResponse(id)
+			}
+
+		case pushtpl:
+			id, e = backend.EnqueueTemplate(op.Parameters[0].([]int64), op.Parameters[1].(string),
+				op.Parameters[2].(map[string]interface{}), time.Time{})
+		default:
+			id, e = backend.EnqueueTopic(op.Parameters[0].(string), op.Parameters[1].(backend.Message))
+		}
+
+		if e == backend.ErrUnknownTemplate {
+			return newResponse(rejected, "Unknown template %s", op.Parameters[1])
+		}
+
 		if e != nil {
-			return failure("Cannot parse %s as a signed integer", fields[1])
+			log.Printf("Error: %s", e.Error())
+			return internalErrorResp
 		}
 
-		var validData backend.Message
+		resp := newResponse(accepted, "%d", id)
+		resp.Id = id
+
+		return resp
+
+	case subscribe:
+		return subscribeResponse(op)
 
-		e = json.Unmarshal(data, &validData)
+	case bcancel, bstatus, cancel, exists, pushstatus, subscribed, tplget, topiclist:
 
-		if data != nil && e != nil {
-			return failure("Malformed json for PUSH request")
+		resp, e := synchronousRequest(op)
+
+		if e != nil {
+			log.Printf("Error: %s", e.Error())
+			return internalErrorResp
 		}
 
-		op.Parameters = []interface{}{val, validData}
+		return resp
 
-		break
+	default:
+		return acceptedResp
+	}
 
+}
+
+// subscribeResponse registers a device right away, so that SUBSCRIBE can be REJECTED past the device cap
+func subscribeResponse(op *operation) *response {
+
+	conn := op.Parameters[1].(backend.Connector)
+
+	switch e := conn.Register(op.Parameters[0].(int64), op.Parameters[2].(string)); e {
+	case nil:
+		return acceptedResp
+	case backend.ErrTooManyDevices:
+		return newResponse(rejected, "%s, unsubscribe one of their devices first", e.Error())
+	case backend.ApnsInvalidToken, backend.WebhookForbiddenHost, backend.WebhookInvalidUrl, backend.WebPushForbiddenHost,
+		backend.WebPushInvalidSubscription:
+		return newResponse(rejected, "%s", e.Error())
+	case backend.ErrDeviceExists:
+		log.Printf("Error: %s", e.Error())
+		return acceptedResp //as when SUBSCRIBE was asynchronous
 	default:
-		return failure("Unknown request %s", op.Command)
+		log.Printf("Error: %s", e.Error())
+		return internalErrorResp
+	}
+}
+
+// duplicateResponse replies to a PUSH whose idempotency key was already used, with the status of the original message
+func duplicateResponse(id int64) *response {
+
+	status, e := backend.PushStatus(id)
 
+	if e != nil {
+		log.Printf("Error: %s", e.Error())
+		return internalErrorResp
 	}
 
-	return
+	return &response{Status: duplicate, Message: "Duplicate", Id: id, Push: status}
+}
 
+func parseUser(user string) (int64, *response) {
+
+	val, e := strconv.ParseInt(user, 10, 64)
+
+	if e != nil {
+		return 0, newResponse(rejected, "Cannot parse %s as a signed integer", user)
+	}
+
+	return val, nil
+}
+
+func getConnector(name string) (backend.Connector, *response) {
+
+	conn := backend.GetConnector(name)
+
+	if conn == nil {
+		return nil, newResponse(rejected, "Connector %s does not exist", name)
+	}
+
+	return conn, nil
+}
+
+// userOp builds ADDUSER, DELUSER, TOPICLIST and EXISTS on user IDs
+func userOp(cmd command, user string) (*operation, *response) {
+
+	val, e := strconv.ParseInt(user, 10, 64)
+
+	if e != nil {
+		return failure("Cannot parse %s as an integer", user)
+	}
+
+	return &operation{Command: cmd, Parameters: []interface{}{val}}, nil
+}
+
+// deviceOp builds EXISTS on device targets
+func deviceOp(connector, target string) (*operation, *response) {
+
+	conn, resp := getConnector(connector)
+
+	if resp != nil {
+		return nil, resp
+	}
+
+	return &operation{Command: exists, Parameters: []interface{}{conn, target}}, nil
+}
+
+func subscribedOp(user, connector string) (*operation, *response) {
+
+	val, resp := parseUser(user)
+
+	if resp != nil {
+		return nil, resp
+	}
+
+	conn, resp := getConnector(connector)
+
+	if resp != nil {
+		return nil, resp
+	}
+
+	return &operation{Command: subscribed, Parameters: []interface{}{val, conn}}, nil
+}
+
+func subscribeOp(cmd command, user, connector, target string) (*operation, *response) {
+
+	val, resp := parseUser(user)
+
+	if resp != nil {
+		return nil, resp
+	}
+
+	conn, resp := getConnector(connector)
+
+	if resp != nil {
+		return nil, resp
+	}
+
+	return &operation{Command: cmd, Parameters: []interface{}{val, conn, target}}, nil
+}
+
+func parseMessage(cmd command, data []byte) (backend.Message, *response) {
+
+	var validData backend.Message
+
+	e := json.Unmarshal(data, &validData)
+
+	if data != nil && e != nil {
+		return validData, newResponse(rejected, "Malformed json for %s request", cmd)
+	}
+
+	if e = validData.Options.Validate(); e != nil {
+		return validData, newResponse(rejected, "Invalid options for %s request: %s", cmd, e.Error())
+	}
+
+	return validData, nil
+}
+
+// pushOp builds PUSH for a comma separated list of users
+func pushOp(users string, data []byte) (*operation, *response) {
+
+	ids, resp := parseUsers(users)
+
+	if resp != nil {
+		return nil, resp
+	}
+
+	return pushUsersOp(ids, data)
+}
+
+func parseUsers(users string) ([]int64, *response) {
+
+	var ids []int64
+
+	for _, user := range strings.Split(users, ",") {
+
+		val, resp := parseUser(user)
+
+		if resp != nil {
+			return nil, resp
+		}
+
+		ids = append(ids, val)
+	}
+
+	return ids, nil
+}
+
+func pushUsersOp(users []int64, data []byte) (*operation, *response) {
+
+	if len(users) == 0 || len(users) > backend.MaxRecipients {
+		return failure("A push must have between 1 and %d users, not %d", backend.MaxRecipients, len(users))
+	}
+
+	validData, resp := parseMessage(push, data)
+
+	if resp != nil {
+		return nil, resp
+	}
+
+	return &operation{Command: push, Parameters: []interface{}{users, validData}}, nil
+}
+
+// scheduleOp turns a PUSH into a PUSHAT, delivered at a unix timestamp or RFC3339 time
+func scheduleOp(op *operation, at string) (*operation, *response) {
+
+	var when time.Time
+
+	if secs, e := strconv.ParseInt(at, 10, 64); e == nil {
+		when = time.Unix(secs, 0)
+	} else if when, e = time.Parse(time.RFC3339, at); e != nil {
+		return failure("Cannot parse %s as a unix timestamp or RFC3339 time", at)
+	}
+
+	return &operation{Command: pushat, Parameters: append(op.Parameters, when), Key: op.Key}, nil
+}
+
+// keyOp sets the idempotency key of a PUSH or PUSHAT
+func keyOp(op *operation, key string) (*operation, *response) {
+
+	if !backend.ValidIdempotencyKey(key) {
+		return failure("Invalid idempotency key %s", key)
+	}
+
+	op.Key = key
+
+	return op, nil
+}
+
+func pushTopicOp(topic string, data []byte) (*operation, *response) {
+
+	if !backend.ValidTopicName(topic) {
+		return failure("Invalid topic name %s", topic)
+	}
+
+	validData, resp := parseMessage(pushtopic, data)
+
+	if resp != nil {
+		return nil, resp
+	}
+
+	return &operation{Command: pushtopic, Parameters: []interface{}{topic, validData}}, nil
+}
+
+// topicOp builds TOPICSUB and TOPICUNSUB
+func topicOp(cmd command, user, topic string) (*operation, *response) {
+
+	val, resp := parseUser(user)
+
+	if resp != nil {
+		return nil, resp
+	}
+
+	if !backend.ValidTopicName(topic) {
+		return failure("Invalid topic name %s", topic)
+	}
+
+	return &operation{Command: cmd, Parameters: []interface{}{val, topic}}, nil
+}
+
+// idOp builds the commands on message and broadcast IDs
+func idOp(cmd command, id string) (*operation, *response) {
+
+	val, e := strconv.ParseInt(id, 10, 64)
+
+	if e != nil {
+		return failure("Cannot parse %s as an integer", id)
+	}
+
+	return &operation{Command: cmd, Parameters: []interface{}{val}}, nil
+}
+
+// broadcastOp builds BROADCAST, with the configured rate if rate is empty
+func broadcastOp(rate string, data []byte) (*operation, *response) {
+
+	val := 0
+
+	if rate != "" {
+
+		var e error
+
+		if val, e = strconv.Atoi(rate); e != nil || val <= 0 {
+			return failure("Invalid rate %s, must be a positive integer", rate)
+		}
+	}
+
+	validData, resp := parseMessage(broadcast, data)
+
+	if resp != nil {
+		return nil, resp
+	}
+
+	return &operation{Command: broadcast, Parameters: []interface{}{val, validData}}, nil
+}
+
+// templateOp builds TEMPLATE SET <name> <locale>, whose data line is the template, TEMPLATE GET <name> <locale>
+// and TEMPLATE DEL <name> [locale], which deletes every locale if none is given
+func templateOp(sub string, args [][]byte, data []byte) (*operation, *response) {
+
+	cmd := command(string(template) + " " + strings.ToUpper(sub))
+
+	switch cmd {
+	case tplset, tplget, tpldel:
+	default:
+		return failure("Unknown %s operation %s", template, sub)
+	}
+
+	if len(args) != 2 && (cmd != tpldel || len(args) != 1) {
+		return failure("Wrong number of arguments for %s: %d", cmd, len(args)+2)
+	}
+
+	tpl := &backend.Template{Name: string(args[0])}
+
+	if len(args) == 2 {
+		tpl.Locale = string(args[1])
+	}
+
+	if cmd == tplset {
+
+		tpl.Body = string(bytes.TrimRight(data, "\r\n"))
+
+		if e := tpl.Validate(); e != nil {
+			return failure("Invalid template for %s request: %s", cmd, e.Error())
+		}
+	}
+
+	return &operation{Command: cmd, Parameters: []interface{}{tpl}}, nil
+}
+
+// clientOp builds CLIENTADD <id> <secret>, whose data line is its optional ACL, and CLIENTDEL <id>
+func clientOp(cmd command, id, secret string, data []byte) (*operation, *response) {
+
+	if !backend.ValidClientId(id) {
+		return failure("Invalid client ID %s", id)
+	}
+
+	if cmd == clientdel {
+		return &operation{Command: cmd, Parameters: []interface{}{id}}, nil
+	}
+
+	if len(secret) < backend.MinSecretLength {
+		return failure("%s", backend.ErrInvalidSecret.Error())
+	}
+
+	var acl *backend.Acl
+
+	if len(bytes.TrimSpace(data)) > 0 {
+
+		acl = new(backend.Acl)
+
+		if json.Unmarshal(data, acl) != nil {
+			return failure("Malformed json for %s request", cmd)
+		}
+
+		for _, users := range acl.Users {
+			if users.From > users.To {
+				return failure("Invalid user range %d-%d", users.From, users.To)
+			}
+		}
+	}
+
+	return &operation{Command: cmd, Parameters: []interface{}{id, secret, acl}}, nil
+}
+
+func setLocaleOp(user, locale string) (*operation, *response) {
+
+	val, resp := parseUser(user)
+
+	if resp != nil {
+		return nil, resp
+	}
+
+	if !backend.ValidLocale(locale) {
+		return failure("Invalid locale %s", locale)
+	}
+
+	return &operation{Command: setlocale, Parameters: []interface{}{val, locale}}, nil
+}
+
+// pushTemplateOp builds PUSHTPL, whose data line is an object with the variables of the template
+func pushTemplateOp(users []int64, name string, data []byte) (*operation, *response) {
+
+	if len(users) == 0 || len(users) > backend.MaxRecipients {
+		return failure("A push must have between 1 and %d users, not %d", backend.MaxRecipients, len(users))
+	}
+
+	if !backend.ValidTemplateName(name) {
+		return failure("Invalid template name %s", name)
+	}
+
+	var vars map[string]interface{}
+
+	if len(bytes.TrimSpace(data)) > 0 {
+
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+
+		if dec.Decode(&vars) != nil {
+			return failure("Malformed json for %s request", pushtpl)
+		}
+	}
+
+	return &operation{Command: pushtpl, Parameters: []interface{}{users, name, vars}}, nil
 }
 
 func synchronousRequest(op *operation) (resp *response, e error) {
@@ -279,6 +892,69 @@ func synchronousRequest(op *operation) (resp *response, e error) {
 	var b bool
 
 	switch op.Command {
+	case bcancel:
+
+		b, e = backend.CancelBroadcast(op.Parameters[0].(int64))
+
+	case cancel:
+
+		b, e = backend.CancelMessage(op.Parameters[0].(int64))
+
+	case bstatus:
+
+		status, e := backend.BroadcastProgress(op.Parameters[0].(int64))
+
+		switch e {
+		case nil:
+			return &response{Status: yes, Message: "Broadcast found", Broadcast: status}, nil
+		case backend.ErrUnknownBroadcast:
+			return noResp, nil
+		default:
+			return nil, e
+		}
+
+	case tplget:
+
+		tpl := op.Parameters[0].(*backend.Template)
+
+		found, e := backend.GetTemplate(tpl.Name, tpl.Locale)
+
+		switch e {
+		case nil:
+			return &response{Status: yes, Message: "Template found", Template: found}, nil
+		case backend.ErrUnknownTemplate:
+			return noResp, nil
+		default:
+			return nil, e
+		}
+
+	case topiclist:
+
+		topics, e := backend.TopicList(op.Parameters[0].(int64))
+
+		if e != nil {
+			return nil, e
+		}
+
+		if len(topics) == 0 {
+			return noResp, nil
+		}
+
+		return &response{Status: yes, Message: "Subscribed topics", Topics: topics}, nil
+
+	case pushstatus:
+
+		status, e := backend.PushStatus(op.Parameters[0].(int64))
+
+		switch e {
+		case nil:
+			return &response{Status: yes, Message: "Message found", Push: status}, nil
+		case backend.ErrUnknownMessage:
+			return noResp, nil
+		default:
+			return nil, e
+		}
+
 	case exists:
 
 		if len(op.Parameters) == 2 {
@@ -0,0 +1,372 @@
+/*  Pushed - a daemon for parallel handling of push operations to mobile devices
+ *  Copyright (C) 2014  Marco Cilloni <marco.cilloni@yahoo.com>
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *  Exhibit B is not attached; this software is compatible with the
+ *  licenses expressed under Section 1.12 of the MPL v2.
+ */
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+)
+
+const (
+	maxBodySize = 1 << 20
+)
+
+// restHandler exposes the same operations of the line protocol as a REST API.
+// Operations are built and run through the same code paths used by dispatch.
+type restHandler struct {
+	mux  *http.ServeMux
+	auth *authenticator //nil if clients need not authenticate
+}
+
+type restDevice struct {
+	Token json.RawMessage `json:"token"`
+}
+
+type restPush struct {
+	Users []int64         `json:"users"`
+	Data  json.RawMessage `json:"data"`
+	At    string          `json:"at"` //optional, like the time of PUSHAT
+}
+
+type restTemplatePush struct {
+	Users []int64         `json:"users"`
+	Vars  json.RawMessage `json:"vars"`
+}
+
+// restPushAt schedules op, if the request asked for it, and sets its Idempotency-Key
+func restPushAt(r *http.Request, op *operation, resp *response, at string) (*operation, *response) {
+
+	if resp == nil && at != "" {
+		op, resp = scheduleOp(op, at)
+	}
+
+	if key := r.Header.Get("Idempotency-Key"); resp == nil && key != "" {
+		op, resp = keyOp(op, key)
+	}
+
+	return op, resp
+}
+
+func newRestHandler(auth *authenticator) *restHandler {
+
+	rest := &restHandler{mux: http.NewServeMux(), auth: auth}
+
+	rest.mux.HandleFunc("PUT /users/{id}", func(w http.ResponseWriter, r *http.Request) {
+		rest.serveOp(w, r, func() (*operation, *response) {
+			return userOp(adduser, r.PathValue("id"))
+		})
+	})
+
+	rest.mux.HandleFunc("DELETE /users/{id}", func(w http.ResponseWriter, r *http.Request) {
+		rest.serveOp(w, r, func() (*operation, *response) {
+			return userOp(deluser, r.PathValue("id"))
+		})
+	})
+
+	rest.mux.HandleFunc("GET /users/{id}", func(w http.ResponseWriter, r *http.Request) {
+		rest.serveOp(w, r, func() (*operation, *response) {
+			return userOp(exists, r.PathValue("id"))
+		})
+	})
+
+	rest.mux.HandleFunc("GET /users/{id}/devices/{connector}", func(w http.ResponseWriter, r *http.Request) {
+		rest.serveOp(w, r, func() (*operation, *response) {
+			return subscribedOp(r.PathValue("id"), r.PathValue("connector"))
+		})
+	})
+
+	rest.mux.HandleFunc("POST /users/{id}/devices/{connector}", func(w http.ResponseWriter, r *http.Request) {
+		rest.serveOp(w, r, func() (*operation, *response) {
+
+			token, resp := readToken(w, r)
+
+			if resp != nil {
+				return nil, resp
+			}
+
+			return subscribeOp(subscribe, r.PathValue("id"), r.PathValue("connector"), token)
+		})
+	})
+
+	rest.mux.HandleFunc("GET /devices/{connector}/{token}", func(w http.ResponseWriter, r *http.Request) {
+		rest.serveOp(w, r, func() (*operation, *response) {
+			return deviceOp(r.PathValue("connector"), r.PathValue("token"))
+		})
+	})
+
+	rest.mux.HandleFunc("DELETE /devices/{connector}/{token}", func(w http.ResponseWriter, r *http.Request) {
+		rest.serveOp(w, r, func() (*operation, *response) {
+			//UNSUBSCRIBE ignores the user, so any valid one will do
+			return subscribeOp(unsubscribe, "0", r.PathValue("connector"), r.PathValue("token"))
+		})
+	})
+
+	rest.mux.HandleFunc("POST /users/{id}/push", func(w http.ResponseWriter, r *http.Request) {
+		rest.serveOp(w, r, func() (*operation, *response) {
+
+			data, e := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+
+			if e != nil {
+				return failure("Cannot read request body")
+			}
+
+			op, resp := pushOp(r.PathValue("id"), data)
+
+			return restPushAt(r, op, resp, r.URL.Query().Get("at"))
+		})
+	})
+
+	rest.mux.HandleFunc("POST /push", func(w http.ResponseWriter, r *http.Request) {
+		rest.serveOp(w, r, func() (*operation, *response) {
+
+			var push restPush
+
+			if e := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodySize)).Decode(&push); e != nil {
+				return failure("Malformed json for push")
+			}
+
+			op, resp := pushUsersOp(push.Users, push.Data)
+
+			return restPushAt(r, op, resp, push.At)
+		})
+	})
+
+	rest.mux.HandleFunc("GET /users/{id}/topics", func(w http.ResponseWriter, r *http.Request) {
+		rest.serveOp(w, r, func() (*operation, *response) {
+			return userOp(topiclist, r.PathValue("id"))
+		})
+	})
+
+	rest.mux.HandleFunc("PUT /users/{id}/topics/{topic}", func(w http.ResponseWriter, r *http.Request) {
+		rest.serveOp(w, r, func() (*operation, *response) {
+			return topicOp(topicsub, r.PathValue("id"), r.PathValue("topic"))
+		})
+	})
+
+	rest.mux.HandleFunc("DELETE /users/{id}/topics/{topic}", func(w http.ResponseWriter, r *http.Request) {
+		rest.serveOp(w, r, func() (*operation, *response) {
+			return topicOp(topicunsub, r.PathValue("id"), r.PathValue("topic"))
+		})
+	})
+
+	rest.mux.HandleFunc("POST /topics/{topic}/push", func(w http.ResponseWriter, r *http.Request) {
+		rest.serveOp(w, r, func() (*operation, *response) {
+
+			data, e := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+
+			if e != nil {
+				return failure("Cannot read request body")
+			}
+
+			return pushTopicOp(r.PathValue("topic"), data)
+		})
+	})
+
+	rest.mux.HandleFunc("GET /messages/{id}", func(w http.ResponseWriter, r *http.Request) {
+		rest.serveOp(w, r, func() (*operation, *response) {
+			return idOp(pushstatus, r.PathValue("id"))
+		})
+	})
+
+	rest.mux.HandleFunc("DELETE /messages/{id}", func(w http.ResponseWriter, r *http.Request) {
+		rest.serveOp(w, r, func() (*operation, *response) {
+			return idOp(cancel, r.PathValue("id"))
+		})
+	})
+
+	rest.mux.HandleFunc("POST /broadcasts", func(w http.ResponseWriter, r *http.Request) {
+		rest.serveOp(w, r, func() (*operation, *response) {
+
+			data, e := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+
+			if e != nil {
+				return failure("Cannot read request body")
+			}
+
+			return broadcastOp(r.URL.Query().Get("rate"), data)
+		})
+	})
+
+	rest.mux.HandleFunc("GET /broadcasts/{id}", func(w http.ResponseWriter, r *http.Request) {
+		rest.serveOp(w, r, func() (*operation, *response) {
+			return idOp(bstatus, r.PathValue("id"))
+		})
+	})
+
+	rest.mux.HandleFunc("DELETE /broadcasts/{id}", func(w http.ResponseWriter, r *http.Request) {
+		rest.serveOp(w, r, func() (*operation, *response) {
+			return idOp(bcancel, r.PathValue("id"))
+		})
+	})
+
+	rest.mux.HandleFunc("PUT /templates/{name}/{locale}", func(w http.ResponseWriter, r *http.Request) {
+		rest.serveOp(w, r, func() (*operation, *response) {
+
+			data, e := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+
+			if e != nil {
+				return failure("Cannot read request body")
+			}
+
+			return templateOp("SET", [][]byte{[]byte(r.PathValue("name")), []byte(r.PathValue("locale"))}, data)
+		})
+	})
+
+	rest.mux.HandleFunc("GET /templates/{name}/{locale}", func(w http.ResponseWriter, r *http.Request) {
+		rest.serveOp(w, r, func() (*operation, *response) {
+			return templateOp("GET", [][]byte{[]byte(r.PathValue("name")), []byte(r.PathValue("locale"))}, nil)
+		})
+	})
+
+	rest.mux.HandleFunc("DELETE /templates/{name}/{locale}", func(w http.ResponseWriter, r *http.Request) {
+		rest.serveOp(w, r, func() (*operation, *response) {
+			return templateOp("DEL", [][]byte{[]byte(r.PathValue("name")), []byte(r.PathValue("locale"))}, nil)
+		})
+	})
+
+	rest.mux.HandleFunc("DELETE /templates/{name}", func(w http.ResponseWriter, r *http.Request) {
+		rest.serveOp(w, r, func() (*operation, *response) {
+			return templateOp("DEL", [][]byte{[]byte(r.PathValue("name"))}, nil)
+		})
+	})
+
+	rest.mux.HandleFunc("POST /templates/{name}/push", func(w http.ResponseWriter, r *http.Request) {
+		rest.serveOp(w, r, func() (*operation, *response) {
+
+			var push restTemplatePush
+
+			if e := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodySize)).Decode(&push); e != nil {
+				return failure("Malformed json for template push")
+			}
+
+			return pushTemplateOp(push.Users, r.PathValue("name"), push.Vars)
+		})
+	})
+
+	rest.mux.HandleFunc("PUT /users/{id}/locale/{locale}", func(w http.ResponseWriter, r *http.Request) {
+		rest.serveOp(w, r, func() (*operation, *response) {
+			return setLocaleOp(r.PathValue("id"), r.PathValue("locale"))
+		})
+	})
+
+	return rest
+}
+
+func (rest *restHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rest.mux.ServeHTTP(w, r)
+}
+
+// readToken accepts the device token either as a JSON string or, for connectors like webpush, as a JSON object
+func readToken(w http.ResponseWriter, r *http.Request) (string, *response) {
+
+	var device restDevice
+
+	if e := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodySize)).Decode(&device); e != nil || len(device.Token) == 0 {
+		return "", newResponse(rejected, "Malformed json for device token")
+	}
+
+	var token string
+
+	if e := json.Unmarshal(device.Token, &token); e == nil {
+		return token, nil
+	}
+
+	var compacted bytes.Buffer
+
+	if e := json.Compact(&compacted, device.Token); e != nil {
+		return "", newResponse(rejected, "Malformed json for device token")
+	}
+
+	return compacted.String(), nil
+}
+
+func statusCode(resp *response) int {
+
+	switch {
+	case resp == internalErrorResp:
+		return http.StatusInternalServerError
+	case resp == authRequiredResp, resp == authFailedResp:
+		return http.StatusUnauthorized
+	case resp == authLockedResp, resp == authBusyResp:
+		return http.StatusTooManyRequests
+	case resp.Status == accepted:
+		return http.StatusAccepted
+	case resp.Status == yes, resp.Status == duplicate:
+		return http.StatusOK
+	case resp.Status == no:
+		return http.StatusNotFound
+	default:
+		return http.StatusBadRequest
+	}
+
+}
+
+// serveOp authenticates the client with HTTP basic authentication and replies like dispatch does, then executes
+// accepted operations
+func (rest *restHandler) serveOp(w http.ResponseWriter, r *http.Request, build func() (*operation, *response)) {
+
+	var (
+		op   *operation
+		code int
+	)
+
+	id, secret, given := r.BasicAuth()
+
+	sess, resp := rest.auth.login(hostOf(r.RemoteAddr), id, secret, given)
+
+	if resp == nil {
+		op, resp = build()
+	}
+
+	if resp == nil {
+		op.Client = sess.client
+
+		if resp = sess.permit(op); resp != nil && resp != internalErrorResp {
+			code = http.StatusForbidden
+		}
+	}
+
+	if resp == nil {
+		resp = process(op)
+	}
+
+	if code == 0 {
+		code = statusCode(resp)
+	}
+
+	if code == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Basic realm="pushed"`)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+
+	if e := json.NewEncoder(w).Encode(resp); e != nil {
+		log.Printf("Error in REST reply: %s", e.Error())
+		return
+	}
+
+	if resp.Status != accepted {
+		return
+	}
+
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+
+	if e := execOp(op, nil); e != nil {
+		log.Printf("Error in REST request %s %s: %s", r.Method, r.URL.Path, e.Error())
+	}
+
+}
@@ -13,6 +13,10 @@ package server
 import (
 	"log"
 	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/mcilloni/pushed/backend"
 )
@@ -21,14 +25,15 @@ const (
 	BuffSize = 10
 )
 
-func InitDatabase(configPath string) (e error) {
+// MigrateDatabase migrates the configured store to the target schema version, the latest if negative
+func MigrateDatabase(configPath string, target int) (e error) {
 
 	conf, e := parse(configPath)
 	if e != nil {
 		return
 	}
 
-	return backend.InitDb(conf.Postgres)
+	return backend.Migrate(conf.Storage, conf.storeSource(), conf.instances(), target)
 
 }
 
@@ -50,20 +55,34 @@ func serveConfig(config *config, stop <-chan bool) (e error) {
 	var (
 		failure  = make(chan bool)
 		forward  = make(chan command, 10)
-		incoming = make(chan net.Conn, 10)
+		incoming = make(chan *session, 10)
 		srv      net.Listener
 		wait     = make(chan bool)
 	)
 
-	if e = backend.InitGcm(config.Gcm); e != nil {
+	if e = config.openStore(); e != nil {
 		return
 	}
 
-	if e = backend.ConnectDb(config.Postgres); e != nil {
+	defer backend.CloseStore()
+
+	for _, connector := range config.Connectors {
+		if e = backend.InitConnector(connector.Type, connector.Name, connector.Settings, connector.Devices); e != nil {
+			return
+		}
+	}
+
+	if e = backend.StartOutbox(&config.Outbox); e != nil {
 		return
 	}
 
-	defer backend.CloseDb()
+	defer backend.StopOutbox()
+
+	if e = backend.StartBroadcasts(&config.Broadcast); e != nil {
+		return
+	}
+
+	defer backend.StopBroadcasts()
 
 	if config.Listen.TcpInfo != "" {
 		srv, e = net.Listen("tcp", config.Listen.TcpInfo)
@@ -77,8 +96,88 @@ func serveConfig(config *config, stop <-chan bool) (e error) {
 
 	defer srv.Close()
 
+	var reloader *tlsReloader
+
+	if config.Listen.Tls != nil {
+
+		if reloader, e = newTlsReloader(config.Listen.Tls); e != nil {
+			return e
+		}
+
+		srv = reloader.listener(srv)
+
+		hangup, done := make(chan os.Signal, 1), make(chan bool)
+		signal.Notify(hangup, syscall.SIGHUP)
+
+		defer close(done)
+		defer signal.Stop(hangup)
+
+		go func() { //SIGHUP reloads the certificates
+			for {
+				select {
+				case <-hangup:
+					if e := reloader.reload(); e != nil {
+						log.Printf("Cannot reload TLS certificates, keeping the current ones: %s", e.Error())
+					}
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+
+	auth := newAuthenticator(&config.Auth)
+
+	if config.Listen.Http != "" {
+
+		restListener, e := net.Listen("tcp", config.Listen.Http)
+
+		if e != nil {
+			return e
+		}
+
+		if reloader != nil {
+			restListener = reloader.listener(restListener, "h2", "http/1.1")
+		}
+
+		restSrv := &http.Server{Handler: newRestHandler(auth)}
+
+		go func() {
+			log.Printf("Serving REST API on %s", config.Listen.Http)
+
+			if e := restSrv.Serve(restListener); e != http.ErrServerClosed {
+				log.Printf("REST API failure: %s", e.Error())
+				failure <- true
+			}
+		}()
+
+		defer restSrv.Close()
+	}
+
+	if config.Listen.Grpc != "" {
+
+		grpcListener, e := net.Listen("tcp", config.Listen.Grpc)
+
+		if e != nil {
+			return e
+		}
+
+		grpcSrv := newGrpcServer(auth, reloader)
+
+		go func() {
+			log.Printf("Serving gRPC on %s", config.Listen.Grpc)
+
+			if e := grpcSrv.Serve(grpcListener); e != nil {
+				log.Printf("gRPC failure: %s", e.Error())
+				failure <- true
+			}
+		}()
+
+		defer grpcSrv.Stop()
+	}
+
 	for i := uint8(0); i < config.Dispatchers; i++ {
-		go dispatch(incoming, forward, wait)
+		go dispatch(incoming, auth, forward, wait)
 	}
 
 	go func() {
@@ -94,7 +193,7 @@ func serveConfig(config *config, stop <-chan bool) (e error) {
 				break
 			}
 
-			incoming <- conn
+			incoming <- &session{conn: conn}
 		}
 	}()
 
@@ -0,0 +1,624 @@
+/*  Pushed - a daemon for parallel handling of push operations to mobile devices
+ *  Copyright (C) 2014  Marco Cilloni <marco.cilloni@yahoo.com>
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *  Exhibit B is not attached; this software is compatible with the
+ *  licenses expressed under Section 1.12 of the MPL v2.
+ */
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mcilloni/pushed/backend"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// lineClient speaks the line protocol over a single connection
+type lineClient struct {
+	t    *testing.T
+	conn net.Conn
+	read *bufio.Reader
+}
+
+func (client *lineClient) request(head, data string) string {
+
+	if _, e := client.conn.Write([]byte(head + "\n" + data + "\n")); e != nil {
+		client.t.Fatal(e)
+	}
+
+	reply, e := client.read.ReadString('\n')
+
+	if e != nil {
+		client.t.Fatal(e)
+	}
+
+	return strings.TrimSuffix(reply, "\n")
+}
+
+func (client *lineClient) expect(head, data, prefix string) {
+
+	if reply := client.request(head, data); !strings.HasPrefix(reply, prefix) {
+		client.t.Errorf("%s replied %q, expected %s", head, reply, prefix)
+	}
+}
+
+// TestServeMemory runs pushed on the memory store, pushing through a webhook to a local HTTP server
+func TestServeMemory(t *testing.T) {
+
+	hooks := make(chan []byte, 1)
+
+	hookSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		hooks <- body
+	}))
+
+	defer hookSrv.Close()
+
+	socket := filepath.Join(t.TempDir(), "pushed.sock")
+
+	conf := &config{
+		Listen:      &connParams{Socket: socket},
+		Storage:     backend.StorageMemory,
+		Dispatchers: 2,
+		Connectors: []connectorConfig{{Type: "webhook", Name: "hook", Settings: json.RawMessage(`{"Secret": "secret", "AllowedHosts": ["127.0.0.1/32"]}`),
+			Devices: backend.DevicePolicy{MaxDevices: 1}}},
+	}
+
+	served := make(chan error, 1)
+
+	go func() {
+		served <- serveConfig(conf, nil)
+	}()
+
+	var (
+		conn net.Conn
+		e    error
+	)
+
+	for i := 0; i < 100; i++ {
+		if conn, e = net.Dial("unix", socket); e == nil {
+			break
+		}
+
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	defer conn.Close()
+
+	client := &lineClient{t: t, conn: conn, read: bufio.NewReader(conn)}
+
+	client.expect("ADDUSER 1", "", "ACCEPTED")
+	client.expect("EXISTS 1", "", "YES")
+	client.expect("SUBSCRIBE 1 hook:"+hookSrv.URL, "", "ACCEPTED")
+	client.expect("SUBSCRIBED 1 hook", "", "YES")
+	client.expect("SUBSCRIBE 1 hook:"+hookSrv.URL+"/other", "", "REJECTED "+backend.ErrTooManyDevices.Error())
+	client.expect("PUSH 1", `{"data": {"text": "hello"}}`, "ACCEPTED")
+
+	select {
+	case body := <-hooks:
+
+		var payload struct {
+			User    int64
+			Message map[string]interface{}
+		}
+
+		if e = json.Unmarshal(body, &payload); e != nil || payload.User != 1 || payload.Message["text"] != "hello" {
+			t.Errorf("Unexpected webhook payload %s", body)
+		}
+
+	case <-time.After(5 * time.Second):
+		t.Error("The webhook got no push")
+	}
+
+	client.expect("PUSHAT 1 4102444800", `{"data": {}}`, "REJECTED PUSHAT needs the postgres storage")
+	client.expect("DELUSER 1", "", "ACCEPTED")
+	client.expect("SUBSCRIBED 1 hook", "", "NO")
+	client.expect("HALT", "", "ACCEPTED")
+
+	select {
+	case e = <-served:
+		if e != nil {
+			t.Error(e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("The server did not halt")
+	}
+}
+
+func TestParseAuthTls(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "pushed.json")
+
+	for _, test := range []struct {
+		listen string
+		valid  bool
+	}{
+		{`{"TcpInfo": "127.0.0.1:0", "Http": "127.0.0.1:0"}`, false},
+		{`{"TcpInfo": "127.0.0.1:0", "Grpc": "127.0.0.1:0"}`, false},
+		{`{"TcpInfo": "127.0.0.1:0", "Http": "127.0.0.1:0", "Tls": {"Cert": "cert.pem", "Key": "key.pem"}}`, true},
+		{`{"TcpInfo": "127.0.0.1:0"}`, true},
+	} {
+		ioutil.WriteFile(path, []byte(`{"Listen": `+test.listen+`, "Storage": "memory", "Auth": {"Required": true}}`), 0600)
+
+		if _, e := parse(path); (e == nil) != test.valid {
+			t.Errorf("Listen %s with Auth.Required should be valid: %v, got %v", test.listen, test.valid, e)
+		}
+	}
+}
+
+func TestAuthCache(t *testing.T) {
+
+	hash, e := backend.HashSecret("correct horse battery staple")
+
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	auth := newAuthenticator(&authConfig{Required: true, Clients: []authClient{{Id: "app", Secret: hash}}, MaxChecks: 1})
+
+	if _, ok, e := auth.check("app", "correct horse battery staple"); !ok || e != nil {
+		t.Fatalf("Right secret refused, error %v", e)
+	}
+
+	auth.checks <- true //a secret is being hashed
+
+	if _, ok, e := auth.check("app", "correct horse battery staple"); !ok || e != nil {
+		t.Errorf("Verified secret hashed again, error %v", e)
+	}
+
+	if _, ok, e := auth.check("app", "wrong horse battery staple"); ok || e != errAuthBusy {
+		t.Errorf("Expected errAuthBusy for a new secret with MaxChecks reached, got %v", e)
+	}
+
+	<-auth.checks
+
+	if _, ok, e := auth.check("app", "wrong horse battery staple"); ok || e != nil {
+		t.Errorf("Wrong secret accepted, error %v", e)
+	}
+}
+
+func TestAuthPruneFailures(t *testing.T) {
+
+	auth := newAuthenticator(&authConfig{Required: true})
+	now := time.Now()
+
+	auth.failures["stale"] = &authFailures{count: 1, last: now.Add(-2 * auth.config.Lockout)}
+	auth.failures["recent"] = &authFailures{count: 1, last: now}
+	auth.failures["locked"] = &authFailures{last: now.Add(-2 * auth.config.Lockout), until: now.Add(time.Minute)}
+
+	auth.pruneFailures(now)
+
+	if _, ok := auth.failures["stale"]; ok || len(auth.failures) != 2 {
+		t.Errorf("Expected only the stale address to be dropped, got %v", auth.failures)
+	}
+
+	for i := 0; i < authFailuresSize; i++ {
+		auth.failures[strconv.Itoa(i)] = &authFailures{count: 1, last: now}
+	}
+
+	auth.pruneFailures(now)
+
+	if _, ok := auth.failures["locked"]; !ok || len(auth.failures) != 1 {
+		t.Errorf("Expected only the locked out address to be kept when full, got %d addresses", len(auth.failures))
+	}
+}
+
+// ownedConnector knows the owner of each of its devices
+type ownedConnector struct {
+	owners map[string]int64
+}
+
+func (owned *ownedConnector) Exists(deviceTargetId string) (bool, error) {
+	_, found := owned.owners[deviceTargetId]
+	return found, nil
+}
+
+func (owned *ownedConnector) Owner(deviceTargetId string) (int64, bool, error) {
+	user, found := owned.owners[deviceTargetId]
+	return user, found, nil
+}
+
+func (owned *ownedConnector) Push(user int64, message backend.Message) ([]backend.Receipt, error) {
+	return nil, backend.ErrNotRegistered
+}
+
+func (owned *ownedConnector) Register(user int64, deviceTargetId string) error { return nil }
+func (owned *ownedConnector) Subscribed(user int64) (bool, error)              { return false, nil }
+func (owned *ownedConnector) Unregister(deviceTargetId string) error           { return nil }
+
+func TestPermitOwners(t *testing.T) {
+
+	sess := &session{client: "app", acl: &backend.Acl{Commands: []string{"*"}, Users: []backend.UserRange{{From: 0, To: 9}}}}
+	conn := &ownedConnector{owners: map[string]int64{"mine": 5, "theirs": 20}}
+
+	for _, test := range []struct {
+		op      *operation
+		allowed bool
+	}{
+		{&operation{Command: unsubscribe, Parameters: []interface{}{int64(1), conn, "mine"}}, true},
+		{&operation{Command: unsubscribe, Parameters: []interface{}{int64(1), conn, "theirs"}}, false},
+		{&operation{Command: unsubscribe, Parameters: []interface{}{int64(1), conn, "missing"}}, true},
+		{&operation{Command: exists, Parameters: []interface{}{conn, "theirs"}}, false},
+		{&operation{Command: exists, Parameters: []interface{}{conn, "mine"}}, true},
+		{&operation{Command: bstatus, Parameters: []interface{}{int64(1)}}, false},
+		{&operation{Command: bcancel, Parameters: []interface{}{int64(1)}}, false},
+		{&operation{Command: clientadd, Parameters: []interface{}{"other"}}, false},
+		{&operation{Command: clientdel, Parameters: []interface{}{"other"}}, false},
+	} {
+		if resp := sess.permit(test.op); (resp == nil) != test.allowed {
+			t.Errorf("%s %v should be allowed: %v, got %v", test.op.Command, test.op.Parameters[len(test.op.Parameters)-1], test.allowed, resp)
+		}
+	}
+}
+
+func TestRestGrpcAuth(t *testing.T) {
+
+	hash, e := backend.HashSecret("correct horse battery staple")
+
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	auth := newAuthenticator(&authConfig{Required: true, Clients: []authClient{{Id: "app", Secret: hash,
+		Acl: &backend.Acl{Commands: []string{"*"}, Users: []backend.UserRange{{From: 0, To: 9}}}}}})
+
+	rest := newRestHandler(auth)
+
+	for _, test := range []struct {
+		path, secret string
+		code         int
+	}{
+		{"/users/5", "", http.StatusUnauthorized},
+		{"/users/5", "wrong horse battery staple", http.StatusUnauthorized},
+		{"/users/50", "correct horse battery staple", http.StatusForbidden},
+		{"/templates/welcome/en", "correct horse battery staple", http.StatusBadRequest}, //needs postgres
+	} {
+		req := httptest.NewRequest("GET", test.path, nil)
+
+		if test.secret != "" {
+			req.SetBasicAuth("app", test.secret)
+		}
+
+		w := httptest.NewRecorder()
+		rest.ServeHTTP(w, req)
+
+		if w.Code != test.code {
+			t.Errorf("GET %s replied %d, expected %d: %s", test.path, w.Code, test.code, w.Body)
+		}
+
+		if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("GET %s replied 401 without WWW-Authenticate", test.path)
+		}
+	}
+
+	srv := &grpcServer{auth: auth}
+
+	if _, e = srv.login(context.Background()); status.Code(e) != codes.Unauthenticated {
+		t.Errorf("Expected Unauthenticated without credentials, got %v", e)
+	}
+
+	credentials := base64.StdEncoding.EncodeToString([]byte("app:correct horse battery staple"))
+
+	ctx, e := srv.login(metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Basic "+credentials)))
+
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	if e = grpcPermit(ctx, adduser, int64(5)); e != nil {
+		t.Errorf("User in range not allowed: %v", e)
+	}
+
+	if e = grpcPermit(ctx, adduser, int64(50)); status.Code(e) != codes.PermissionDenied {
+		t.Errorf("Expected PermissionDenied for a user out of range, got %v", e)
+	}
+
+	if _, e = srv.push(ctx, 5, "retry-1", backend.Message{}); status.Code(e) != codes.FailedPrecondition {
+		t.Errorf("Expected FailedPrecondition for an idempotency key without Postgres, got %v", e)
+	}
+}
+
+// testCert is a certificate for tests, with its key and their PEM encoding
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPem []byte
+	keyPem  []byte
+}
+
+// newTestCert issues a certificate for subject signed by parent, or a self-signed CA if parent is nil
+func newTestCert(t *testing.T, subject pkix.Name, parent *testCert) *testCert {
+
+	key, e := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	serial, e := rand.Int(rand.Reader, big.NewInt(1<<62))
+
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      subject,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+
+	signer, signerKey := template, key
+
+	if parent == nil {
+		template.IsCA, template.BasicConstraintsValid = true, true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, e := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	cert, e := x509.ParseCertificate(der)
+
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	keyDer, e := x509.MarshalECPrivateKey(key)
+
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPem:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}),
+	}
+}
+
+func (cert *testCert) tlsCert() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{cert.cert.Raw}, PrivateKey: cert.key}
+}
+
+// writeTlsFiles stores the certificate of the server and the client CA where params expects them
+func writeTlsFiles(t *testing.T, params *tlsParams, server, ca *testCert) {
+
+	for path, data := range map[string][]byte{params.Cert: server.certPem, params.Key: server.keyPem, params.ClientCa: ca.certPem} {
+		if e := ioutil.WriteFile(path, data, 0600); e != nil {
+			t.Fatal(e)
+		}
+	}
+}
+
+func TestTlsReload(t *testing.T) {
+
+	dir := t.TempDir()
+	ca := newTestCert(t, pkix.Name{CommonName: "ca"}, nil)
+	server := newTestCert(t, pkix.Name{CommonName: "pushed"}, ca)
+
+	params := &tlsParams{
+		Cert:     filepath.Join(dir, "cert.pem"),
+		Key:      filepath.Join(dir, "key.pem"),
+		ClientCa: filepath.Join(dir, "ca.pem"),
+	}
+
+	writeTlsFiles(t, params, server, ca)
+
+	reloader, e := newTlsReloader(params)
+
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	if auth := reloader.current.Load().ClientAuth; auth != tls.RequireAndVerifyClientCert {
+		t.Errorf("Expected client certificates to be required with ClientCa, got %v", auth)
+	}
+
+	params.OptionalClientCert = true
+
+	if e = reloader.reload(); e != nil {
+		t.Fatal(e)
+	}
+
+	loaded := reloader.current.Load()
+
+	if loaded.ClientAuth != tls.VerifyClientCertIfGiven {
+		t.Errorf("Expected client certificates to be optional with OptionalClientCert, got %v", loaded.ClientAuth)
+	}
+
+	for _, broken := range []string{params.Cert, params.ClientCa} {
+
+		ioutil.WriteFile(broken, []byte("gigia"), 0600)
+
+		if e = reloader.reload(); e == nil {
+			t.Errorf("Broken %s loaded", filepath.Base(broken))
+		}
+
+		if reloader.current.Load() != loaded {
+			t.Errorf("Configuration replaced after failing to load %s", filepath.Base(broken))
+		}
+
+		writeTlsFiles(t, params, server, ca)
+	}
+
+	renewed := newTestCert(t, pkix.Name{CommonName: "pushed"}, ca)
+	writeTlsFiles(t, params, renewed, ca)
+
+	if e = reloader.reload(); e != nil {
+		t.Fatal(e)
+	}
+
+	if !bytes.Equal(reloader.current.Load().Certificates[0].Certificate[0], renewed.cert.Raw) {
+		t.Error("Renewed certificate not loaded")
+	}
+
+	params.ClientCa = ""
+
+	if e = reloader.reload(); e != nil || reloader.current.Load().ClientAuth != tls.NoClientCert {
+		t.Errorf("Expected no client certificates without ClientCa, error %v", e)
+	}
+}
+
+func TestTlsHandshake(t *testing.T) {
+
+	dir := t.TempDir()
+	ca := newTestCert(t, pkix.Name{CommonName: "ca"}, nil)
+	app := newTestCert(t, pkix.Name{CommonName: "app"}, ca)
+	nameless := newTestCert(t, pkix.Name{Organization: []string{"Gigia"}}, ca)
+	stranger := newTestCert(t, pkix.Name{CommonName: "app"}, newTestCert(t, pkix.Name{CommonName: "other ca"}, nil))
+
+	params := &tlsParams{
+		Cert:     filepath.Join(dir, "cert.pem"),
+		Key:      filepath.Join(dir, "key.pem"),
+		ClientCa: filepath.Join(dir, "ca.pem"),
+	}
+
+	writeTlsFiles(t, params, newTestCert(t, pkix.Name{CommonName: "pushed"}, ca), ca)
+
+	reloader, e := newTlsReloader(params)
+
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	inner, e := net.Listen("tcp", "127.0.0.1:0")
+
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	listener := reloader.listener(inner)
+	defer listener.Close()
+
+	acl := &backend.Acl{Commands: []string{"PUSH"}}
+	auth := newAuthenticator(&authConfig{Required: true, Clients: []authClient{{Id: "app", Acl: acl}}})
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	type accepted struct {
+		sess *session
+		e    error
+	}
+
+	// handshake connects with cert, if not nil, and returns the session the server side got out of it
+	handshake := func(cert *testCert) (*session, error) {
+
+		results := make(chan accepted, 1)
+
+		go func() {
+			conn, e := listener.Accept()
+
+			if e != nil {
+				results <- accepted{e: e}
+				return
+			}
+
+			defer conn.Close()
+
+			if e = conn.(*tls.Conn).Handshake(); e != nil {
+				results <- accepted{e: e}
+				return
+			}
+
+			sess := &session{conn: conn}
+			auth.authorize(sess, []byte("PUSH 1"))
+
+			results <- accepted{sess: sess}
+		}()
+
+		config := &tls.Config{RootCAs: roots, ServerName: "127.0.0.1"}
+
+		if cert != nil {
+			config.Certificates = []tls.Certificate{cert.tlsCert()}
+		}
+
+		if conn, e := tls.Dial("tcp", inner.Addr().String(), config); e == nil {
+			conn.Read(make([]byte, 1)) //with TLS 1.3, the server checks the certificate after the client is done
+			conn.Close()
+		}
+
+		res := <-results
+
+		return res.sess, res.e
+	}
+
+	if sess, e := handshake(app); e != nil || sess.subject != "app" || sess.client != "app" || sess.acl != acl {
+		t.Errorf("Expected the certificate to authenticate as app, got %+v, error %v", sess, e)
+	}
+
+	if _, e = handshake(nil); e == nil {
+		t.Error("Handshake without a client certificate accepted with ClientCa")
+	}
+
+	if _, e = handshake(stranger); e == nil {
+		t.Error("Client certificate of another CA accepted")
+	}
+
+	params.OptionalClientCert = true
+
+	if e = reloader.reload(); e != nil {
+		t.Fatal(e)
+	}
+
+	if sess, e := handshake(nil); e != nil || sess.subject != "" || sess.client != "" {
+		t.Errorf("Expected an anonymous session without a client certificate, got %+v, error %v", sess, e)
+	}
+
+	if sess, e := handshake(nameless); e != nil || sess.subject != "O=Gigia" || sess.client != "" {
+		t.Errorf("Expected the whole subject of a certificate without a common name, got %+v, error %v", sess, e)
+	}
+
+	if sess, e := handshake(app); e != nil || sess.client != "app" {
+		t.Errorf("Expected an optional certificate to authenticate as app, got %+v, error %v", sess, e)
+	}
+
+	plain, other := net.Pipe()
+	defer plain.Close()
+	defer other.Close()
+
+	if subject := peerSubject(plain); subject != "" {
+		t.Errorf("Expected no subject outside TLS, got %s", subject)
+	}
+}
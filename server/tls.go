@@ -0,0 +1,202 @@
+/*  Pushed - a daemon for parallel handling of push operations to mobile devices
+ *  Copyright (C) 2014  Marco Cilloni <marco.cilloni@yahoo.com>
+ *
+ *  This Source Code Form is subject to the terms of the Mozilla Public
+ *  License, v. 2.0. If a copy of the MPL was not distributed with this
+ *  file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *  Exhibit B is not attached; this software is compatible with the
+ *  licenses expressed under Section 1.12 of the MPL v2.
+ */
+
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"sync/atomic"
+)
+
+// tlsParams enables TLS on the line protocol listener. With ClientCa, clients must present a certificate signed
+// by one of its CAs, unless OptionalClientCert is set.
+type tlsParams struct {
+	Cert               string
+	Key                string
+	MinVersion         string   //1.0 to 1.3, 1.2 if empty
+	Ciphers            []string //names of the cipher suites allowed up to TLS 1.2, Go defaults if empty
+	ClientCa           string   //PEM bundle of the CAs client certificates are verified against
+	OptionalClientCert bool
+}
+
+// tlsReloader keeps the TLS configuration built from tlsParams, reloading the files it refers to on demand.
+// Handshakes always get the last configuration that loaded successfully.
+type tlsReloader struct {
+	params  *tlsParams
+	current atomic.Pointer[tls.Config]
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// check validates the parts of params that do not need the files, so that errors show up while parsing the config
+func (params *tlsParams) check() error {
+
+	if params.Cert == "" || params.Key == "" {
+		return errors.New("TLS needs both Cert and Key")
+	}
+
+	if _, ok := tlsVersions[params.MinVersion]; params.MinVersion != "" && !ok {
+		return errors.New("Unknown TLS version " + params.MinVersion + ", must be one of 1.0, 1.1, 1.2 or 1.3")
+	}
+
+	_, e := tlsCiphers(params.Ciphers)
+
+	return e
+}
+
+func tlsCiphers(names []string) ([]uint16, error) {
+
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	known := make(map[string]uint16)
+
+	for _, suite := range tls.CipherSuites() {
+		known[suite.Name] = suite.ID
+	}
+
+	ids := make([]uint16, 0, len(names))
+
+	for _, name := range names {
+
+		id, ok := known[name]
+
+		if !ok {
+			return nil, errors.New("Unknown or insecure cipher suite " + name)
+		}
+
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
+func newTlsReloader(params *tlsParams) (*tlsReloader, error) {
+
+	reloader := &tlsReloader{params: params}
+
+	if e := reloader.reload(); e != nil {
+		return nil, e
+	}
+
+	return reloader, nil
+}
+
+// reload reads the certificate, the key and the client CAs again. On failure the previous ones are kept.
+func (reloader *tlsReloader) reload() error {
+
+	params := reloader.params
+
+	cert, e := tls.LoadX509KeyPair(params.Cert, params.Key)
+
+	if e != nil {
+		return e
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if params.MinVersion != "" {
+		config.MinVersion = tlsVersions[params.MinVersion]
+	}
+
+	if config.CipherSuites, e = tlsCiphers(params.Ciphers); e != nil {
+		return e
+	}
+
+	if params.ClientCa != "" {
+
+		bundle, e := ioutil.ReadFile(params.ClientCa)
+
+		if e != nil {
+			return e
+		}
+
+		config.ClientCAs = x509.NewCertPool()
+
+		if !config.ClientCAs.AppendCertsFromPEM(bundle) {
+			return errors.New("No certificates found in " + params.ClientCa)
+		}
+
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+
+		if params.OptionalClientCert {
+			config.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+	}
+
+	reloader.current.Store(config)
+
+	log.Printf("Loaded TLS certificate %s", params.Cert)
+
+	return nil
+}
+
+// config returns a TLS configuration handing out the last one loaded to each handshake, offering nextProtos
+// through ALPN if given
+func (reloader *tlsReloader) config(nextProtos ...string) *tls.Config {
+
+	return &tls.Config{
+		NextProtos: nextProtos,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+
+			config := reloader.current.Load()
+
+			if len(nextProtos) > 0 {
+				config = config.Clone()
+				config.NextProtos = nextProtos
+			}
+
+			return config, nil
+		},
+	}
+}
+
+func (reloader *tlsReloader) listener(inner net.Listener, nextProtos ...string) net.Listener {
+	return tls.NewListener(inner, reloader.config(nextProtos...))
+}
+
+// peerSubject returns the common name of the verified client certificate of conn, or its whole subject if it
+// has none. It is empty if conn is not TLS, or if the client gave no certificate.
+func peerSubject(conn net.Conn) string {
+
+	tlsConn, ok := conn.(*tls.Conn)
+
+	if !ok {
+		return ""
+	}
+
+	state := tlsConn.ConnectionState()
+
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return ""
+	}
+
+	subject := state.VerifiedChains[0][0].Subject
+
+	if subject.CommonName != "" {
+		return subject.CommonName
+	}
+
+	return subject.String()
+}